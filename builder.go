@@ -0,0 +1,229 @@
+package gopipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// Stage is a typed pipeline stage that turns an input of type In into an output of type Out
+type Stage[In any, Out any] func(input In) Out
+
+// Builder builds a pipeline whose stages are checked for type compatibility at compile time. Out is the output type of
+// the last stage added to the builder, and therefore the input type of the next one. The stages of a typed pipeline
+// always form a chain; use Pipeline.Connect on an untyped pipeline to build other topologies.
+type Builder[Out any] struct {
+	pipeline *types.Pipeline                // The untyped pipeline being built
+	options  []func(*types.StageDefinition) // The options to apply to the next stage added to the builder
+}
+
+// NewBuilder starts a typed pipeline with the function of the first stage. The function is called repeatedly on the
+// first stage workers, and should return false once it has no more items to produce.
+func NewBuilder[Out any](source func() (Out, bool)) *Builder[Out] {
+	builder := new(Builder[Out])
+	builder.pipeline = types.NewPipeline(nil)
+	builder.pipeline.AddStage(func(arg interface{}) interface{} {
+		output, ok := source()
+		if !ok {
+			return types.EndOfStream
+		}
+		return output
+	}).Named(types.FunctionName(source))
+	var output Out
+	builder.pipeline.AddRegisterTypes(output)
+	return builder
+}
+
+// AddStage appends a stage to the pipeline being built. The stage's input type must match the output type of the
+// previous stage. Since Go methods cannot have type parameters of their own, this is a function rather than a method.
+func AddStage[In any, Out any](builder *Builder[In], stage Stage[In, Out]) *Builder[Out] {
+	nextBuilder := new(Builder[Out])
+	nextBuilder.pipeline = builder.pipeline
+	definition := nextBuilder.pipeline.AddStage(func(arg interface{}) interface{} {
+		return stage(convertArg[In](arg))
+	}).Named(types.FunctionName(stage))
+	builder.applyOptions(definition)
+	var output Out
+	nextBuilder.pipeline.AddRegisterTypes(output)
+	return nextBuilder
+}
+
+// AddErrorStage appends a stage that can fail to the pipeline being built. Errors returned by the stage are handled
+// according to the given policy.
+func AddErrorStage[In any, Out any](builder *Builder[In], stage func(input In) (Out, error),
+	policy types.ErrorPolicy) *Builder[Out] {
+	nextBuilder := new(Builder[Out])
+	nextBuilder.pipeline = builder.pipeline
+	definition := nextBuilder.pipeline.AddErrorStage(func(arg interface{}) (interface{}, error) {
+		return stage(convertArg[In](arg))
+	}, policy).Named(types.FunctionName(stage))
+	builder.applyOptions(definition)
+	var output Out
+	nextBuilder.pipeline.AddRegisterTypes(output)
+	return nextBuilder
+}
+
+// AddStatefulStage appends a stage with access to the keyed state of its worker to the pipeline being built. The state
+// is checkpointed to disk, and moves with the worker when the scheduler moves it to another node. Every value stored in
+// the state must be of a type passed to Builder.Register.
+func AddStatefulStage[In any, Out any](builder *Builder[In],
+	stage func(input In, state *types.StateStore) Out) *Builder[Out] {
+	nextBuilder := new(Builder[Out])
+	nextBuilder.pipeline = builder.pipeline
+	definition := nextBuilder.pipeline.AddStatefulStage(func(arg interface{}, state *types.StateStore) interface{} {
+		return stage(convertArg[In](arg), state)
+	}).Named(types.FunctionName(stage))
+	builder.applyOptions(definition)
+	var output Out
+	nextBuilder.pipeline.AddRegisterTypes(output)
+	return nextBuilder
+}
+
+// AddFlatMapStage appends a stage that can produce zero or more outputs for every input to the pipeline being built.
+// The stage passes each of its outputs to emit.
+func AddFlatMapStage[In any, Out any](builder *Builder[In], stage func(input In, emit func(output Out))) *Builder[Out] {
+	nextBuilder := new(Builder[Out])
+	nextBuilder.pipeline = builder.pipeline
+	definition := nextBuilder.pipeline.AddFlatMapStage(func(arg interface{}, emit types.Emitter) {
+		stage(convertArg[In](arg), func(output Out) {
+			emit(output)
+		})
+	}).Named(types.FunctionName(stage))
+	builder.applyOptions(definition)
+	var output Out
+	nextBuilder.pipeline.AddRegisterTypes(output)
+	return nextBuilder
+}
+
+// AddFilterStage appends a stage that forwards the inputs accepted by keep unchanged, and drops the others, to the
+// pipeline being built
+func AddFilterStage[T any](builder *Builder[T], keep func(input T) bool) *Builder[T] {
+	nextBuilder := new(Builder[T])
+	nextBuilder.pipeline = builder.pipeline
+	definition := nextBuilder.pipeline.AddFilterStage(func(arg interface{}) bool {
+		return keep(convertArg[T](arg))
+	}).Named(types.FunctionName(keep))
+	builder.applyOptions(definition)
+	return nextBuilder
+}
+
+// PartitionBy partitions the inputs of the next stage added to the builder by the given key, so that inputs with the
+// same key are always processed by the same worker of that stage
+func PartitionBy[T any](builder *Builder[T], key func(input T) string) *Builder[T] {
+	return builder.withOption(func(stage *types.StageDefinition) {
+		stage.PartitionBy(func(item interface{}) string {
+			return key(convertArg[T](item))
+		})
+	})
+}
+
+// InOrder makes the next stage added to the builder process its inputs in the order the first stage produced them.
+// See StageDefinition.InOrder for the meaning of capacity and maxWait.
+func InOrder[T any](builder *Builder[T], capacity int, maxWait time.Duration) *Builder[T] {
+	return builder.withOption(func(stage *types.StageDefinition) {
+		stage.InOrder(capacity, maxWait)
+	})
+}
+
+// RouteBy sets the policy with which the next stage added to the builder receives its inputs. See
+// StageDefinition.RouteBy.
+func RouteBy[T any](builder *Builder[T], policy types.RoutingPolicy) *Builder[T] {
+	return builder.withOption(func(stage *types.StageDefinition) {
+		stage.RouteBy(policy)
+	})
+}
+
+// withOption returns a builder for the same pipeline that applies the given option, along with the options collected
+// so far, to the next stage added to it
+func (builder *Builder[Out]) withOption(option func(*types.StageDefinition)) *Builder[Out] {
+	nextBuilder := new(Builder[Out])
+	nextBuilder.pipeline = builder.pipeline
+	nextBuilder.options = make([]func(*types.StageDefinition), 0, len(builder.options)+1)
+	nextBuilder.options = append(nextBuilder.options, builder.options...)
+	nextBuilder.options = append(nextBuilder.options, option)
+	return nextBuilder
+}
+
+// applyOptions applies the options collected by the builder to the stage that was just added
+func (builder *Builder[Out]) applyOptions(stage *types.StageDefinition) {
+	for _, option := range builder.options {
+		option(stage)
+	}
+}
+
+// AddBatchStage appends a stage that processes batches of up to batchSize inputs to the pipeline being built. A batch
+// is processed once it is full, or batchTimeout after its first input arrived.
+func AddBatchStage[In any, Out any](builder *Builder[In], stage func(inputs []In) []Out, batchSize int,
+	batchTimeout time.Duration) *Builder[Out] {
+	nextBuilder := new(Builder[Out])
+	nextBuilder.pipeline = builder.pipeline
+	definition := nextBuilder.pipeline.AddBatchStage(func(args []interface{}) []interface{} {
+		inputs := make([]In, 0, len(args))
+		for _, arg := range args {
+			inputs = append(inputs, convertArg[In](arg))
+		}
+		outputs := make([]interface{}, 0)
+		for _, output := range stage(inputs) {
+			outputs = append(outputs, output)
+		}
+		return outputs
+	}, batchSize, batchTimeout).Named(types.FunctionName(stage))
+	builder.applyOptions(definition)
+	var output Out
+	nextBuilder.pipeline.AddRegisterTypes(output)
+	return nextBuilder
+}
+
+// Register adds values of types that are not passed between the stages, but must still be encoded with gob, such as
+// the types of the values stored in the state of stateful stages
+func (builder *Builder[Out]) Register(values ...interface{}) *Builder[Out] {
+	builder.pipeline.AddRegisterTypes(values...)
+	return builder
+}
+
+// UseCodec encodes the items passed between the stages with the codec registered under the given name. See
+// Pipeline.UseCodec.
+func (builder *Builder[Out]) UseCodec(name string) *Builder[Out] {
+	builder.pipeline.UseCodec(name)
+	return builder
+}
+
+// Build returns the untyped pipeline built so far
+func (builder *Builder[Out]) Build() *types.Pipeline {
+	return builder.pipeline
+}
+
+// Run runs the built pipeline on this node, like RunPipeline. If sink is not nil, the master passes every result of
+// the last stage to it, one at a time.
+func (builder *Builder[Out]) Run(sink func(result Out)) {
+	var resultSink types.ResultSink
+	if sink != nil {
+		resultSink = func(result interface{}) {
+			sink(convertArg[Out](result))
+		}
+	}
+	RunPipeline(builder.pipeline, resultSink)
+}
+
+// convertArg converts a decoded stage input back into its static type. A nil input is converted into the zero value
+// of the type, since gob does not transmit nil interface and pointer values. Inputs decoded by the JSON codec come in
+// their generic representation, and are converted by encoding them as JSON again and decoding them into the type.
+func convertArg[T any](arg interface{}) T {
+	var value T
+	if arg == nil {
+		return value
+	}
+	if typed, ok := arg.(T); ok {
+		return typed
+	}
+	encoded, err := json.Marshal(arg)
+	if err == nil {
+		err = json.Unmarshal(encoded, &value)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Could not convert a stage input of type %T into %T: %v", arg, value, err))
+	}
+	return value
+}
@@ -0,0 +1,54 @@
+package gopipeline
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+func builderTestSource() (int, bool) {
+	return 0, false
+}
+
+func builderTestDouble(input int) int {
+	return input * 2
+}
+
+func builderTestNegate(input int) int {
+	return -input
+}
+
+func builderTestIsEven(input int) bool {
+	return input%2 == 0
+}
+
+// builderTestIdentities returns the identity of every stage of the given pipeline
+func builderTestIdentities(pipeline *types.Pipeline) []string {
+	identities := make([]string, 0)
+	for _, stage := range pipeline.Stages {
+		identities = append(identities, stage.Identity())
+	}
+	return identities
+}
+
+// TestBuilderStageIdentity checks that the stages added with the builder are identified by the functions they wrap
+// rather than by the builder's closures, so that a worker built with different or reordered stages is refused
+func TestBuilderStageIdentity(t *testing.T) {
+	doubleThenNegate := AddStage(AddStage(NewBuilder(builderTestSource), builderTestDouble), builderTestNegate)
+	negateThenDouble := AddStage(AddStage(NewBuilder(builderTestSource), builderTestNegate), builderTestDouble)
+	identities := builderTestIdentities(doubleThenNegate.Build())
+	want := []string{"map github.com/ffrankies/gopipeline.builderTestSource",
+		"map github.com/ffrankies/gopipeline.builderTestDouble", "map github.com/ffrankies/gopipeline.builderTestNegate"}
+	if !reflect.DeepEqual(identities, want) {
+		t.Errorf("got identities %v, want %v", identities, want)
+	}
+	reordered := builderTestIdentities(negateThenDouble.Build())
+	if identities[1] == reordered[1] || identities[2] == reordered[2] {
+		t.Errorf("reordered stages have the same identities: %v and %v", identities, reordered)
+	}
+	filtered := AddFilterStage(NewBuilder(builderTestSource), builderTestIsEven).Build()
+	if identity := filtered.Stages[1].Identity(); identity != "filter github.com/ffrankies/gopipeline.builderTestIsEven" {
+		t.Errorf("got filter stage identity %q, want it named after builderTestIsEven", identity)
+	}
+}
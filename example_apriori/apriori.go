@@ -245,5 +245,8 @@ func main() {
 	for i := 0; i < 4; i++ {
 		functionList = append(functionList, NextIteration)
 	}
-	gopipeline.Run(functionList, Parameters{})
+	pipeline := types.NewPipeline(functionList, Parameters{})
+	// The set lists passed between the iterations are large and repetitive, so they are compressed
+	pipeline.Compress(types.FlateCompression, 1024)
+	gopipeline.RunPipeline(pipeline, nil)
 }
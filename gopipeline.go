@@ -29,19 +29,36 @@ func getProcessType() (processType string, err error) {
 // Run runs either the master or the worker stage on a single node. Also parses the command-line arguments needed for
 // the worker and/or master
 func Run(functionList []types.AnyFunc, registerType interface{}) {
+	RunWithSink(functionList, registerType, nil)
+}
+
+// RunWithSink works like Run, but the master process passes every result produced by the last stage of the pipeline
+// to the given sink, one at a time. If the sink is nil, the results of the last stage are discarded. On the master,
+// RunWithSink returns once the pipeline has finished, which only happens if the first stage returns types.EndOfStream.
+func RunWithSink(functionList []types.AnyFunc, registerType interface{}, sink types.ResultSink) {
+	RunPipeline(types.NewPipeline(functionList, registerType), sink)
+}
+
+// RunPipeline runs either the master or the worker stage of the given pipeline on a single node. The types passed
+// between the stages are registered with gob once, before the master or worker starts. Panics if the topology of the
+// pipeline is invalid.
+func RunPipeline(pipeline *types.Pipeline, sink types.ResultSink) {
 	program := os.Args[0]
+	if err := pipeline.Validate(); err != nil {
+		panic(err)
+	}
 	processType, err := getProcessType()
 	if err != nil {
 		panic(err)
 	}
 	if processType == "master" {
 		options := common.NewMasterOptions(program)
-		master.Run(options, functionList)
+		master.Run(options, pipeline, sink)
 		return
 	}
 	if processType == "worker" {
 		options := common.NewWorkerOptions()
-		worker.Run(options, functionList, registerType)
+		worker.Run(options, pipeline)
 		return
 	}
 }
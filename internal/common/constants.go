@@ -9,4 +9,18 @@ const (
 	MsgStartWorker      int = 4
 	MsgBreakConnection  int = 5
 	MsgNotifyExit       int = 6
+	MsgEndOfStream      int = 7
+	MsgDrainStage       int = 8
+	MsgStageDone        int = 9
+	MsgStageFailure     int = 10
+	MsgAbortPipeline    int = 11
+	MsgStageState       int = 12
+	MsgSequenceSkip     int = 13
+	MsgAcknowledge      int = 14
+	MsgBarrier          int = 15
+	MsgCheckpointDone   int = 16
+	MsgRestore          int = 17
+	MsgCredit           int = 18
+	MsgOpenSession      int = 19
+	MsgReply            int = 20
 )
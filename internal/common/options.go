@@ -1,11 +1,17 @@
 package common
 
-import "flag"
+import (
+	"flag"
+	"time"
+)
 
 // MasterOptions contains the command-line options passed to the master process
 type MasterOptions struct {
-	Program    string // The program to run on the worker nodes
-	ConfigPath string // The path to the config file
+	Program        string // The program to run on the worker nodes
+	ConfigPath     string // The path to the config file
+	DeadLetterPath string // The path to the file in which to store the inputs that stages failed to process
+	CheckpointPath string // The path to the file in which to store the last completed checkpoint
+	Restore        bool   // Whether to start the pipeline from the last completed checkpoint
 }
 
 // NewMasterOptions parses the command-line flags for starting a new master process and stores them in an
@@ -14,15 +20,27 @@ func NewMasterOptions(program string) *MasterOptions {
 	options := new(MasterOptions)
 	options.Program = program
 	flag.StringVar(&options.ConfigPath, "config", "GoPipeline.config.yaml", "The path to a config file")
+	flag.StringVar(&options.DeadLetterPath, "deadletters", "GoPipeline.deadletters.jsonl",
+		"The path to the file in which to store the inputs that stages failed to process")
+	flag.StringVar(&options.CheckpointPath, "checkpoints", "GoPipeline.checkpoint.gob",
+		"The path to the file in which to store the last completed checkpoint")
+	flag.BoolVar(&options.Restore, "restore", false, "Start the pipeline from the last completed checkpoint")
 	flag.Parse()
 	return options
 }
 
 // WorkerOptions contains the command-line options passed to the worker process
 type WorkerOptions struct {
-	MasterAddress string // The internet address of the master node
-	Position      int    // The position of the worker process within the pipeline stages
-	StageID       string // The ID of the stage being run by this worker
+	MasterAddress      string        // The internet address of the master node
+	Position           int           // The position of the worker process within the pipeline stages
+	StageID            string        // The ID of the stage being run by this worker
+	SendResults        bool          // Whether a worker running the last stage should send its results to the master
+	AwaitState         bool          // Whether the worker should wait for the state of the worker it replaces
+	CheckpointInterval time.Duration // The time between two checkpoints of the state of a stateful stage
+	Origin             string        // The ID of the failed source stage worker whose stream this worker carries on
+	Resume             uint64        // The number of items of the carried on stream that are not sent again
+	QueueCapacity      int           // The maximum number of items in each of the worker's queues
+	TLS                bool          // Whether to read the TLS identity issued by the master from the standard input
 }
 
 // NewWorkerOptions parses the command-line flags for starting a new worker process and stores them in an
@@ -33,6 +51,17 @@ func NewWorkerOptions() *WorkerOptions {
 		"The internet address of the node running the master process")
 	flag.StringVar(&options.StageID, "id", "", "The ID of the stage to be executed")
 	flag.IntVar(&options.Position, "position", 0, "The position of the worker process within the pipeline stages")
+	flag.BoolVar(&options.SendResults, "results", false, "Send the results of the last stage to the master")
+	flag.BoolVar(&options.AwaitState, "awaitstate", false,
+		"Wait for the state of the replaced worker before processing any inputs")
+	flag.DurationVar(&options.CheckpointInterval, "checkpoint", 10*time.Second,
+		"The time between two checkpoints of the state of a stateful stage")
+	flag.StringVar(&options.Origin, "origin", "", "The ID of the failed source stage worker whose stream to carry on")
+	flag.Uint64Var(&options.Resume, "resume", 0, "The number of items of the carried on stream not to send again")
+	flag.IntVar(&options.QueueCapacity, "queue", 1000,
+		"The maximum number of items in the input and output queues, and the credits given to each previous worker")
+	flag.BoolVar(&options.TLS, "tls", false,
+		"Read the TLS identity issued by the master from the standard input, and secure every connection with it")
 	flag.Parse()
 	return options
 }
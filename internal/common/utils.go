@@ -2,6 +2,7 @@ package common
 
 import (
 	"net"
+	"strconv"
 	"strings"
 )
 
@@ -41,3 +42,9 @@ func CombineAddressAndPort(address string, port string) (netAddress string) {
 	}
 	return
 }
+
+// StateFileName returns the name of the file in the home directory of its node to which a worker of a stateful stage
+// periodically checkpoints its state. The master reads it back to restore the state if the worker fails.
+func StateFileName(position int, workerID string) string {
+	return "gopipeline" + strconv.Itoa(position) + "." + workerID + ".state"
+}
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// compressor compresses the payloads of the frames sent along a connection with the agreed compression algorithm
+type compressor struct {
+	algorithm string                             // The name of the compression algorithm
+	threshold int                                // The size in bytes below which payloads are sent uncompressed
+	observer  func(uncompressed, compressed int) // Called with the size of every payload sent compressed. May be nil
+	buffer    *bytes.Buffer                      // Holds the compressed payload
+	writer    io.WriteCloser                     // Compresses into buffer. Reset for every payload
+}
+
+// newCompressor creates a compressor for the given algorithm. Returns an error if the algorithm is not supported.
+func newCompressor(algorithm string, threshold int, observer func(uncompressed, compressed int)) (*compressor,
+	error) {
+	compressor := new(compressor)
+	compressor.algorithm = algorithm
+	compressor.threshold = threshold
+	compressor.observer = observer
+	compressor.buffer = new(bytes.Buffer)
+	switch algorithm {
+	case types.FlateCompression:
+		writer, err := flate.NewWriter(compressor.buffer, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		compressor.writer = writer
+	case types.GzipCompression:
+		compressor.writer = gzip.NewWriter(compressor.buffer)
+	default:
+		return nil, fmt.Errorf("compression %q is not supported", algorithm)
+	}
+	return compressor, nil
+}
+
+// compress returns the compressed payload, and true, if the payload is at least as large as the threshold and
+// compression makes it smaller. Otherwise, returns the payload as it is, and false.
+func (compressor *compressor) compress(payload []byte) ([]byte, bool, error) {
+	if len(payload) < compressor.threshold {
+		return payload, false, nil
+	}
+	compressor.buffer.Reset()
+	switch writer := compressor.writer.(type) {
+	case *flate.Writer:
+		writer.Reset(compressor.buffer)
+	case *gzip.Writer:
+		writer.Reset(compressor.buffer)
+	}
+	if _, err := compressor.writer.Write(payload); err != nil {
+		return nil, false, err
+	}
+	if err := compressor.writer.Close(); err != nil {
+		return nil, false, err
+	}
+	if compressor.buffer.Len() >= len(payload) {
+		return payload, false, nil
+	}
+	if compressor.observer != nil {
+		compressor.observer(len(payload), compressor.buffer.Len())
+	}
+	return compressor.buffer.Bytes(), true, nil
+}
+
+// decompress decompresses a payload compressed with the given algorithm. Returns an error if the decompressed payload
+// would be larger than limit bytes, so that a small frame cannot exhaust the memory of the receiver.
+func decompress(algorithm string, payload []byte, limit int) ([]byte, error) {
+	var reader io.ReadCloser
+	switch algorithm {
+	case types.FlateCompression:
+		reader = flate.NewReader(bytes.NewReader(payload))
+	case types.GzipCompression:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		reader = gzipReader
+	default:
+		return nil, fmt.Errorf("compression %q is not supported", algorithm)
+	}
+	defer reader.Close()
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > limit {
+		return nil, fmt.Errorf("the decompressed payload is larger than the limit of %d bytes", limit)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// TestDecompressLimit checks that payloads are decompressed up to the limit, and that a small payload that would
+// decompress past the limit is refused, with every supported algorithm
+func TestDecompressLimit(t *testing.T) {
+	const limit = 1 << 16
+	for _, algorithm := range []string{types.FlateCompression, types.GzipCompression} {
+		compressor, err := newCompressor(algorithm, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []int{limit, limit + 1, 64 * limit} {
+			original := bytes.Repeat([]byte{'a'}, size)
+			compressed, ok, err := compressor.compress(original)
+			if err != nil || !ok {
+				t.Fatalf("%s: could not compress %d bytes: %v", algorithm, size, err)
+			}
+			decompressed, err := decompress(algorithm, append([]byte(nil), compressed...), limit)
+			switch {
+			case size <= limit && (err != nil || !bytes.Equal(decompressed, original)):
+				t.Errorf("%s: %d bytes were not decompressed back: %v", algorithm, size, err)
+			case size > limit && (err == nil || !strings.Contains(err.Error(), "larger than the limit")):
+				t.Errorf("%s: %d bytes compressed into %d were decompressed past the limit of %d bytes: %v",
+					algorithm, size, len(compressed), limit, err)
+			}
+		}
+	}
+}
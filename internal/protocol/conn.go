@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// Conn is a connection on which the handshake has been performed. Messages are sent as frames whose header carries
+// the type of the message. Messages are encoded with gob, except for the items in result messages, which are encoded
+// with the codec agreed on during the handshake. Since the message is gob-encoded anyway, items sent with the gob
+// codec are left in the message rather than encoded twice.
+type Conn struct {
+	Agreement    Agreement     // The features agreed on during the handshake
+	codec        types.Codec   // The codec for the items in result messages. nil if the agreed codec is gob
+	compressor   *compressor   // Compresses the payloads of the frames sent. nil until CompressAbove is called
+	connection   net.Conn      // The underlying network connection
+	encodeBuffer *bytes.Buffer // Holds the encoding of the message being sent
+	encoder      *gob.Encoder  // Encodes messages into encodeBuffer
+	decodeBuffer *bytes.Buffer // Holds the payload of the frame being received
+	decoder      *gob.Decoder  // Decodes messages from decodeBuffer
+	writeMutex   *sync.Mutex   // Guards sending
+	readMutex    *sync.Mutex   // Guards receiving
+	closeOnce    *sync.Once    // Closes the underlying network connection only once
+}
+
+// newConn wraps a network connection on which the handshake has been performed
+func newConn(connection net.Conn, agreement Agreement) (*Conn, error) {
+	conn := new(Conn)
+	conn.Agreement = agreement
+	if agreement.Codec != types.GobCodec {
+		if conn.codec = types.LookupCodec(agreement.Codec); conn.codec == nil {
+			return nil, fmt.Errorf("codec %q is not registered", agreement.Codec)
+		}
+	}
+	conn.connection = connection
+	conn.encodeBuffer = new(bytes.Buffer)
+	conn.encoder = gob.NewEncoder(conn.encodeBuffer)
+	conn.decodeBuffer = new(bytes.Buffer)
+	conn.decoder = gob.NewDecoder(conn.decodeBuffer)
+	conn.writeMutex = &sync.Mutex{}
+	conn.readMutex = &sync.Mutex{}
+	conn.closeOnce = &sync.Once{}
+	return conn, nil
+}
+
+// CompressAbove compresses the payloads of the frames sent from now on that are at least threshold bytes long, if a
+// compression algorithm was agreed on during the handshake. observer, if not nil, is called with the size of every
+// payload sent compressed, before and after compression.
+func (conn *Conn) CompressAbove(threshold int, observer func(uncompressed int, compressed int)) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if conn.Agreement.Compression == "" || conn.Agreement.Compression == types.NoCompression {
+		return nil
+	}
+	compressor, err := newCompressor(conn.Agreement.Compression, threshold, observer)
+	if err != nil {
+		return err
+	}
+	conn.compressor = compressor
+	return nil
+}
+
+// Encode sends a message as a single frame. If the message could not be encoded with gob or written, the connection is
+// closed, since the gob encoder may have recorded as sent type descriptions that never reached the peer, and the
+// peer's decoder would then fail on every message that follows.
+func (conn *Conn) Encode(message *types.Message) error {
+	flags := uint8(0)
+	if conn.codec != nil && message.Description == common.MsgStageResult {
+		contents, err := conn.codec.Marshal(message.Contents)
+		if err != nil {
+			return fmt.Errorf("could not encode an item with codec %q: %v", conn.codec.Name(), err)
+		}
+		messageCopy := *message
+		messageCopy.Contents = contents
+		message = &messageCopy
+		flags |= FlagCodec
+	}
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if err := conn.writeMessage(message, flags); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// writeMessage encodes the message with gob, compresses it if it is large enough, and writes it as a single frame.
+// Must be called with writeMutex locked.
+func (conn *Conn) writeMessage(message *types.Message, flags uint8) error {
+	conn.encodeBuffer.Reset()
+	if err := conn.encoder.Encode(message); err != nil {
+		return err
+	}
+	payload := conn.encodeBuffer.Bytes()
+	if conn.compressor != nil {
+		compressed, ok, err := conn.compressor.compress(payload)
+		if err != nil {
+			return err
+		}
+		if ok {
+			payload = compressed
+			flags |= FlagCompressed
+		}
+	}
+	return writeFrame(conn.connection, uint16(message.Description), flags, payload)
+}
+
+// Decode receives the next message. Returns an error if the frame's header does not match the message it contains.
+func (conn *Conn) Decode(message *types.Message) error {
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+	header, payload, err := readFrame(conn.connection)
+	if err != nil {
+		return err
+	}
+	if header.Version != Version {
+		return fmt.Errorf("received a frame of protocol version %d from %s, expected version %d", header.Version,
+			conn.RemoteAddr(), Version)
+	}
+	if header.Flags&FlagCompressed != 0 {
+		if payload, err = decompress(conn.Agreement.Compression, payload, maxPayloadSize); err != nil {
+			return fmt.Errorf("could not decompress a frame from %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+	conn.decodeBuffer.Reset()
+	conn.decodeBuffer.Write(payload)
+	if err = conn.decoder.Decode(message); err != nil {
+		return err
+	}
+	if uint16(message.Description) != header.Type {
+		return fmt.Errorf("received a message of type %d from %s in a frame of type %d", message.Description,
+			conn.RemoteAddr(), header.Type)
+	}
+	if header.Flags&FlagCodec != 0 {
+		return conn.decodeContents(message)
+	}
+	return nil
+}
+
+// decodeContents decodes the contents of a message that were encoded with the agreed codec
+func (conn *Conn) decodeContents(message *types.Message) error {
+	contents, ok := message.Contents.([]byte)
+	if conn.codec == nil || !ok {
+		return fmt.Errorf("received a message from %s whose contents were not encoded with codec %q",
+			conn.RemoteAddr(), conn.Agreement.Codec)
+	}
+	item, err := conn.codec.Unmarshal(contents)
+	if err != nil {
+		return fmt.Errorf("could not decode an item from %s with codec %q: %v", conn.RemoteAddr(),
+			conn.codec.Name(), err)
+	}
+	message.Contents = item
+	return nil
+}
+
+// PeerName returns the name in the certificate presented by the other peer, i.e. its worker ID or "master". Returns an
+// empty string if the connection is not secured with TLS.
+func (conn *Conn) PeerName() string {
+	return peerName(conn.connection)
+}
+
+// RemoteAddr returns the address of the other peer
+func (conn *Conn) RemoteAddr() string {
+	return conn.connection.RemoteAddr().String()
+}
+
+// Close closes the connection. Closing a connection that was already closed, for instance because a message could not
+// be sent along it, does nothing.
+func (conn *Conn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		err = conn.connection.Close()
+	})
+	return err
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// unregisteredItem is never registered with gob, so a message carrying one cannot be encoded with the gob codec
+type unregisteredItem struct {
+	Value int
+}
+
+// connPair returns both ends of a connection on which the handshake has been performed with the given codec
+func connPair(t *testing.T, codec string) (*Conn, *Conn) {
+	clientEnd, serverEnd := net.Pipe()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		server, err := Server(serverEnd, DefaultFeatures())
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- server
+	}()
+	client, err := Client(clientEnd, FeaturesFor(codec, types.NoCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, <-accepted
+}
+
+// decodeAsync decodes the next message in the background, and returns where the error of Decode arrives
+func decodeAsync(conn *Conn, message *types.Message) chan error {
+	decoded := make(chan error, 1)
+	go func() {
+		decoded <- conn.Decode(message)
+	}()
+	return decoded
+}
+
+// TestEncodeFailureClosesConn checks that a message that gob fails to encode closes the connection, so that the peer
+// sees the connection end instead of a message it cannot decode, and that later messages are not sent along it
+func TestEncodeFailureClosesConn(t *testing.T) {
+	sender, receiver := connPair(t, types.GobCodec)
+	defer receiver.Close()
+	decoded := decodeAsync(receiver, new(types.Message))
+	bad := &types.Message{Description: common.MsgStageResult, Contents: unregisteredItem{1}}
+	if err := sender.Encode(bad); err == nil {
+		t.Fatal("encoded an item of an unregistered type, want an error")
+	}
+	select {
+	case err := <-decoded:
+		if err == nil {
+			t.Error("the peer decoded a message that was never sent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the peer is still waiting for a message a second after the connection should have been closed")
+	}
+	good := &types.Message{Description: common.MsgStageResult, Contents: "item"}
+	if err := sender.Encode(good); err == nil {
+		t.Error("sent a message along a connection that should have been closed")
+	}
+	if err := sender.Close(); err != nil {
+		t.Errorf("closing the connection again failed: %v", err)
+	}
+}
+
+// TestCodecFailureKeepsConn checks that an item the agreed codec cannot encode is refused without closing the
+// connection, since nothing was written and the gob encoder was not used
+func TestCodecFailureKeepsConn(t *testing.T) {
+	sender, receiver := connPair(t, types.JSONCodec)
+	defer sender.Close()
+	defer receiver.Close()
+	bad := &types.Message{Description: common.MsgStageResult, Contents: make(chan int)}
+	if err := sender.Encode(bad); err == nil {
+		t.Fatal("encoded a channel as JSON, want an error")
+	}
+	received := new(types.Message)
+	decoded := decodeAsync(receiver, received)
+	if err := sender.Encode(&types.Message{Description: common.MsgStageResult, Contents: "item"}); err != nil {
+		t.Fatalf("could not send a message after the codec failed: %v", err)
+	}
+	if err := <-decoded; err != nil || received.Contents != "item" {
+		t.Errorf("the peer decoded %v with error %v, want the item", received.Contents, err)
+	}
+}
@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// handshakeTimeout is the maximum time the handshake of a new connection may take
+const handshakeTimeout = 10 * time.Second
+
+// Features lists the optional features a peer supports, each in order of preference
+type Features struct {
+	Codecs       []string // The names of the codecs the peer can encode and decode messages with
+	Compressions []string // The names of the compression algorithms the peer supports
+}
+
+// Agreement holds the features both peers of a connection agreed on during the handshake
+type Agreement struct {
+	Codec       string // The name of the codec messages are encoded with
+	Compression string // The name of the compression algorithm used for large payloads
+}
+
+// hello is the payload of the first frame sent by the peer that opened the connection
+type hello struct {
+	Features Features // The features supported by the peer that opened the connection
+}
+
+// rejection is the payload of the frame sent back when a connection is rejected
+type rejection struct {
+	Reason string // Why the connection was rejected
+}
+
+// DefaultFeatures returns the features supported by this build of the library, including the codecs registered by
+// the user so far
+func DefaultFeatures() *Features {
+	features := new(Features)
+	features.Codecs = types.CodecNames()
+	features.Compressions = []string{types.NoCompression, types.FlateCompression, types.GzipCompression}
+	return features
+}
+
+// FeaturesFor returns the default features, with the given codec and compression algorithm preferred over the others
+func FeaturesFor(codec string, compression string) *Features {
+	features := DefaultFeatures()
+	features.Codecs = prefer(codec, features.Codecs)
+	features.Compressions = prefer(compression, features.Compressions)
+	return features
+}
+
+// prefer moves the preferred option to the front of the list of options. The list is returned as it is if preferred is
+// empty.
+func prefer(preferred string, options []string) []string {
+	if preferred == "" {
+		return options
+	}
+	reordered := []string{preferred}
+	for _, option := range options {
+		if option != preferred {
+			reordered = append(reordered, option)
+		}
+	}
+	return reordered
+}
+
+// Dial opens a connection to the peer listening at the given address, and performs the handshake. features lists the
+// features this peer supports, in order of preference.
+func Dial(address string, timeout time.Duration, features *Features) (*Conn, error) {
+	var connection net.Conn
+	var err error
+	if timeout > 0 {
+		connection, err = net.DialTimeout("tcp", address, timeout)
+	} else {
+		connection, err = net.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := Client(connection, features)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Client performs the handshake on a connection this peer opened, after securing it with TLS if an identity is in use.
+// Returns an error explaining why if the other peer rejected the connection.
+func Client(connection net.Conn, features *Features) (*Conn, error) {
+	connection.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer connection.SetDeadline(time.Time{})
+	connection, err := secure(connection, false)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(hello{Features: *features})
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFrame(connection, TypeHello, 0, payload); err != nil {
+		return nil, fmt.Errorf("could not send the handshake to %s: %v", connection.RemoteAddr(), err)
+	}
+	header, payload, err := readFrame(connection)
+	if err != nil {
+		return nil, fmt.Errorf("handshake with %s failed: %v", connection.RemoteAddr(), err)
+	}
+	if header.Type == TypeReject {
+		reason := new(rejection)
+		json.Unmarshal(payload, reason)
+		return nil, fmt.Errorf("%s rejected the connection: %s", connection.RemoteAddr(), reason.Reason)
+	}
+	if header.Type != TypeAccept {
+		return nil, fmt.Errorf("handshake with %s failed: expected an accept frame, received frame type %d",
+			connection.RemoteAddr(), header.Type)
+	}
+	if header.Version != Version {
+		return nil, fmt.Errorf("%s speaks protocol version %d, but this peer speaks version %d",
+			connection.RemoteAddr(), header.Version, Version)
+	}
+	agreement := new(Agreement)
+	if err = json.Unmarshal(payload, agreement); err != nil {
+		return nil, fmt.Errorf("handshake with %s failed: %v", connection.RemoteAddr(), err)
+	}
+	if !contains(features.Codecs, agreement.Codec) || !contains(features.Compressions, agreement.Compression) {
+		return nil, fmt.Errorf("%s agreed on codec %q and compression %q, which this peer did not offer",
+			connection.RemoteAddr(), agreement.Codec, agreement.Compression)
+	}
+	return newConn(connection, *agreement)
+}
+
+// Server performs the handshake on a connection accepted by this peer, after securing it with TLS if an identity is in
+// use. Incompatible peers are sent the reason they are rejected before the connection is closed, and the same reason
+// is returned as an error. Peers without a certificate issued by the authority of the run are not sent anything.
+func Server(connection net.Conn, features *Features) (*Conn, error) {
+	connection.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer connection.SetDeadline(time.Time{})
+	secured, err := secure(connection, true)
+	if err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("rejected the connection from %s: %v", connection.RemoteAddr(), err)
+	}
+	connection = secured
+	header, payload, err := readFrame(connection)
+	if err != nil {
+		return nil, reject(connection, err.Error())
+	}
+	if header.Type != TypeHello {
+		return nil, reject(connection, fmt.Sprintf("expected a handshake, received frame type %d", header.Type))
+	}
+	if header.Version != Version {
+		return nil, reject(connection, fmt.Sprintf("protocol version %d is not supported, this peer speaks version %d",
+			header.Version, Version))
+	}
+	received := new(hello)
+	if err = json.Unmarshal(payload, received); err != nil {
+		return nil, reject(connection, "malformed handshake: "+err.Error())
+	}
+	agreement := Agreement{}
+	if agreement.Codec, err = negotiate("codec", received.Features.Codecs, features.Codecs); err != nil {
+		return nil, reject(connection, err.Error())
+	}
+	agreement.Compression, err = negotiate("compression", received.Features.Compressions, features.Compressions)
+	if err != nil {
+		return nil, reject(connection, err.Error())
+	}
+	if payload, err = json.Marshal(agreement); err != nil {
+		return nil, err
+	}
+	if err = writeFrame(connection, TypeAccept, 0, payload); err != nil {
+		return nil, err
+	}
+	return newConn(connection, agreement)
+}
+
+// reject tells the peer why its connection is rejected, closes the connection, and returns the reason as an error
+func reject(connection net.Conn, reason string) error {
+	payload, _ := json.Marshal(rejection{Reason: reason})
+	writeFrame(connection, TypeReject, 0, payload)
+	connection.Close()
+	return fmt.Errorf("rejected the connection from %s: %s", connection.RemoteAddr(), reason)
+}
+
+// negotiate returns the first of the offered options that is also supported
+func negotiate(feature string, offered []string, supported []string) (string, error) {
+	for _, option := range offered {
+		if contains(supported, option) {
+			return option, nil
+		}
+	}
+	return "", fmt.Errorf("no common %s: the peer offered [%s], this peer supports [%s]", feature,
+		strings.Join(offered, ", "), strings.Join(supported, ", "))
+}
+
+// contains returns true if the option is in the list
+func contains(options []string, option string) bool {
+	for _, candidate := range options {
+		if candidate == option {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// handshakeResult is what one side of a test handshake ended with
+type handshakeResult struct {
+	conn *Conn // The connection, if the handshake succeeded
+	err  error // Why the handshake failed, if it did
+}
+
+// TestHandshakeNegotiation checks that both peers agree on the first codec and compression algorithm offered by the
+// client that the server supports, and that the client is told why when there is none
+func TestHandshakeNegotiation(t *testing.T) {
+	tests := []struct {
+		name          string    // The name of the test case
+		client        *Features // The features offered by the client
+		server        *Features // The features supported by the server
+		wantAgreement Agreement // The agreement both peers should end with, if the handshake succeeds
+		wantError     string    // A substring of the error the client should get, or empty if it should succeed
+	}{
+		{
+			"same features",
+			&Features{Codecs: []string{types.GobCodec}, Compressions: []string{types.NoCompression}},
+			&Features{Codecs: []string{types.GobCodec}, Compressions: []string{types.NoCompression}},
+			Agreement{Codec: types.GobCodec, Compression: types.NoCompression}, "",
+		},
+		{
+			"client preference wins",
+			&Features{Codecs: []string{types.JSONCodec, types.GobCodec},
+				Compressions: []string{types.GzipCompression, types.NoCompression}},
+			&Features{Codecs: []string{types.GobCodec, types.JSONCodec},
+				Compressions: []string{types.NoCompression, types.FlateCompression, types.GzipCompression}},
+			Agreement{Codec: types.JSONCodec, Compression: types.GzipCompression}, "",
+		},
+		{
+			"unsupported preference skipped",
+			&Features{Codecs: []string{"protobuf", types.RawCodec},
+				Compressions: []string{"zstd", types.FlateCompression}},
+			DefaultFeatures(),
+			Agreement{Codec: types.RawCodec, Compression: types.FlateCompression}, "",
+		},
+		{
+			"no common codec",
+			&Features{Codecs: []string{types.JSONCodec}, Compressions: []string{types.NoCompression}},
+			&Features{Codecs: []string{types.GobCodec}, Compressions: []string{types.NoCompression}},
+			Agreement{}, "no common codec",
+		},
+		{
+			"no common compression",
+			&Features{Codecs: []string{types.GobCodec}, Compressions: []string{types.GzipCompression}},
+			&Features{Codecs: []string{types.GobCodec}, Compressions: []string{types.NoCompression}},
+			Agreement{}, "no common compression",
+		},
+	}
+	for _, test := range tests {
+		clientEnd, serverEnd := net.Pipe()
+		serverResult := make(chan handshakeResult, 1)
+		go func(features *Features) {
+			conn, err := Server(serverEnd, features)
+			serverResult <- handshakeResult{conn, err}
+		}(test.server)
+		client, err := Client(clientEnd, test.client)
+		server := <-serverResult
+		if test.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("%s: client got error %v, want an error containing %q", test.name, err, test.wantError)
+			}
+			if server.err == nil {
+				t.Errorf("%s: the server accepted the connection, want it rejected", test.name)
+			}
+			clientEnd.Close()
+			continue
+		}
+		if err != nil || server.err != nil {
+			t.Errorf("%s: got client error %v and server error %v, want none", test.name, err, server.err)
+			clientEnd.Close()
+			serverEnd.Close()
+			continue
+		}
+		if client.Agreement != test.wantAgreement || server.conn.Agreement != test.wantAgreement {
+			t.Errorf("%s: client agreed on %v and server on %v, want %v", test.name, client.Agreement,
+				server.conn.Agreement, test.wantAgreement)
+		}
+		client.Close()
+		server.conn.Close()
+	}
+}
+
+// TestHandshakeRejection checks that the server rejects peers that do not open with a handshake in its protocol
+// version, and sends them the reason
+func TestHandshakeRejection(t *testing.T) {
+	payload, _ := json.Marshal(hello{Features: *DefaultFeatures()})
+	tests := []struct {
+		name       string // The name of the test case
+		version    uint8  // The protocol version the client sends
+		frameType  uint16 // The type of the first frame the client sends
+		wantReason string // A substring of the reason the client should be sent
+	}{
+		{"newer version", Version + 1, TypeHello, "protocol version 2 is not supported"},
+		{"older version", Version - 1, TypeHello, "protocol version 0 is not supported"},
+		{"no handshake", Version, 3, "expected a handshake, received frame type 3"},
+	}
+	for _, test := range tests {
+		clientEnd, serverEnd := net.Pipe()
+		serverResult := make(chan handshakeResult, 1)
+		go func() {
+			conn, err := Server(serverEnd, DefaultFeatures())
+			serverResult <- handshakeResult{conn, err}
+		}()
+		frame := append(rawHeader(Magic, test.version, test.frameType, uint32(len(payload))), payload...)
+		if _, err := clientEnd.Write(frame); err != nil {
+			t.Fatalf("%s: could not send the handshake: %v", test.name, err)
+		}
+		header, answer, err := readFrame(clientEnd)
+		if err != nil {
+			t.Fatalf("%s: could not read the answer: %v", test.name, err)
+		}
+		reason := new(rejection)
+		json.Unmarshal(answer, reason)
+		if header.Type != TypeReject || !strings.Contains(reason.Reason, test.wantReason) {
+			t.Errorf("%s: got frame type %d with reason %q, want a rejection containing %q", test.name,
+				header.Type, reason.Reason, test.wantReason)
+		}
+		if server := <-serverResult; server.err == nil {
+			t.Errorf("%s: the server accepted the connection, want it rejected", test.name)
+		}
+		clientEnd.Close()
+	}
+}
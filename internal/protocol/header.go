@@ -0,0 +1,102 @@
+// Package protocol implements the wire protocol spoken between the master and the workers. Every connection starts
+// with a handshake in which the two peers check that they speak the same version of the protocol and agree on the
+// features to use. After the handshake, every message is sent as a frame: a fixed-size header followed by the encoded
+// message.
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Magic identifies a gopipeline peer. It is the first field of every frame header.
+const Magic uint32 = 0x47504C4E // "GPLN"
+
+// Version is the version of the wire protocol implemented by this package. Peers speaking different versions reject
+// each other during the handshake.
+const Version uint8 = 1
+
+// Frame types used by the handshake. Every other frame type is the Description of the message the frame contains.
+const (
+	TypeHello  uint16 = 0xFFF0 // Sent by the peer that opened the connection, with the features it supports
+	TypeAccept uint16 = 0xFFF1 // Sent back when the connection is accepted, with the features agreed on
+	TypeReject uint16 = 0xFFF2 // Sent back when the connection is rejected, with the reason
+)
+
+// FlagCodec is set in the header of a frame whose message contents were encoded with the codec agreed on during the
+// handshake
+const FlagCodec uint8 = 0x01
+
+// FlagCompressed is set in the header of a frame whose payload was compressed with the compression algorithm agreed
+// on during the handshake
+const FlagCompressed uint8 = 0x02
+
+// headerSize is the size in bytes of an encoded header
+const headerSize = 12
+
+// maxPayloadSize is the size of the largest frame payload accepted, so that a corrupt header does not cause a huge
+// allocation
+const maxPayloadSize = 1 << 30
+
+// Header precedes every frame sent on a connection
+type Header struct {
+	Magic   uint32 // Always equal to Magic
+	Version uint8  // The version of the protocol spoken by the sender
+	Flags   uint8  // Describe how the payload is encoded
+	Type    uint16 // The type of the frame: a handshake frame type, or the Description of the message
+	Length  uint32 // The length of the payload that follows the header, in bytes
+}
+
+// String returns a readable representation of the header
+func (header Header) String() string {
+	return fmt.Sprintf("{Magic: %#x, Version: %d, Flags: %#x, Type: %d, Length: %d}", header.Magic, header.Version,
+		header.Flags, header.Type, header.Length)
+}
+
+// writeFrame writes a header with the given type and flags, followed by the payload
+func writeFrame(writer io.Writer, frameType uint16, flags uint8, payload []byte) error {
+	frame := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], Magic)
+	frame[4] = Version
+	frame[5] = flags
+	binary.BigEndian.PutUint16(frame[6:8], frameType)
+	binary.BigEndian.PutUint32(frame[8:12], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+	_, err := writer.Write(frame)
+	return err
+}
+
+// readHeader reads the header of the next frame. Returns an error if the header does not start with Magic, since the
+// peer is then not speaking this protocol at all.
+func readHeader(reader io.Reader) (header Header, err error) {
+	buffer := make([]byte, headerSize)
+	if _, err = io.ReadFull(reader, buffer); err != nil {
+		return
+	}
+	header.Magic = binary.BigEndian.Uint32(buffer[0:4])
+	header.Version = buffer[4]
+	header.Flags = buffer[5]
+	header.Type = binary.BigEndian.Uint16(buffer[6:8])
+	header.Length = binary.BigEndian.Uint32(buffer[8:12])
+	if header.Magic != Magic {
+		err = fmt.Errorf("the peer is not speaking the gopipeline protocol (received magic %#x instead of %#x)",
+			header.Magic, Magic)
+		return
+	}
+	if header.Length > maxPayloadSize {
+		err = fmt.Errorf("the frame payload of %d bytes is larger than the limit of %d bytes", header.Length,
+			maxPayloadSize)
+	}
+	return
+}
+
+// readFrame reads the next frame, and returns its header and payload
+func readFrame(reader io.Reader) (header Header, payload []byte, err error) {
+	if header, err = readHeader(reader); err != nil {
+		return
+	}
+	payload = make([]byte, header.Length)
+	_, err = io.ReadFull(reader, payload)
+	return
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// rawHeader encodes a header with the given fields as they are, so that invalid headers can be tested
+func rawHeader(magic uint32, version uint8, frameType uint16, length uint32) []byte {
+	buffer := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(buffer[0:4], magic)
+	buffer[4] = version
+	binary.BigEndian.PutUint16(buffer[6:8], frameType)
+	binary.BigEndian.PutUint32(buffer[8:12], length)
+	return buffer
+}
+
+// TestFrameRoundTrip checks that a frame read back after being written has the same header fields and payload
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string // The name of the test case
+		frameType uint16 // The type of the frame
+		flags     uint8  // The flags set in the header of the frame
+		payload   []byte // The payload of the frame
+	}{
+		{"empty payload", TypeHello, 0, []byte{}},
+		{"handshake frame", TypeAccept, 0, []byte(`{"Codec":"gob","Compression":"none"}`)},
+		{"codec flag", 3, FlagCodec, []byte("encoded contents")},
+		{"all flags", 3, FlagCodec | FlagCompressed, bytes.Repeat([]byte{0xAB}, 70000)},
+	}
+	for _, test := range tests {
+		buffer := new(bytes.Buffer)
+		if err := writeFrame(buffer, test.frameType, test.flags, test.payload); err != nil {
+			t.Fatalf("%s: could not write the frame: %v", test.name, err)
+		}
+		header, payload, err := readFrame(buffer)
+		if err != nil {
+			t.Fatalf("%s: could not read the frame: %v", test.name, err)
+		}
+		want := Header{Magic: Magic, Version: Version, Flags: test.flags, Type: test.frameType,
+			Length: uint32(len(test.payload))}
+		if header != want {
+			t.Errorf("%s: got header %v, want %v", test.name, header, want)
+		}
+		if !bytes.Equal(payload, test.payload) {
+			t.Errorf("%s: got a payload of %d bytes, want %d bytes", test.name, len(payload), len(test.payload))
+		}
+		if buffer.Len() != 0 {
+			t.Errorf("%s: %d bytes were left unread after the frame", test.name, buffer.Len())
+		}
+	}
+}
+
+// TestReadHeader checks that headers from other protocol versions are read so that the handshake can reject them,
+// and that invalid headers are rejected straight away
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name        string // The name of the test case
+		input       []byte // The bytes the header is read from
+		wantVersion uint8  // The version the header should be read with, if no error is expected
+		wantError   string // A substring of the expected error, or empty if no error is expected
+	}{
+		{"current version", rawHeader(Magic, Version, TypeHello, 0), Version, ""},
+		{"other version", rawHeader(Magic, Version+1, TypeHello, 0), Version + 1, ""},
+		{"bad magic", rawHeader(0x48545450, Version, TypeHello, 0), 0, "not speaking the gopipeline protocol"},
+		{"payload too large", rawHeader(Magic, Version, TypeHello, maxPayloadSize+1), 0, "larger than the limit"},
+		{"truncated header", rawHeader(Magic, Version, TypeHello, 0)[:headerSize-1], 0, "EOF"},
+	}
+	for _, test := range tests {
+		header, err := readHeader(bytes.NewReader(test.input))
+		if test.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("%s: got error %v, want an error containing %q", test.name, err, test.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v, want none", test.name, err)
+		} else if header.Version != test.wantVersion {
+			t.Errorf("%s: got version %d, want %d", test.name, header.Version, test.wantVersion)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// serverName is the name every certificate is issued for. Workers are dialed by IP address, which is only known once
+// they have started, so peers are not verified by name: every certificate signed by the authority of the run is
+// trusted, and the certificate's common name identifies the peer.
+const serverName = "gopipeline"
+
+// certificateLifetime is the time for which the certificates issued by an authority are valid
+const certificateLifetime = 30 * 24 * time.Hour
+
+// tlsConfig is the mutual TLS configuration every connection is secured with. nil until UseIdentity is called, in
+// which case connections are not secured.
+var tlsConfig *tls.Config
+
+// tlsMutex guards tlsConfig
+var tlsMutex = &sync.Mutex{}
+
+// Authority is the certificate authority the master creates for a single run of the pipeline. It issues a certificate
+// to the master and to every worker, and peers only accept connections secured with a certificate it issued.
+type Authority struct {
+	certificate    *x509.Certificate // The self-signed certificate of the authority
+	certificatePEM []byte            // The same certificate, PEM-encoded
+	key            *ecdsa.PrivateKey // The key the certificates are signed with
+	mutex          *sync.Mutex       // For concurrency stuff
+}
+
+// Identity is a certificate issued by the authority of the run, along with its private key and the certificate of the
+// authority itself. The master hands every worker its identity when starting it.
+type Identity struct {
+	Name           string // The common name of the certificate, i.e. the ID of the worker, or "master"
+	CertificatePEM []byte // The PEM-encoded certificate
+	KeyPEM         []byte // The PEM-encoded private key of the certificate
+	AuthorityPEM   []byte // The PEM-encoded certificate of the authority
+}
+
+// NewAuthority creates a new certificate authority with a freshly generated key
+func NewAuthority() (*Authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate("gopipeline run authority")
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	authority := new(Authority)
+	if authority.certificate, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	authority.certificatePEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	authority.key = key
+	authority.mutex = &sync.Mutex{}
+	return authority, nil
+}
+
+// Issue issues a certificate with the given common name, usable both for accepting and for opening connections
+func (authority *Authority) Issue(name string) (*Identity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+	template.DNSNames = []string{serverName}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	authority.mutex.Lock()
+	der, err := x509.CreateCertificate(rand.Reader, template, authority.certificate, &key.PublicKey, authority.key)
+	authority.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	identity := new(Identity)
+	identity.Name = name
+	identity.CertificatePEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	identity.KeyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	identity.AuthorityPEM = authority.certificatePEM
+	return identity, nil
+}
+
+// newTemplate creates a certificate template with the given common name and a random serial number
+func newTemplate(name string) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := new(x509.Certificate)
+	template.SerialNumber = serialNumber
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(certificateLifetime)
+	return template, nil
+}
+
+// Encode encodes the identity as a series of PEM blocks: the certificate, the private key, and the certificate of the
+// authority
+func (identity *Identity) Encode() []byte {
+	var buffer bytes.Buffer
+	buffer.Write(identity.CertificatePEM)
+	buffer.Write(identity.KeyPEM)
+	buffer.Write(identity.AuthorityPEM)
+	return buffer.Bytes()
+}
+
+// ReadIdentity reads an identity encoded with Identity.Encode
+func ReadIdentity(reader io.Reader) (*Identity, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([][]byte, 0, 3)
+	for len(blocks) < 3 {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return nil, errors.New("the TLS identity is incomplete: expected a certificate, a key and an authority")
+		}
+		blocks = append(blocks, pem.EncodeToMemory(block))
+	}
+	identity := new(Identity)
+	identity.CertificatePEM = blocks[0]
+	identity.KeyPEM = blocks[1]
+	identity.AuthorityPEM = blocks[2]
+	certificate, err := tls.X509KeyPair(identity.CertificatePEM, identity.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	identity.Name = leaf.Subject.CommonName
+	return identity, nil
+}
+
+// UseIdentity secures every connection opened or accepted from now on with mutual TLS, using the given identity. Peers
+// must present a certificate issued by the same authority.
+func UseIdentity(identity *Identity) error {
+	certificate, err := tls.X509KeyPair(identity.CertificatePEM, identity.KeyPEM)
+	if err != nil {
+		return err
+	}
+	authorities := x509.NewCertPool()
+	if !authorities.AppendCertsFromPEM(identity.AuthorityPEM) {
+		return errors.New("could not parse the certificate of the TLS authority")
+	}
+	config := new(tls.Config)
+	config.Certificates = []tls.Certificate{certificate}
+	config.RootCAs = authorities
+	config.ClientCAs = authorities
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ServerName = serverName
+	config.MinVersion = tls.VersionTLS12
+	tlsMutex.Lock()
+	tlsConfig = config
+	tlsMutex.Unlock()
+	return nil
+}
+
+// secure performs the TLS handshake on the connection if an identity is in use. isServer tells whether this peer
+// accepted the connection. Returns the connection as it is if no identity is in use.
+func secure(connection net.Conn, isServer bool) (net.Conn, error) {
+	tlsMutex.Lock()
+	config := tlsConfig
+	tlsMutex.Unlock()
+	if config == nil {
+		return connection, nil
+	}
+	var tlsConnection *tls.Conn
+	if isServer {
+		tlsConnection = tls.Server(connection, config)
+	} else {
+		tlsConnection = tls.Client(connection, config)
+	}
+	if err := tlsConnection.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", connection.RemoteAddr(), err)
+	}
+	return tlsConnection, nil
+}
+
+// peerName returns the common name of the certificate presented by the other peer, or an empty string if the
+// connection is not secured with TLS
+func peerName(connection net.Conn) string {
+	tlsConnection, ok := connection.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certificates := tlsConnection.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return ""
+	}
+	return certificates[0].Subject.CommonName
+}
@@ -0,0 +1,114 @@
+package master
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ffrankies/gopipeline/scheduler"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// CheckpointCoordinator periodically starts pipeline-wide checkpoints, and collects the snapshots of the workers. A
+// checkpoint is written to disk once every worker that was running when it started has sent its snapshot.
+type CheckpointCoordinator struct {
+	Path      string            // The path to the file holding the last completed checkpoint
+	nextID    int               // The ID of the next checkpoint to start
+	current   *types.Checkpoint // The checkpoint in progress. nil if there is none
+	expected  map[string]bool   // The IDs of the workers whose snapshots the checkpoint in progress is waiting for
+	completed int               // The number of checkpoints completed during this run
+	mutex     *sync.Mutex       // For concurrency stuff
+}
+
+// NewCheckpointCoordinator creates a CheckpointCoordinator that writes completed checkpoints to the given path. If
+// restored is not nil, the IDs of the new checkpoints continue from its ID.
+func NewCheckpointCoordinator(path string, restored *types.Checkpoint) *CheckpointCoordinator {
+	coordinator := new(CheckpointCoordinator)
+	coordinator.Path = path
+	coordinator.nextID = 1
+	if restored != nil {
+		coordinator.nextID = restored.ID + 1
+	}
+	coordinator.current = nil
+	coordinator.expected = make(map[string]bool)
+	coordinator.completed = 0
+	coordinator.mutex = &sync.Mutex{}
+	return coordinator
+}
+
+// Run starts a checkpoint every interval, until the source stages start running out of items to produce. A checkpoint
+// that is still in progress when the next one starts, for example because a worker failed, is abandoned.
+func (coordinator *CheckpointCoordinator) Run(schedule *scheduler.Schedule, interval time.Duration) {
+	for !schedule.IsDraining() {
+		time.Sleep(interval)
+		if schedule.IsDraining() {
+			return
+		}
+		coordinator.mutex.Lock()
+		if coordinator.current != nil {
+			fmt.Println("Abandoning checkpoint", coordinator.current.ID, "since it did not complete in time")
+		}
+		checkpoint := types.NewCheckpoint(coordinator.nextID)
+		coordinator.nextID++
+		coordinator.current = checkpoint
+		coordinator.expected = make(map[string]bool)
+		coordinator.mutex.Unlock()
+		fmt.Println("=====Starting checkpoint", checkpoint.ID, "=====")
+		expected := schedule.InjectBarrier(checkpoint.ID)
+		coordinator.mutex.Lock()
+		if coordinator.current == checkpoint {
+			for _, workerID := range expected {
+				if !coordinator.received(workerID) {
+					coordinator.expected[workerID] = true
+				}
+			}
+			coordinator.checkCompletion()
+		}
+		coordinator.mutex.Unlock()
+	}
+}
+
+// Store adds the snapshot of a worker to the checkpoint in progress. Snapshots of abandoned checkpoints are ignored.
+func (coordinator *CheckpointCoordinator) Store(workerCheckpoint *types.WorkerCheckpoint) {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	if coordinator.current == nil || coordinator.current.ID != workerCheckpoint.CheckpointID {
+		return
+	}
+	coordinator.current.Workers = append(coordinator.current.Workers, workerCheckpoint)
+	delete(coordinator.expected, workerCheckpoint.WorkerID)
+	coordinator.checkCompletion()
+}
+
+// Completed returns the number of checkpoints completed during this run
+func (coordinator *CheckpointCoordinator) Completed() int {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	return coordinator.completed
+}
+
+// received returns true if the checkpoint in progress already holds the snapshot of the given worker. Must be called
+// with the mutex locked.
+func (coordinator *CheckpointCoordinator) received(workerID string) bool {
+	for _, workerCheckpoint := range coordinator.current.Workers {
+		if workerCheckpoint.WorkerID == workerID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCompletion writes the checkpoint in progress to disk once every expected snapshot has been received. Must be
+// called with the mutex locked.
+func (coordinator *CheckpointCoordinator) checkCompletion() {
+	if len(coordinator.expected) > 0 || len(coordinator.current.Workers) == 0 {
+		return
+	}
+	if err := coordinator.current.Write(coordinator.Path); err != nil {
+		fmt.Println("ERROR: Could not write checkpoint:", err.Error())
+	} else {
+		fmt.Println("=====Completed checkpoint", coordinator.current.ID, "=====")
+		coordinator.completed++
+	}
+	coordinator.current = nil
+}
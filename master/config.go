@@ -2,7 +2,9 @@ package master
 
 import (
 	"io/ioutil"
+	"time"
 
+	"github.com/ffrankies/gopipeline/types"
 	"gopkg.in/yaml.v2"
 )
 
@@ -12,6 +14,76 @@ type Config struct {
 	SSHPort  int      `yaml:"SSHPort"`  // The port number with which to log into pipelined worker nodes
 	NodeList []string `yaml:"NodeList"` // The list of nodes available to the pipeline
 	UserPath string   `yaml:"UserPath"` // The userpath for the go install directory
+	// The number of seconds after which a worker that has not sent its statistics is considered to have failed
+	HeartbeatTimeout int `yaml:"HeartbeatTimeout"`
+	// The number of seconds between two checkpoints of the pipeline. Checkpoints are disabled if it is 0
+	CheckpointInterval int `yaml:"CheckpointInterval"`
+	// The maximum number of items in the input and output queues of every worker
+	QueueCapacity int `yaml:"QueueCapacity"`
+	// The known_hosts file the host keys of the nodes are checked against. Defaults to ~/.ssh/known_hosts
+	SSHKnownHosts string `yaml:"SSHKnownHosts"`
+	// What to do with nodes whose host key is not in the known_hosts file: strict (refuse) or accept-new (add)
+	SSHHostKeyPolicy string `yaml:"SSHHostKeyPolicy"`
+	// The private keys to log into the nodes with. Defaults to the id_ed25519, id_ecdsa and id_rsa keys in ~/.ssh
+	SSHIdentityFiles []string `yaml:"SSHIdentityFiles"`
+	// Whether to log into the nodes with the keys held by the ssh-agent. Defaults to true
+	SSHUseAgent *bool `yaml:"SSHUseAgent"`
+	// The OpenSSH client configuration file. Defaults to ~/.ssh/config. The User, Port, IdentityFile and ProxyJump it
+	// sets for a node override SSHUser and SSHPort, and the nodes in the NodeList may be Host aliases from it
+	SSHConfigFile string `yaml:"SSHConfigFile"`
+}
+
+// defaultHeartbeatTimeout is used when the config file does not set a HeartbeatTimeout
+const defaultHeartbeatTimeout = 5
+
+// GetHeartbeatTimeout returns the time after which a worker that has not sent its statistics is considered to have
+// failed
+func (config *Config) GetHeartbeatTimeout() time.Duration {
+	if config.HeartbeatTimeout <= 0 {
+		return defaultHeartbeatTimeout * time.Second
+	}
+	return time.Duration(config.HeartbeatTimeout) * time.Second
+}
+
+// defaultQueueCapacity is used when the config file does not set a QueueCapacity
+const defaultQueueCapacity = 1000
+
+// GetQueueCapacity returns the maximum number of items in the input and output queues of every worker
+func (config *Config) GetQueueCapacity() int {
+	if config.QueueCapacity <= 0 {
+		return defaultQueueCapacity
+	}
+	return config.QueueCapacity
+}
+
+// GetCheckpointInterval returns the time between two checkpoints of the pipeline. 0 means checkpoints are disabled.
+func (config *Config) GetCheckpointInterval() time.Duration {
+	if config.CheckpointInterval <= 0 {
+		return 0
+	}
+	return time.Duration(config.CheckpointInterval) * time.Second
+}
+
+// GetSSHOptions returns how to log into the nodes with SSH. Panics if the host key policy is unknown.
+func (config *Config) GetSSHOptions() *types.SSHOptions {
+	options := types.NewSSHOptions(config.SSHUser, config.SSHPort)
+	if config.SSHConfigFile != "" {
+		options.ConfigPath = config.SSHConfigFile
+	}
+	if config.SSHKnownHosts != "" {
+		options.KnownHostsPath = config.SSHKnownHosts
+	}
+	if config.SSHHostKeyPolicy != "" {
+		if config.SSHHostKeyPolicy != types.StrictHostKeys && config.SSHHostKeyPolicy != types.AcceptNewHostKeys {
+			panic("Unknown SSHHostKeyPolicy: " + config.SSHHostKeyPolicy)
+		}
+		options.HostKeyPolicy = config.SSHHostKeyPolicy
+	}
+	options.IdentityFiles = append(options.IdentityFiles, config.SSHIdentityFiles...)
+	if config.SSHUseAgent != nil {
+		options.UseAgent = *config.SSHUseAgent
+	}
+	return options
 }
 
 // NewConfig creates a new Config object out of a YAMl config file
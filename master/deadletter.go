@@ -0,0 +1,76 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// DeadLetterStore persists the inputs that stages failed to process to a file, one JSON-encoded types.DeadLetter per
+// line, so that they can be inspected and replayed once the pipeline has finished
+type DeadLetterStore struct {
+	Path  string      // The path to the dead-letter file
+	count int         // The number of dead letters stored during this run
+	file  *os.File    // The dead-letter file, opened for appending
+	mutex *sync.Mutex // For concurrency stuff
+}
+
+// NewDeadLetterStore creates a DeadLetterStore that appends to the file at the given path. The file is only created
+// once the first dead letter is stored.
+func NewDeadLetterStore(path string) *DeadLetterStore {
+	store := new(DeadLetterStore)
+	store.Path = path
+	store.count = 0
+	store.file = nil
+	store.mutex = &sync.Mutex{}
+	return store
+}
+
+// Store writes a failed input to the dead-letter file
+func (store *DeadLetterStore) Store(failure *types.StageFailure) {
+	fmt.Println("Received dead letter:", failure)
+	deadLetter, err := types.NewDeadLetter(failure)
+	if err != nil {
+		fmt.Println("ERROR: Could not encode dead letter:", err.Error())
+		return
+	}
+	line, err := json.Marshal(deadLetter)
+	if err != nil {
+		fmt.Println("ERROR: Could not encode dead letter:", err.Error())
+		return
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.file == nil {
+		store.file, err = os.OpenFile(store.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Println("ERROR: Could not open dead-letter file:", err.Error())
+			return
+		}
+	}
+	if _, err = store.file.Write(append(line, '\n')); err != nil {
+		fmt.Println("ERROR: Could not write dead letter:", err.Error())
+		return
+	}
+	store.count++
+}
+
+// Length returns the number of dead letters stored during this run
+func (store *DeadLetterStore) Length() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.count
+}
+
+// Close closes the dead-letter file
+func (store *DeadLetterStore) Close() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.file != nil {
+		store.file.Close()
+		store.file = nil
+	}
+}
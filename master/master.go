@@ -3,27 +3,33 @@ package master
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
 	"syscall"
 
 	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
 	"github.com/ffrankies/gopipeline/scheduler"
 	"github.com/ffrankies/gopipeline/types"
 )
 
+// masterName is the name in the TLS certificate of the master
+const masterName = "master"
+
 // startListener creates and starts a listener that listens for connections from workers. For each connection, it
 // starts a goroutine that reads the messages from the connection.
-func startListener(schedule *scheduler.Schedule) (masterAddress string, err error) {
+func startListener(schedule *scheduler.Schedule, sink types.ResultSink,
+	deadLetters *DeadLetterStore, checkpoints *CheckpointCoordinator) (masterAddress string, err error) {
 	masterHost := common.GetOutboundIPAddressHack()
 	listener, err := net.Listen("tcp", masterHost+":0")
 	if err != nil {
 		return
 	}
-	go receiveConnectionsGoRoutine(schedule, listener)
+	go receiveConnectionsGoRoutine(schedule, listener, sink, deadLetters, checkpoints)
 	masterPort := common.GetPortNumberFromListener(listener)
 	masterAddress = masterHost + ":" + masterPort
 	return
@@ -31,56 +37,96 @@ func startListener(schedule *scheduler.Schedule) (masterAddress string, err erro
 
 // receiveConnectionsGoRoutine is a goroutine that accepts connections from the workers and parses the messages
 // received from the workers in separate gosubroutines.
-func receiveConnectionsGoRoutine(schedule *scheduler.Schedule, listener net.Listener) {
+func receiveConnectionsGoRoutine(schedule *scheduler.Schedule, listener net.Listener, sink types.ResultSink,
+	deadLetters *DeadLetterStore, checkpoints *CheckpointCoordinator) {
 	for {
 		connection, err := listener.Accept()
 		if err != nil {
 			panic(err)
 		}
-		go handleConnectionFromWorker(schedule, connection)
+		go handleConnectionFromWorker(schedule, connection, sink, deadLetters, checkpoints)
 	}
 }
 
-// handleConnectionFromWorker, at the moment, assumes no further communication from the worker node. Thus, it assumes
-// the worker sends it's listener address, parses the message as such, and then closes the connection.
-// In the future, it should check message type, and either do the above, or update a stage/node's statistics
-func handleConnectionFromWorker(schedule *scheduler.Schedule, connection net.Conn) {
+// handleConnectionFromWorker reads messages from a worker until the worker closes the connection. Every worker opens
+// a long-lived control session, along which it sends its listener address, its statistics and its notifications, and
+// replies to the master's commands. Workers running the last stage also open a connection through which they stream
+// their results. Workers speaking an incompatible version of the wire protocol, or without a certificate issued by the
+// authority of this run, are rejected during the handshake. A worker may only send messages under the ID it was issued
+// a certificate for.
+func handleConnectionFromWorker(schedule *scheduler.Schedule, networkConnection net.Conn, sink types.ResultSink,
+	deadLetters *DeadLetterStore, checkpoints *CheckpointCoordinator) {
 	gob.Register(&types.WorkerStats{})
 	gob.Register(types.MessageStageInfo{})
-	decoder := gob.NewDecoder(connection)
-	message := new(types.Message)
-	decoder.Decode(message)
-	if message.Description == common.MsgStageInfo {
-		schedule.UpdateStageInfo(message)
-	} else if message.Description == common.MsgStageStats {
-		schedule.UpdateStageStats(message)
-	} else if message.Description == common.MsgNotifyExit {
-		exitingWorkerID := message.Sender
-		schedule.StageList.RemoveWorker(exitingWorkerID)
-		schedule.NodeList.RemoveWorker(exitingWorkerID)
-	} else {
-		fmt.Println("Received invalid message type from", message.Sender)
+	connection, err := protocol.Server(networkConnection, protocol.DefaultFeatures())
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	defer connection.Close()
+	for {
+		message := new(types.Message)
+		if err := connection.Decode(message); err != nil {
+			return
+		}
+		if peer := connection.PeerName(); peer != "" && peer != message.Sender {
+			fmt.Println("ERROR: Worker", peer, "sent a message as", message.Sender, "- closing its connection")
+			return
+		}
+		if message.Description == common.MsgOpenSession {
+			session := schedule.Sessions.Open(message.Sender, connection)
+			defer schedule.Sessions.Close(session)
+		} else if message.Description == common.MsgReply {
+			schedule.Sessions.Reply(message)
+		} else if message.Description == common.MsgStageInfo {
+			if err := schedule.UpdateStageInfo(message); errors.Is(err, scheduler.ErrUnknownWorker) {
+				fmt.Println("ERROR: Ignoring the info of a worker that is not part of the pipeline:", err)
+			} else if err != nil {
+				refuseWorker(schedule, err)
+			}
+		} else if message.Description == common.MsgStageStats {
+			schedule.UpdateStageStats(message)
+		} else if message.Description == common.MsgStageResult {
+			if sink != nil {
+				sink(message.Contents)
+			}
+		} else if message.Description == common.MsgStageFailure {
+			deadLetters.Store(message.Contents.(*types.StageFailure))
+		} else if message.Description == common.MsgAbortPipeline {
+			abortPipeline(schedule, message.Contents.(*types.StageFailure))
+		} else if message.Description == common.MsgStageDone {
+			schedule.FinishWorker(message.Sender)
+		} else if message.Description == common.MsgStageState {
+			schedule.HandOverState(message.Sender, message.Contents.([]byte))
+		} else if message.Description == common.MsgCheckpointDone {
+			checkpoints.Store(message.Contents.(*types.WorkerCheckpoint))
+		} else if message.Description == common.MsgNotifyExit {
+			exitingWorkerID := message.Sender
+			schedule.StageList.RemoveWorker(exitingWorkerID)
+			schedule.NodeList.RemoveWorker(exitingWorkerID)
+		} else {
+			fmt.Println("Received invalid message type from", message.Sender)
+		}
 	}
-	connection.Close()
 }
 
-// startWorkers starts the worker at position 0, thereby kick-starting the pipeline
+// startWorkers starts the workers of every source stage, thereby kick-starting the pipeline
 func startWorkers(schedule *scheduler.Schedule) {
-	message := new(types.Message)
-	message.Sender = "0"
-	message.Description = common.MsgStartWorker
-	firstWorker := schedule.StageList.FindWorker("1")
-	connection, err := net.Dial("tcp", firstWorker.Address)
-	if err != nil {
-		panic(err)
+	for _, stage := range schedule.StageList.List {
+		if !stage.IsSource() {
+			continue
+		}
+		for _, sourceWorker := range stage.Workers {
+			if err := schedule.StartWorker(sourceWorker); err != nil {
+				panic(err)
+			}
+			fmt.Println("Started worker:", sourceWorker.ID)
+		}
 	}
-	encoder := gob.NewEncoder(connection)
-	encoder.Encode(message)
-	fmt.Println("Started worker:", firstWorker.ID)
 }
 
 // setUpSignalHandler sets up a signal handler for clean exit on termination
-func setUpSignalHandler(schedule *scheduler.Schedule, config *Config) {
+func setUpSignalHandler(schedule *scheduler.Schedule) {
 	signalHandlerChannel := make(chan os.Signal, 1)
 	signal.Notify(signalHandlerChannel, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
@@ -89,27 +135,77 @@ func setUpSignalHandler(schedule *scheduler.Schedule, config *Config) {
 			fmt.Println("Received signal:", receivedSignal)
 			fmt.Println("Performing cleanup...")
 			schedule.StageList.WaitUntilAllListenerPortsUpdated()
-			for _, stage := range schedule.StageList.List {
-				for _, worker := range stage.Workers {
-					sshConnection := types.NewSSHConnection(worker.Host, config.SSHUser, config.SSHPort)
-					command := "kill " + strconv.Itoa(worker.PID)
-					sshConnection.RunCommand(command, nil, nil)
-				}
-			}
+			schedule.KillWorkers()
 			os.Exit(0)
 		}
 	}()
 }
 
+// serializeSink wraps the sink so that it is called with one result at a time, although the results of the workers
+// running the sink stages are received concurrently. Returns nil if the sink is nil.
+func serializeSink(sink types.ResultSink) types.ResultSink {
+	if sink == nil {
+		return nil
+	}
+	mutex := &sync.Mutex{}
+	return func(result interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sink(result)
+	}
+}
+
+// abortPipeline kills every worker after a stage failed to process an input with the AbortOnError policy, and exits
+func abortPipeline(schedule *scheduler.Schedule, failure *types.StageFailure) {
+	fmt.Println("=====Aborting the pipeline=====")
+	fmt.Println(failure)
+	schedule.KillWorkers()
+	os.Exit(1)
+}
+
+// refuseWorker kills every worker after a worker reported a fingerprint that does not match the master's, and exits.
+// The pipeline cannot run correctly until the program on the worker's node is rebuilt from the same sources.
+func refuseWorker(schedule *scheduler.Schedule, err error) {
+	fmt.Println("=====Refusing a mismatched worker=====")
+	fmt.Println("ERROR:", err)
+	schedule.KillWorkers()
+	os.Exit(1)
+}
+
 // Run executes the main logic of the "master" node.
-// This involves setting up the pipeline stages, and starting worker processes on each node in the pipeline.
-func Run(options *common.MasterOptions, functionList []types.AnyFunc) {
+// This involves setting up the pipeline stages, and starting worker processes on each node in the pipeline. If sink is
+// not nil, the workers running the sink stages send their results back to the master, which passes them to the sink
+// one at a time. If checkpoints are enabled, a consistent checkpoint of the pipeline is written to
+// options.CheckpointPath at a regular interval. If options.Restore is true, the pipeline resumes from the last
+// checkpoint written there.
+// Every connection between the master and the workers, and between the workers, is secured with mutual TLS, using
+// certificates issued by an authority created for this run.
+// Returns once every source stage has run out of items to produce, and every stage has drained.
+func Run(options *common.MasterOptions, pipeline *types.Pipeline, sink types.ResultSink) {
 	config := NewConfig(options.ConfigPath)
 	schedule := scheduler.NewSchedule(
-		config.NodeList, config.SSHUser, config.SSHPort, config.UserPath, len(functionList))
-	setUpSignalHandler(schedule, config)
-	schedule.Static(functionList)
-	masterAddress, err := startListener(schedule)
+		config.NodeList, config.GetSSHOptions(), config.UserPath, pipeline, sink != nil,
+		config.GetHeartbeatTimeout(), config.GetQueueCapacity())
+	setUpSignalHandler(schedule)
+	identity, err := schedule.Authority.Issue(masterName)
+	if err != nil {
+		panic(err)
+	}
+	if err = protocol.UseIdentity(identity); err != nil {
+		panic(err)
+	}
+	pipeline.Register()
+	schedule.Static(pipeline)
+	var restored *types.Checkpoint
+	if options.Restore {
+		if restored, err = types.ReadCheckpoint(options.CheckpointPath); err != nil {
+			panic(err)
+		}
+		schedule.AwaitRestore()
+	}
+	deadLetters := NewDeadLetterStore(options.DeadLetterPath)
+	checkpoints := NewCheckpointCoordinator(options.CheckpointPath, restored)
+	masterAddress, err := startListener(schedule, serializeSink(sink), deadLetters, checkpoints)
 	if err != nil {
 		panic(err)
 	}
@@ -118,6 +214,16 @@ func Run(options *common.MasterOptions, functionList []types.AnyFunc) {
 	schedule.StageList.WaitUntilAllListenerPortsUpdated()
 	fmt.Println("=====Setting up communication between workers=====")
 	schedule.EstablishWorkerCommunication()
+	if restored != nil {
+		schedule.RestoreCheckpoint(restored)
+	}
 	startWorkers(schedule)
+	if interval := config.GetCheckpointInterval(); interval > 0 {
+		go checkpoints.Run(schedule, interval)
+	}
 	schedule.Dynamic(options.Program, masterAddress)
+	fmt.Println("=====Pipeline has finished=====")
+	fmt.Println(deadLetters.Length(), "inputs were written to the dead-letter file", deadLetters.Path)
+	fmt.Println(checkpoints.Completed(), "checkpoints were written to", checkpoints.Path)
+	deadLetters.Close()
 }
@@ -0,0 +1,44 @@
+package master
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSerializeSink checks that a sink is never called again before it has returned, even when the results of
+// several workers arrive at the same time, so that a sink appending to a slice is safe
+func TestSerializeSink(t *testing.T) {
+	var active, overlaps int32
+	results := make([]interface{}, 0)
+	sink := serializeSink(func(result interface{}) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(time.Millisecond)
+		results = append(results, result)
+		atomic.AddInt32(&active, -1)
+	})
+	const numWorkers, numResults = 4, 10
+	var workers sync.WaitGroup
+	for worker := 0; worker < numWorkers; worker++ {
+		workers.Add(1)
+		go func(worker int) {
+			defer workers.Done()
+			for result := 0; result < numResults; result++ {
+				sink(worker*numResults + result)
+			}
+		}(worker)
+	}
+	workers.Wait()
+	if overlaps != 0 {
+		t.Errorf("the sink was called %d times while it was still running", overlaps)
+	}
+	if len(results) != numWorkers*numResults {
+		t.Errorf("the sink received %d results, want %d", len(results), numWorkers*numResults)
+	}
+	if serializeSink(nil) != nil {
+		t.Error("got a sink for a nil sink, want nil so that results are not sent to the master")
+	}
+}
@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// InjectBarrier starts the checkpoint with the given ID. The workers of the source stages are told to pass a barrier
+// on between two results, and every other worker is told which workers to expect the barrier from. Returns the IDs of
+// the workers that are expected to take a snapshot.
+func (schedule *Schedule) InjectBarrier(checkpointID int) []string {
+	expected := make([]string, 0)
+	for _, stage := range schedule.StageList.List {
+		for _, worker := range stage.Workers {
+			if !isRunning(worker) {
+				continue
+			}
+			barrier := new(types.Barrier)
+			barrier.CheckpointID = checkpointID
+			if !stage.IsSource() {
+				barrier.Upstream = schedule.runningUpstreamWorkers(worker)
+			}
+			if err := schedule.commandWorker(worker, common.MsgBarrier, barrier); err != nil {
+				fmt.Println("ERROR: Could not send barrier to worker", worker.ID, ":", err)
+				continue
+			}
+			expected = append(expected, worker.ID)
+		}
+	}
+	return expected
+}
+
+// AwaitRestore makes every worker wait for its part of a checkpoint before it starts processing. Must be called
+// before the workers are started.
+func (schedule *Schedule) AwaitRestore() {
+	for _, stage := range schedule.StageList.List {
+		for _, worker := range stage.Workers {
+			worker.AwaitState = true
+		}
+	}
+}
+
+// RestoreCheckpoint sends every worker the merged snapshots of the workers that ran its stage when the checkpoint was
+// taken
+func (schedule *Schedule) RestoreCheckpoint(checkpoint *types.Checkpoint) {
+	for _, stage := range schedule.StageList.List {
+		workerCheckpoint, err := checkpoint.ForPosition(stage.Position)
+		if err != nil {
+			panic(err)
+		}
+		for _, worker := range stage.Workers {
+			if err = schedule.commandWorker(worker, common.MsgRestore, workerCheckpoint); err != nil {
+				panic(err)
+			}
+		}
+	}
+	fmt.Println("Restored checkpoint", checkpoint.ID, "taken at", checkpoint.Time)
+}
+
+// IsDraining returns true once a worker of a source stage has run out of items to produce
+func (schedule *Schedule) IsDraining() bool {
+	return schedule.isDraining()
+}
+
+// runningUpstreamWorkers returns the IDs of the running workers that send their results to the given worker
+func (schedule *Schedule) runningUpstreamWorkers(worker *types.Worker) []string {
+	upstream := make([]string, 0)
+	for _, upstreamID := range worker.Upstream {
+		upstreamWorker := schedule.StageList.FindWorker(upstreamID)
+		if upstreamWorker != nil && isRunning(upstreamWorker) {
+			upstream = append(upstream, upstreamID)
+		}
+	}
+	return upstream
+}
+
+// isRunning returns true if the worker has started, and is neither exiting nor failed
+func isRunning(worker *types.Worker) bool {
+	return worker.Exiting == false && worker.Address != "" && worker.PID > 0
+}
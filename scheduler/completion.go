@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// FinishWorker records that the worker with the given ID has processed the end of the stream and exited. Once every
+// worker of every upstream stage of a stage has finished, the workers of that stage are told which of them to expect
+// end-of-stream markers from. Once every worker of every sink stage has finished, the pipeline is complete.
+func (schedule *Schedule) FinishWorker(workerID string) {
+	schedule.completionMutex.Lock()
+	defer schedule.completionMutex.Unlock()
+	stage := schedule.StageList.FindStageWithWorker(workerID)
+	if stage == nil {
+		fmt.Println("ERROR: Could not find the stage of finished worker", workerID)
+		return
+	}
+	fmt.Println("Worker", workerID, "has finished")
+	if stage.IsSource() {
+		schedule.draining = true
+	}
+	stage.FinishWorker(workerID)
+	schedule.NodeList.RemoveWorker(workerID)
+	if !stage.IsFinished() {
+		return
+	}
+	fmt.Println("=====All workers of stage", stage.Position, "have finished=====")
+	if stage.IsSink() {
+		schedule.finished = schedule.sinksFinished()
+		return
+	}
+	for _, downstreamPosition := range stage.Downstream {
+		downstreamStage := schedule.StageList.FindByPosition(downstreamPosition)
+		finishedWorkers, allFinished := schedule.finishedUpstreamWorkers(downstreamStage)
+		if allFinished {
+			schedule.drainStage(downstreamPosition, finishedWorkers)
+		}
+	}
+}
+
+// sinksFinished returns true if every worker of every sink stage has processed the end of the stream
+func (schedule *Schedule) sinksFinished() bool {
+	for _, sink := range schedule.StageList.Sinks() {
+		if !sink.IsFinished() {
+			return false
+		}
+	}
+	return true
+}
+
+// finishedUpstreamWorkers returns the IDs of the finished workers of every upstream stage of the given stage, and
+// whether all of those upstream stages have finished. A stage only starts draining once all of its inputs have ended.
+func (schedule *Schedule) finishedUpstreamWorkers(stage *types.PipelineStage) (finishedWorkers []string,
+	allFinished bool) {
+	finishedWorkers = make([]string, 0)
+	for _, upstreamPosition := range stage.Upstream {
+		upstreamStage := schedule.StageList.FindByPosition(upstreamPosition)
+		if !upstreamStage.IsFinished() {
+			return nil, false
+		}
+		finishedWorkers = append(finishedWorkers, upstreamStage.Finished...)
+	}
+	return finishedWorkers, true
+}
+
+// IsFinished returns true once every worker of every sink stage has processed the end of the stream
+func (schedule *Schedule) IsFinished() bool {
+	schedule.completionMutex.Lock()
+	defer schedule.completionMutex.Unlock()
+	return schedule.finished
+}
+
+// isDraining returns true once a worker of a source stage has run out of items to produce. From then on, the
+// pipeline is no longer rescheduled.
+func (schedule *Schedule) isDraining() bool {
+	schedule.completionMutex.Lock()
+	defer schedule.completionMutex.Unlock()
+	return schedule.draining
+}
+
+// drainStage tells every worker of the stage at the given position which of the finished workers of its upstream stages
+// it should expect end-of-stream markers from
+func (schedule *Schedule) drainStage(position int, finishedWorkers []string) {
+	for _, worker := range schedule.StageList.FindByPosition(position).Workers {
+		if worker.PID == -2 {
+			continue
+		}
+		err := schedule.commandWorker(worker, common.MsgDrainStage, expectedMarkers(worker, finishedWorkers))
+		if err != nil {
+			fmt.Println("ERROR: Could not tell worker", worker.ID, "to drain:", err)
+		}
+	}
+}
+
+// drainReplacement tells a worker that replaced a failed worker to finish straight away if every upstream stage of its
+// stage has already finished, since the other workers of its stage were told to drain before it was started
+func (schedule *Schedule) drainReplacement(newWorker *types.Worker) {
+	schedule.completionMutex.Lock()
+	defer schedule.completionMutex.Unlock()
+	stage := schedule.StageList.FindByPosition(newWorker.Stage)
+	if stage.IsSource() {
+		return
+	}
+	finishedWorkers, allFinished := schedule.finishedUpstreamWorkers(stage)
+	if !allFinished {
+		return
+	}
+	err := schedule.commandWorker(newWorker, common.MsgDrainStage, expectedMarkers(newWorker, finishedWorkers))
+	if err != nil {
+		fmt.Println("ERROR: Could not tell worker", newWorker.ID, "to drain:", err)
+	}
+}
+
+// expectedMarkers returns the IDs of the finished workers that were sending their results to the given worker
+func expectedMarkers(worker *types.Worker, finishedWorkers []string) []string {
+	expected := make([]string, 0)
+	for _, upstreamID := range worker.Upstream {
+		for _, finishedID := range finishedWorkers {
+			if upstreamID == finishedID {
+				expected = append(expected, upstreamID)
+				break
+			}
+		}
+	}
+	return expected
+}
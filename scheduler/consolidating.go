@@ -1,9 +1,7 @@
 package scheduler
 
 import (
-	"encoding/gob"
 	"fmt"
-	"net"
 	"strconv"
 
 	"github.com/ffrankies/gopipeline/internal/common"
@@ -11,11 +9,15 @@ import (
 )
 
 // findWorkerToMove searches for the worker that is on the node that is after the given node. It should be using less memory than
-// avaiable in the node at the given position.
+// avaiable in the node at the given position. Source stage workers are not moved, since the worker replacing one would
+// produce the whole stream again.
 func (schedule *Schedule) findWorkerToMove(position int, availableMemory uint64) *types.Worker {
 	for _, node := range schedule.NodeList.List {
 		if position < node.Position {
 			for _, worker := range node.Workers {
+				if schedule.StageList.FindByPosition(worker.Stage).IsSource() {
+					continue
+				}
 				if worker.Stats.WorkerMemoryUsage < availableMemory && worker.Stats.ExecutionTime > 0 && worker.Exiting == false {
 					return worker
 				}
@@ -27,28 +29,22 @@ func (schedule *Schedule) findWorkerToMove(position int, availableMemory uint64)
 
 // breakConnection closes the connection between the worker and all the other workers who sends the results to it
 func (schedule *Schedule) breakConnection(oldWorkerAddress string, position int) {
-	if position == 0 {
-		return
-	}
-	message := new(types.Message)
-	message.Sender = "0"
-	message.Description = common.MsgBreakConnection
-	message.Contents = oldWorkerAddress
-	previousStage := schedule.StageList.FindByPosition(position - 1)
-	for _, worker := range previousStage.Workers {
-		connection, err := net.Dial("tcp", worker.Address)
-		if err != nil {
-			panic(err)
+	for _, upstreamPosition := range schedule.StageList.FindByPosition(position).Upstream {
+		for _, worker := range schedule.StageList.FindByPosition(upstreamPosition).Workers {
+			if err := schedule.commandWorker(worker, common.MsgBreakConnection, oldWorkerAddress); err != nil {
+				fmt.Println("ERROR: Could not tell worker", worker.ID, "to break its connection:", err)
+			}
 		}
-		encoder := gob.NewEncoder(connection)
-		encoder.Encode(message)
-		connection.Close()
 	}
 }
 
 // flushAndStopWorker sends a signal to the worker to flush its queue and kill itself
 func (schedule *Schedule) flushAndStopWorker(worker *types.Worker) {
-	sshConnection := types.NewSSHConnection(worker.Host, schedule.sshUser, schedule.sshPort)
+	sshConnection, err := types.NewSSHConnection(worker.Host, schedule.sshOptions)
+	if err != nil {
+		fmt.Println("ERROR: Could not stop worker", worker.ID+":", err)
+		return
+	}
 	command := "kill -SIGUSR1 " + strconv.Itoa(worker.PID)
 	fmt.Println("Running command:", command, "on node:", worker.Host)
 	go sshConnection.RunCommand(command, nil, nil)
@@ -66,6 +62,10 @@ func (schedule *Schedule) moveStages(program string, masterAddress string) {
 		worker.Exiting = true
 		fmt.Println("Moving worker " + worker.ID + " to node " + node.Address)
 		newWorker := schedule.AssignWorkerToNode(worker.Stage, node)
+		if schedule.StageList.FindByPosition(worker.Stage).Stateful {
+			newWorker.AwaitState = true
+			worker.Replacement = newWorker.ID
+		}
 		schedule.startWorker(newWorker, program, masterAddress)
 		if err := schedule.waitForWorkerToSendInfo(newWorker); err != nil {
 			panic(err)
@@ -76,3 +76,23 @@ func (schedule *Schedule) moveStages(program string, masterAddress string) {
 		break
 	}
 }
+
+// HandOverState sends the final state snapshot of an exiting worker to the worker replacing it. The snapshot is dropped
+// if the exiting worker has no replacement.
+func (schedule *Schedule) HandOverState(exitingWorkerID string, snapshot []byte) {
+	exitingWorker := schedule.StageList.FindWorker(exitingWorkerID)
+	if exitingWorker == nil || exitingWorker.Replacement == "" {
+		fmt.Println("Dropping the state of worker", exitingWorkerID, "since it has no replacement")
+		return
+	}
+	replacement := schedule.StageList.FindWorker(exitingWorker.Replacement)
+	if replacement == nil {
+		fmt.Println("ERROR: Could not find worker", exitingWorker.Replacement, "to hand the state over to")
+		return
+	}
+	if err := schedule.commandWorker(replacement, common.MsgStageState, snapshot); err != nil {
+		fmt.Println("ERROR: Could not hand the state over to worker", replacement.ID, ":", err)
+		return
+	}
+	fmt.Println("Handed the state of worker", exitingWorkerID, "over to worker", replacement.ID)
+}
@@ -0,0 +1,138 @@
+package scheduler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// commandTimeout is the maximum time the master waits for a worker to have a control session, and then for the
+// worker's reply to a command
+const commandTimeout = 10 * time.Second
+
+// ControlSession is the long-lived control connection opened by a single worker
+type ControlSession struct {
+	WorkerID   string         // The ID of the worker that opened the session
+	connection *protocol.Conn // The connection to the worker
+	mutex      *sync.Mutex    // For concurrency stuff
+}
+
+// ControlSessions holds the control session of every connected worker by worker ID, so that the master can send a
+// command to a worker without dialing its listener. Replies to the commands are matched to the commands by ID.
+type ControlSessions struct {
+	sessions map[string]*ControlSession     // The control session of every connected worker, by worker ID
+	pending  map[uint64]chan *types.Message // The channels waiting for the replies to the commands sent, by command ID
+	counter  uint64                         // The ID of the last command sent
+	mutex    *sync.Mutex                    // For concurrency stuff
+}
+
+// NewControlSessions creates an empty set of control sessions
+func NewControlSessions() *ControlSessions {
+	sessions := new(ControlSessions)
+	sessions.sessions = make(map[string]*ControlSession)
+	sessions.pending = make(map[uint64]chan *types.Message)
+	sessions.counter = 0
+	sessions.mutex = &sync.Mutex{}
+	return sessions
+}
+
+// Open registers the connection as the control session of the given worker. A session the worker opened earlier, and
+// has since lost, is replaced.
+func (sessions *ControlSessions) Open(workerID string, connection *protocol.Conn) *ControlSession {
+	session := new(ControlSession)
+	session.WorkerID = workerID
+	session.connection = connection
+	session.mutex = &sync.Mutex{}
+	sessions.mutex.Lock()
+	sessions.sessions[workerID] = session
+	sessions.mutex.Unlock()
+	return session
+}
+
+// Close forgets the given control session, unless the worker has already replaced it with a new one
+func (sessions *ControlSessions) Close(session *ControlSession) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if sessions.sessions[session.WorkerID] == session {
+		delete(sessions.sessions, session.WorkerID)
+	}
+}
+
+// Reply passes a worker's reply to the command waiting for it
+func (sessions *ControlSessions) Reply(message *types.Message) {
+	sessions.mutex.Lock()
+	replyChannel, ok := sessions.pending[message.ID]
+	delete(sessions.pending, message.ID)
+	sessions.mutex.Unlock()
+	if ok {
+		replyChannel <- message
+	}
+}
+
+// Command sends a command to the worker with the given ID along its control session, and waits until the worker has
+// handled it. If the worker has no session, for example because it is reconnecting, the command waits for one.
+func (sessions *ControlSessions) Command(workerID string, description int, contents interface{}) error {
+	session, err := sessions.waitForSession(workerID)
+	if err != nil {
+		return err
+	}
+	message := new(types.Message)
+	message.Sender = "0"
+	message.Description = description
+	message.Contents = contents
+	replyChannel := make(chan *types.Message, 1)
+	sessions.mutex.Lock()
+	sessions.counter++
+	message.ID = sessions.counter
+	sessions.pending[message.ID] = replyChannel
+	sessions.mutex.Unlock()
+	session.mutex.Lock()
+	err = session.connection.Encode(message)
+	session.mutex.Unlock()
+	if err != nil {
+		sessions.Close(session)
+	} else {
+		select {
+		case <-replyChannel:
+			return nil
+		case <-time.After(commandTimeout):
+			err = errors.New("worker " + workerID + " did not reply in time")
+		}
+	}
+	sessions.mutex.Lock()
+	delete(sessions.pending, message.ID)
+	sessions.mutex.Unlock()
+	return err
+}
+
+// waitForSession returns the control session of the given worker, waiting at most commandTimeout for the worker to
+// open one
+func (sessions *ControlSessions) waitForSession(workerID string) (*ControlSession, error) {
+	deadline := time.Now().Add(commandTimeout)
+	for {
+		sessions.mutex.Lock()
+		session, ok := sessions.sessions[workerID]
+		sessions.mutex.Unlock()
+		if ok {
+			return session, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("worker " + workerID + " has no control session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// commandWorker sends a command to the given worker along its control session
+func (schedule *Schedule) commandWorker(worker *types.Worker, description int, contents interface{}) error {
+	return schedule.Sessions.Command(worker.ID, description, contents)
+}
+
+// StartWorker tells a worker running a source stage to start producing items
+func (schedule *Schedule) StartWorker(worker *types.Worker) error {
+	return schedule.commandWorker(worker, common.MsgStartWorker, nil)
+}
@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// findFailedWorkers returns the running workers that have stopped sending their statistics for longer than the
+// heartbeat timeout, or whose process has exited with an error
+func (schedule *Schedule) findFailedWorkers() []*types.Worker {
+	failedWorkers := make([]*types.Worker, 0)
+	for _, stage := range schedule.StageList.List {
+		for _, worker := range stage.Workers {
+			if worker.Exiting == true || worker.Address == "" {
+				continue
+			}
+			if worker.PID == -2 || time.Since(worker.LastHeartbeat) > schedule.heartbeatTimeout {
+				failedWorkers = append(failedWorkers, worker)
+			}
+		}
+	}
+	return failedWorkers
+}
+
+// replaceFailedWorkers replaces every worker that has failed with a new worker running the same stage
+func (schedule *Schedule) replaceFailedWorkers(program string, masterAddress string) {
+	for _, failedWorker := range schedule.findFailedWorkers() {
+		schedule.replaceWorker(failedWorker, program, masterAddress)
+	}
+}
+
+// replaceWorker marks the worker as failed, and removes it from the connection lists of the workers sending their
+// results to it, which send their unacknowledged results to the other workers of the stage instead. A replacement
+// worker is then started on the same node, or on another node if the failed worker's node cannot be reached, and
+// connected to the rest of the pipeline. A replacement for a source stage worker carries on the failed worker's stream
+// from the first item whose results were not all acknowledged, rather than producing the whole stream again. A
+// replacement for a stateful stage worker starts from the state of the failed worker's last periodic checkpoint.
+func (schedule *Schedule) replaceWorker(failedWorker *types.Worker, program string, masterAddress string) {
+	fmt.Println("=====Worker", failedWorker.ID, "on node", failedWorker.Host, "has failed=====")
+	failedWorker.Exiting = true
+	failedWorker.PID = -2
+	schedule.breakConnection(failedWorker.Address, failedWorker.Stage)
+	node := schedule.NodeList.FindNodeWithWorker(failedWorker.ID)
+	schedule.StageList.RemoveWorker(failedWorker.ID)
+	schedule.NodeList.RemoveWorker(failedWorker.ID)
+	reachable := node != nil && schedule.isHostReachable(node.Address)
+	var newWorker *types.Worker
+	if reachable {
+		newWorker = schedule.AssignWorkerToNode(failedWorker.Stage, node)
+	} else {
+		fmt.Println("Node", failedWorker.Host, "cannot be reached, and will no longer be used")
+		schedule.NodeList.RemoveNode(failedWorker.Host)
+		if schedule.freeNodeList.Length() >= 1 {
+			newWorker = schedule.AssignWorkerToFreeNode(failedWorker.Stage)
+		} else {
+			newWorker = schedule.AssignWorkerToUnderutilizedNode(failedWorker.Stage)
+		}
+		if newWorker == nil {
+			fmt.Println("ERROR: There is no node to start a replacement for worker", failedWorker.ID, "on")
+			return
+		}
+	}
+	fmt.Println("Replacing worker", failedWorker.ID, "with worker", newWorker.ID, "on node", newWorker.Host)
+	stage := schedule.StageList.FindByPosition(failedWorker.Stage)
+	if stage.IsSource() {
+		newWorker.Origin = failedWorker.SourceOrigin()
+		newWorker.Resume = failedWorker.Stats.Delivered
+		fmt.Println("Worker", newWorker.ID, "resumes the stream of", newWorker.Origin, "at item", newWorker.Resume)
+	}
+	if stage.Stateful {
+		newWorker.AwaitState = true
+	}
+	schedule.startWorker(newWorker, program, masterAddress)
+	if err := schedule.waitForWorkerToSendInfo(newWorker); err != nil {
+		panic(err)
+	}
+	if stage.Stateful {
+		schedule.restoreFailedState(failedWorker, newWorker, reachable)
+	}
+	schedule.setUpNewWorkerCommunication(newWorker)
+	schedule.drainReplacement(newWorker)
+}
+
+// restoreFailedState hands the state of a failed stateful stage worker over to the worker replacing it, as it was at
+// the failed worker's last periodic checkpoint. The checkpoint is read from the failed worker's node, if it can still
+// be reached. Otherwise, or if there is no checkpoint yet, the replacement starts with an empty state.
+func (schedule *Schedule) restoreFailedState(failedWorker *types.Worker, newWorker *types.Worker, reachable bool) {
+	var snapshot []byte
+	var err error
+	if reachable {
+		snapshot, err = schedule.readStateCheckpoint(failedWorker)
+	} else {
+		err = errors.New("its node cannot be reached")
+	}
+	if err != nil {
+		fmt.Println("ERROR: Could not read the last checkpoint of worker", failedWorker.ID+":", err)
+		fmt.Println("Worker", newWorker.ID, "starts with an empty state")
+		if snapshot, err = types.NewStateStore().Snapshot(); err != nil {
+			panic(err)
+		}
+	}
+	if err = schedule.commandWorker(newWorker, common.MsgStageState, snapshot); err != nil {
+		fmt.Println("ERROR: Could not hand the state over to worker", newWorker.ID, ":", err)
+		return
+	}
+	fmt.Println("Restored the state of worker", failedWorker.ID, "on worker", newWorker.ID)
+}
+
+// readStateCheckpoint reads the last periodic checkpoint of the state of the given worker from its node
+func (schedule *Schedule) readStateCheckpoint(worker *types.Worker) ([]byte, error) {
+	sshConnection, err := types.NewSSHConnection(worker.Host, schedule.sshOptions)
+	if err != nil {
+		return nil, err
+	}
+	return sshConnection.Output("cat ~/" + common.StateFileName(worker.Stage, worker.ID))
+}
+
+// isHostReachable returns true if the SSH server of the given host accepts connections, through its jump hosts if the
+// SSH config file sets any
+func (schedule *Schedule) isHostReachable(host string) bool {
+	return types.IsHostReachable(host, schedule.sshOptions, 2*time.Second)
+}
@@ -1,18 +1,19 @@
 package scheduler
 
 import (
-	"encoding/gob"
 	"errors"
 	"fmt"
-	"net"
 	"time"
 
-	"github.com/ffrankies/gopipeline/internal/common"
 	"github.com/ffrankies/gopipeline/types"
 )
 
-// scaleStage scales a Bottleneck stage out to a free node
+// scaleStage scales a Bottleneck stage out to a free node. Source stages are not scaled, since every worker of a source
+// stage would produce the whole stream.
 func (schedule *Schedule) scaleStage(position int, numToScale int, program string, masterAddress string) {
+	if position != -1 && schedule.StageList.FindByPosition(position).IsSource() {
+		return
+	}
 	numScaled := 0
 	fmt.Println(numScaled, "|", numToScale)
 	for numScaled < numToScale {
@@ -57,28 +58,23 @@ func (schedule *Schedule) waitForWorkerToSendInfo(worker *types.Worker) error {
 	return nil
 }
 
-// setUpNewWorkerCommunication communicates the next node information to the new stage, and the stage before it
+// setUpNewWorkerCommunication communicates the next node information to the new stage, and the stages before it
 func (schedule *Schedule) setUpNewWorkerCommunication(newWorker *types.Worker) {
-	if newWorker.Stage != schedule.StageList.MaxPosition {
-		for _, worker := range schedule.StageList.FindByPosition(newWorker.Stage + 1).Workers {
-			sendNextWorkerAddress(newWorker, worker)
+	stage := schedule.StageList.FindByPosition(newWorker.Stage)
+	for _, downstreamPosition := range stage.Downstream {
+		for _, worker := range schedule.StageList.FindByPosition(downstreamPosition).Workers {
+			schedule.sendNextWorkerAddress(newWorker, worker)
 		}
 	}
-	if newWorker.Stage != 0 {
-		for _, worker := range schedule.StageList.FindByPosition(newWorker.Stage - 1).Workers {
-			sendNextWorkerAddress(worker, newWorker)
+	for _, upstreamPosition := range stage.Upstream {
+		for _, worker := range schedule.StageList.FindByPosition(upstreamPosition).Workers {
+			schedule.sendNextWorkerAddress(worker, newWorker)
 		}
 	}
-	if newWorker.Stage == 0 {
-		message := new(types.Message)
-		message.Sender = "0"
-		message.Description = common.MsgStartWorker
-		connection, err := net.Dial("tcp", newWorker.Address)
-		if err != nil {
+	if stage.IsSource() {
+		if err := schedule.StartWorker(newWorker); err != nil {
 			panic(err)
 		}
-		encoder := gob.NewEncoder(connection)
-		encoder.Encode(message)
 		fmt.Println("Started worker:", newWorker.ID)
 	}
 }
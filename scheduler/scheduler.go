@@ -1,36 +1,63 @@
 package scheduler
 
 import (
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"math"
-	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
 	"github.com/ffrankies/gopipeline/types"
 )
 
+// ErrUnknownWorker is returned when a message comes from a worker that is not part of the schedule
+var ErrUnknownWorker = errors.New("message from an unknown worker")
+
 // Schedule contains the information needed for scheduling
 type Schedule struct {
-	freeNodeList *types.PipelineNodeList  // The list of Nodes available for scheduling
-	NodeList     *types.PipelineNodeList  // The list of Nodes that have at least one stages running on them
-	StageList    *types.PipelineStageList // The list of pipeline Stages, with metadata
-	sshUser      string                   // The username to use for logging in with SSH
-	sshPort      int                      // The port to use for logging in with SSH
-	sshUserPath  string                   // The path to the program command on the remote machines
+	freeNodeList     *types.PipelineNodeList  // The list of Nodes available for scheduling
+	NodeList         *types.PipelineNodeList  // The list of Nodes that have at least one stages running on them
+	StageList        *types.PipelineStageList // The list of pipeline Stages, with metadata
+	Sessions         *ControlSessions         // The control sessions of the workers, for sending them commands
+	Authority        *protocol.Authority      // Issues the TLS certificates of the master and the workers of this run
+	sshOptions       *types.SSHOptions        // How to log into the nodes with SSH
+	sshUserPath      string                   // The path to the program command on the remote machines
+	sendResults      bool                     // Whether the last stage workers should send their results to the master
+	heartbeatTimeout time.Duration            // The time after which a worker that has not sent its statistics fails
+	queueCapacity    int                      // The maximum number of items in the queues of every worker
+	fingerprint      *types.Fingerprint       // The fingerprint of the master's executable and pipeline
+	draining         bool                     // Whether a source stage has started to run out of items to produce
+	finished         bool                     // Whether every worker of every sink stage has processed the end of the stream
+	completionMutex  sync.Mutex               // Guards draining and finished
 }
 
-// NewSchedule creates a new scheduler with empty node and stage lists, and populates the empty node list
-func NewSchedule(nodeList []string, SSHUser string, SSHPort int, SSHUserPath string, numStages int) *Schedule {
+// NewSchedule creates a new scheduler with empty node and stage lists, and populates the empty node list. The stage
+// list follows the topology of the given pipeline.
+func NewSchedule(nodeList []string, sshOptions *types.SSHOptions, SSHUserPath string, pipeline *types.Pipeline,
+	sendResults bool, heartbeatTimeout time.Duration, queueCapacity int) *Schedule {
 	schedule := new(Schedule)
 	schedule.NodeList = types.NewPipelineNodeList()
-	schedule.StageList = types.NewPipelineStageList(numStages)
+	schedule.StageList = types.NewPipelineStageList(pipeline)
 	schedule.freeNodeList = types.NewPipelineNodeList()
-	schedule.sshUser = SSHUser
-	schedule.sshPort = SSHPort
+	schedule.Sessions = NewControlSessions()
+	authority, err := protocol.NewAuthority()
+	if err != nil {
+		panic(err)
+	}
+	schedule.Authority = authority
+	schedule.sshOptions = sshOptions
 	schedule.sshUserPath = SSHUserPath
+	schedule.sendResults = sendResults
+	schedule.heartbeatTimeout = heartbeatTimeout
+	schedule.queueCapacity = queueCapacity
+	fingerprint, err := types.NewFingerprint(pipeline)
+	if err != nil {
+		panic(err)
+	}
+	schedule.fingerprint = fingerprint
 	for _, nodeHostName := range nodeList {
 		node := types.NewPipelineNode(nodeHostName, -1)
 		schedule.freeNodeList.AddNode(node)
@@ -38,18 +65,23 @@ func NewSchedule(nodeList []string, SSHUser string, SSHPort int, SSHUserPath str
 	return schedule
 }
 
-// Static does initial static scheduling of the pipeline stages on the available nodes
-func (schedule *Schedule) Static(functionList []types.AnyFunc) {
+// Static does initial static scheduling of the pipeline stages on the available nodes. Stages are assigned in
+// topological order, so that stages that feed into each other tend to share a node.
+func (schedule *Schedule) Static(pipeline *types.Pipeline) {
 	fmt.Println("Performing static scheduling")
-	density := schedule.CalculateFunctionDensity(functionList)
+	order, err := pipeline.TopologicalOrder()
+	if err != nil {
+		panic(err)
+	}
+	density := schedule.CalculateFunctionDensity(pipeline)
 	counter := 0
 	schedulingNode := schedule.freeNodeList.Pop()
-	for index := range functionList {
-		schedule.AssignWorkerToNode(index, schedulingNode)
+	for _, position := range order {
+		schedule.AssignWorkerToNode(position, schedulingNode)
 		counter++
 		if counter == density {
 			counter = 0
-			density = schedule.CalculateFunctionDensity(functionList)
+			density = schedule.CalculateFunctionDensity(pipeline)
 			if density < 0 { // If scheduling is over, there are no functions to schedule, so density becomes < 0
 				break
 			}
@@ -59,8 +91,8 @@ func (schedule *Schedule) Static(functionList []types.AnyFunc) {
 }
 
 // CalculateFunctionDensity calculates the initial function density in the pipeline
-func (schedule *Schedule) CalculateFunctionDensity(functionList []types.AnyFunc) int {
-	numFunctionsRemaining := len(functionList) - schedule.StageList.Length()
+func (schedule *Schedule) CalculateFunctionDensity(pipeline *types.Pipeline) int {
+	numFunctionsRemaining := pipeline.Length() - schedule.StageList.Length()
 	numNodesRemaining := schedule.freeNodeList.Length()
 	density := math.Ceil(float64(numFunctionsRemaining) / float64(numNodesRemaining))
 	return int(density)
@@ -101,25 +133,46 @@ func (schedule *Schedule) AssignWorkerToNode(position int, pipelineNode *types.P
 // UpdateStageStats updates the worker statistics for a given stage from an incoming message
 func (schedule *Schedule) UpdateStageStats(message *types.Message) {
 	worker := schedule.StageList.FindWorker(message.Sender)
+	if worker == nil {
+		return
+	}
 	stageStats, ok := (message.Contents).(*types.WorkerStats)
 	if ok {
 		worker.Stats = stageStats
+		worker.LastHeartbeat = time.Now()
 	} else {
 		fmt.Println("ERROR: Could not convert message contents to WorkerStats")
 	}
 }
 
-// UpdateStageInfo updates the stage information for a given stage from an incoming message
-func (schedule *Schedule) UpdateStageInfo(message *types.Message) {
+// UpdateStageInfo updates the stage information for a given stage from an incoming message. Returns an error naming
+// the worker's node and executable if the worker runs a different build or pipeline than the master, in which case the
+// worker is not registered. Returns an error wrapping ErrUnknownWorker if the sender is not a worker of the schedule,
+// such as a worker that has since been replaced.
+func (schedule *Schedule) UpdateStageInfo(message *types.Message) error {
 	fmt.Println("Received worker info from", message.Sender)
 	worker := schedule.StageList.FindWorker(message.Sender)
+	if worker == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownWorker, message.Sender)
+	}
 	stageInfo, ok := (message.Contents).(types.MessageStageInfo)
-	if ok {
-		worker.Address = stageInfo.Address
-		worker.PID = stageInfo.PID
-	} else {
+	if !ok {
 		fmt.Println("ERROR: Could not convert message contents to MessageStageInfo")
+		return nil
 	}
+	if mismatch := schedule.fingerprint.Mismatch(stageInfo.Fingerprint); mismatch != "" {
+		path := "unknown path"
+		if stageInfo.Fingerprint != nil {
+			path = stageInfo.Fingerprint.Path
+		}
+		worker.PID = stageInfo.PID
+		return fmt.Errorf("worker %s on node %s runs %s, which does not match the master's %s: %s", worker.ID,
+			worker.Host, path, schedule.fingerprint.Path, mismatch)
+	}
+	worker.LastHeartbeat = time.Now()
+	worker.Address = stageInfo.Address
+	worker.PID = stageInfo.PID
+	return nil
 }
 
 // StartStages starts GoPipeline workers for all the current stages
@@ -132,12 +185,39 @@ func (schedule *Schedule) StartStages(program string, masterAddress string) {
 	}
 }
 
-// startStage starts a GoPipeline worker for a given stage
+// startStage starts a GoPipeline worker for a given stage. The worker is issued a TLS certificate, which it reads from
+// its standard input.
 func (schedule *Schedule) startWorker(worker *types.Worker, program string, masterAddress string) {
-	sshConnection := types.NewSSHConnection(worker.Host, schedule.sshUser, schedule.sshPort)
-	command := buildWorkerCommand(program, masterAddress, worker, schedule.sshUserPath)
+	identity, err := schedule.Authority.Issue(worker.ID)
+	if err != nil {
+		panic(err)
+	}
+	sshConnection, err := types.NewSSHConnection(worker.Host, schedule.sshOptions)
+	if err != nil {
+		panic(err)
+	}
+	command := buildWorkerCommand(program, masterAddress, worker, schedule.sshUserPath, schedule.sendResults,
+		schedule.queueCapacity)
 	fmt.Println("Running command:", command, "on node:", worker.Host)
-	go sshConnection.RunCommand(command, workerErrorCallback, worker)
+	go sshConnection.RunCommandWithInput(command, identity.Encode(), workerErrorCallback, worker)
+}
+
+// KillWorkers kills the process of every worker in the pipeline
+func (schedule *Schedule) KillWorkers() {
+	for _, stage := range schedule.StageList.List {
+		for _, worker := range stage.Workers {
+			if worker.PID < 0 {
+				continue
+			}
+			sshConnection, err := types.NewSSHConnection(worker.Host, schedule.sshOptions)
+			if err != nil {
+				fmt.Println("ERROR: Could not kill worker", worker.ID+":", err)
+				continue
+			}
+			command := "kill " + strconv.Itoa(worker.PID)
+			sshConnection.RunCommand(command, nil, nil)
+		}
+	}
 }
 
 // workerErrorCallback is the callback for when a worker errors out and dies
@@ -148,53 +228,67 @@ func workerErrorCallback(args ...interface{}) {
 
 // buildWorkerCommand builds the command with which to start a worker.
 // The User Path should have a "/" included in the path.
-func buildWorkerCommand(program string, masterAddress string, worker *types.Worker, userpath string) string {
+func buildWorkerCommand(program string, masterAddress string, worker *types.Worker, userpath string,
+	sendResults bool, queueCapacity int) string {
 	command := userpath + program + " -address=" + masterAddress
 	command += " -id=" + worker.ID
 	command += " -position=" + strconv.Itoa(worker.Stage)
+	command += " -queue=" + strconv.Itoa(queueCapacity)
+	command += " -tls"
+	if sendResults {
+		command += " -results"
+	}
+	if worker.AwaitState {
+		command += " -awaitstate"
+	}
+	if worker.Origin != "" {
+		command += " -origin=" + worker.Origin
+		command += " -resume=" + strconv.FormatUint(worker.Resume, 10)
+	}
 	command += " worker"
 	return command
 }
 
-// EstablishWorkerCommunication establishes initial communication between workers by telling them the address
-// of the next worker in the pipeline
+// EstablishWorkerCommunication establishes initial communication between workers by telling every worker the
+// addresses of the workers of its downstream stages
 func (schedule *Schedule) EstablishWorkerCommunication() {
-	numPositions := schedule.StageList.Length()
-	for position := 1; position < numPositions; position++ {
-		for _, nextWorker := range schedule.StageList.FindByPosition(position).Workers {
-			if nextWorker.Exiting == true {
-				continue
-			}
-			for _, currentWorker := range schedule.StageList.FindByPosition(position - 1).Workers {
-				if currentWorker.Exiting == true {
+	for _, stage := range schedule.StageList.List {
+		for _, downstreamPosition := range stage.Downstream {
+			for _, nextWorker := range schedule.StageList.FindByPosition(downstreamPosition).Workers {
+				if nextWorker.Exiting == true {
 					continue
 				}
-				sendNextWorkerAddress(currentWorker, nextWorker)
+				for _, currentWorker := range stage.Workers {
+					if currentWorker.Exiting == true {
+						continue
+					}
+					schedule.sendNextWorkerAddress(currentWorker, nextWorker)
+				}
 			}
 		}
 	}
 }
 
-// sendNextWorkerAddress sends the next worker's address to the given worker
-func sendNextWorkerAddress(currentWorker *types.Worker, nextWorker *types.Worker) {
-	message := new(types.Message)
-	message.Sender = "0"
-	message.Description = common.MsgAddNextStageAddr
-	message.Contents = nextWorker.Address
-	connection, err := net.Dial("tcp", currentWorker.Address)
-	// defer connection.Close()
-	if err != nil {
+// sendNextWorkerAddress sends the next worker's address and stage position to the given worker, and records the given
+// worker as sending its results to the next worker
+func (schedule *Schedule) sendNextWorkerAddress(currentWorker *types.Worker, nextWorker *types.Worker) {
+	nextWorker.Upstream = append(nextWorker.Upstream, currentWorker.ID)
+	nextStage := types.NextStageAddress{Position: nextWorker.Stage, Address: nextWorker.Address}
+	if err := schedule.commandWorker(currentWorker, common.MsgAddNextStageAddr, nextStage); err != nil {
 		panic(err)
 	}
-	encoder := gob.NewEncoder(connection)
-	encoder.Encode(message)
 }
 
 // Dynamic does dynamic scheduling of the pipeline stages on the available nodes, with the aim of increasing
-// throughput and memory utilization
+// throughput and memory utilization. Workers that have failed are replaced. Returns once the pipeline has finished.
+// Once a source stage starts running out of items to produce, the stages are no longer scaled or moved.
 func (schedule *Schedule) Dynamic(program string, masterAddress string) {
-	for {
+	for !schedule.IsFinished() {
 		time.Sleep(1 * time.Second)
+		schedule.replaceFailedWorkers(program, masterAddress)
+		if schedule.isDraining() {
+			continue
+		}
 		bottleneck, numToScale := schedule.StageList.FindBottleneck()
 		if bottleneck == -1 {
 			fmt.Println("There is no bottleneck")
@@ -0,0 +1,107 @@
+package types
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Barrier marks a consistent point in the stream of items. The master sends it to the workers of the source stages,
+// which pass it on to the next workers between two results. A worker that has received the barrier from every worker
+// sending results to it takes a snapshot, and passes the barrier on.
+type Barrier struct {
+	CheckpointID int      // The ID of the checkpoint the barrier belongs to
+	Upstream     []string // Set by the master only: the IDs of the workers the barrier should be received from
+}
+
+// WorkerCheckpoint is the snapshot a worker takes when a barrier passes it
+type WorkerCheckpoint struct {
+	CheckpointID int    // The ID of the checkpoint the snapshot belongs to
+	WorkerID     string // The ID of the worker that took the snapshot
+	Position     int    // The position of the worker's stage
+	Sequence     uint64 // For source stage workers, the number of items produced before the barrier
+	State        []byte // The snapshot of the worker's StateStore, if its stage is stateful
+}
+
+// Checkpoint is a consistent snapshot of the whole pipeline, made up of the snapshots of every worker
+type Checkpoint struct {
+	ID      int                 // The ID of the checkpoint, increasing with every checkpoint of a run
+	Time    time.Time           // The time at which the checkpoint was started
+	Workers []*WorkerCheckpoint // The snapshots of every worker
+}
+
+// NewCheckpoint creates a new empty checkpoint with the given ID
+func NewCheckpoint(id int) *Checkpoint {
+	checkpoint := new(Checkpoint)
+	checkpoint.ID = id
+	checkpoint.Time = time.Now()
+	checkpoint.Workers = make([]*WorkerCheckpoint, 0)
+	return checkpoint
+}
+
+// ForPosition merges the snapshots of every worker of the stage at the given position into a single snapshot, so that
+// it can be restored on a single worker. The keyed states are combined, and the largest source sequence is kept.
+func (checkpoint *Checkpoint) ForPosition(position int) (*WorkerCheckpoint, error) {
+	merged := new(WorkerCheckpoint)
+	merged.CheckpointID = checkpoint.ID
+	merged.Position = position
+	state := NewStateStore()
+	for _, workerCheckpoint := range checkpoint.Workers {
+		if workerCheckpoint.Position != position {
+			continue
+		}
+		if workerCheckpoint.Sequence > merged.Sequence {
+			merged.Sequence = workerCheckpoint.Sequence
+		}
+		if len(workerCheckpoint.State) > 0 {
+			if err := state.Merge(workerCheckpoint.State); err != nil {
+				return nil, err
+			}
+		}
+	}
+	snapshot, err := state.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	merged.State = snapshot
+	return merged, nil
+}
+
+// Write writes the checkpoint to the file at the given path. The checkpoint is written to a temporary file first, so
+// that the file always holds the last completed checkpoint.
+func (checkpoint *Checkpoint) Write(path string) error {
+	return writeGobFile(path, checkpoint)
+}
+
+// Write writes the snapshot to the file at the given path, on the worker's local disk
+func (workerCheckpoint *WorkerCheckpoint) Write(path string) error {
+	return writeGobFile(path, workerCheckpoint)
+}
+
+// writeGobFile gob-encodes the value into a temporary file, and then moves it to the given path
+func writeGobFile(path string, value interface{}) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ReadCheckpoint reads a checkpoint written by the master
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	checkpoint := new(Checkpoint)
+	if err = gob.NewDecoder(file).Decode(checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
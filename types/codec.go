@@ -0,0 +1,142 @@
+package types
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Names of the built-in codecs
+const (
+	GobCodec  = "gob"  // Encodes items with encoding/gob. Every type passed between the stages must be registered
+	JSONCodec = "json" // Encodes items as JSON. Items are decoded into maps, slices, strings, float64s and bools
+	RawCodec  = "raw"  // Sends []byte and string items as they are. Items are decoded into []byte
+)
+
+// Codec encodes the items passed between the stages of a pipeline. The codec used along an edge is chosen with
+// Pipeline.UseCodec or Pipeline.ConnectWithCodec, and negotiated by the two workers when they connect, so a codec
+// must be registered with RegisterCodec by every process running the pipeline.
+type Codec interface {
+	Name() string                               // The name the codec is registered and negotiated under
+	Marshal(item interface{}) ([]byte, error)   // Encodes an item
+	Unmarshal(data []byte) (interface{}, error) // Decodes an item encoded by Marshal
+}
+
+// codecs holds every registered codec, by name
+var codecs = make(map[string]Codec)
+
+// codecNames holds the names of the registered codecs, in the order they were registered in
+var codecNames = make([]string, 0)
+
+// codecsMutex guards codecs and codecNames
+var codecsMutex = &sync.Mutex{}
+
+// init registers the built-in codecs, along with the generic types the JSON codec decodes items into, so that items
+// received along a JSON edge can be sent on along a gob edge
+func init() {
+	RegisterCodec(new(gobCodec))
+	RegisterCodec(new(jsonCodec))
+	RegisterCodec(new(rawCodec))
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// RegisterCodec makes a codec available to pipelines under its name, replacing any codec registered under the same
+// name. Must be called before the pipeline is run, on the master and the workers alike.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	if _, ok := codecs[codec.Name()]; !ok {
+		codecNames = append(codecNames, codec.Name())
+	}
+	codecs[codec.Name()] = codec
+}
+
+// LookupCodec returns the codec registered under the given name, or nil if there is none
+func LookupCodec(name string) Codec {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	return codecs[name]
+}
+
+// CodecNames returns the names of the registered codecs, in the order they were registered in
+func CodecNames() []string {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	return append([]string(nil), codecNames...)
+}
+
+// gobCodec encodes items with encoding/gob
+type gobCodec struct{}
+
+// Name returns the name of the gob codec
+func (codec *gobCodec) Name() string {
+	return GobCodec
+}
+
+// Marshal encodes the item with gob, along with its type
+func (codec *gobCodec) Marshal(item interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(&item); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Unmarshal decodes an item encoded with gob
+func (codec *gobCodec) Unmarshal(data []byte) (interface{}, error) {
+	var item interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// jsonCodec encodes items as JSON
+type jsonCodec struct{}
+
+// Name returns the name of the JSON codec
+func (codec *jsonCodec) Name() string {
+	return JSONCodec
+}
+
+// Marshal encodes the item as JSON
+func (codec *jsonCodec) Marshal(item interface{}) ([]byte, error) {
+	return json.Marshal(item)
+}
+
+// Unmarshal decodes a JSON item into the generic Go representation of its value
+func (codec *jsonCodec) Unmarshal(data []byte) (interface{}, error) {
+	var item interface{}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// rawCodec sends the bytes of []byte and string items as they are
+type rawCodec struct{}
+
+// Name returns the name of the raw codec
+func (codec *rawCodec) Name() string {
+	return RawCodec
+}
+
+// Marshal returns the bytes of the item. Returns an error if the item is neither a []byte nor a string.
+func (codec *rawCodec) Marshal(item interface{}) ([]byte, error) {
+	switch value := item.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	default:
+		return nil, fmt.Errorf("the raw codec can only send []byte and string items, not %T", item)
+	}
+}
+
+// Unmarshal returns a copy of the bytes
+func (codec *rawCodec) Unmarshal(data []byte) (interface{}, error) {
+	return append([]byte(nil), data...), nil
+}
@@ -0,0 +1,66 @@
+package types
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Names of the compression algorithms that can be used along an edge
+const (
+	NoCompression    = "none"  // Payloads are sent as they are
+	FlateCompression = "flate" // Payloads are compressed with compress/flate
+	GzipCompression  = "gzip"  // Payloads are compressed with compress/gzip
+)
+
+// Compression describes how the payloads sent along an edge are compressed
+type Compression struct {
+	Algorithm string // The name of the compression algorithm. If empty, payloads are not compressed
+	Threshold int    // The size in bytes below which payloads are sent uncompressed
+}
+
+// Compress compresses the payloads sent along every edge of the pipeline, and the results sent back to the master,
+// with the given algorithm, unless they are smaller than threshold bytes. Edges compressed with CompressEdge keep their
+// own settings.
+func (pipeline *Pipeline) Compress(algorithm string, threshold int) {
+	pipeline.Compression = Compression{Algorithm: algorithm, Threshold: threshold}
+}
+
+// CompressEdge compresses the payloads sent from the stage at position from to the stage at position to with the given
+// algorithm, unless they are smaller than threshold bytes. Returns an error if there is no such edge.
+func (pipeline *Pipeline) CompressEdge(from int, to int, algorithm string, threshold int) error {
+	if len(pipeline.Edges) == 0 {
+		pipeline.Edges = append(pipeline.Edges, pipeline.GetEdges()...)
+	}
+	for index, edge := range pipeline.Edges {
+		if edge.From == from && edge.To == to {
+			pipeline.Edges[index].Compression = Compression{Algorithm: algorithm, Threshold: threshold}
+			return nil
+		}
+	}
+	return errors.New("The pipeline has no edge to compress: " + strconv.Itoa(from) + " -> " + strconv.Itoa(to))
+}
+
+// EdgeCompression returns how the payloads sent from the stage at position from to the stage at position to are
+// compressed
+func (pipeline *Pipeline) EdgeCompression(from int, to int) Compression {
+	for _, edge := range pipeline.GetEdges() {
+		if edge.From == from && edge.To == to && edge.Compression.Algorithm != "" {
+			return edge.Compression
+		}
+	}
+	return pipeline.GetCompression()
+}
+
+// GetCompression returns how the payloads sent along the edges without their own settings are compressed
+func (pipeline *Pipeline) GetCompression() Compression {
+	if pipeline.Compression.Algorithm == "" {
+		return Compression{Algorithm: NoCompression}
+	}
+	return pipeline.Compression
+}
+
+// isSupportedCompression returns true if the algorithm is one of the supported compression algorithms
+func isSupportedCompression(algorithm string) bool {
+	return algorithm == "" || algorithm == NoCompression || algorithm == FlateCompression ||
+		algorithm == GzipCompression
+}
@@ -0,0 +1,72 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DeadLetter is the stored form of an input that a stage failed to process. Dead letters are stored by the master as
+// JSON lines. The input is stored twice: as text, for inspection, and gob-encoded, so it can be replayed.
+type DeadLetter struct {
+	Time       time.Time `json:"time"`                 // The time at which the master received the failure
+	WorkerID   string    `json:"workerID"`             // The ID of the worker that failed to process the input
+	Position   int       `json:"position"`             // The position of the stage that failed to process the input
+	Error      string    `json:"error"`                // The error returned by, or the panic raised in, the last attempt
+	StackTrace string    `json:"stackTrace,omitempty"` // The stack trace of the worker, if the last attempt panicked
+	Attempts   int       `json:"attempts"`             // The number of times the stage attempted to process the input
+	InputText  string    `json:"input"`                // The input, formatted with fmt.Sprint
+	Payload    []byte    `json:"payload"`              // The gob-encoded input
+}
+
+// NewDeadLetter creates a DeadLetter out of a StageFailure. The type of the failed input must be registered with gob.
+func NewDeadLetter(failure *StageFailure) (*DeadLetter, error) {
+	deadLetter := new(DeadLetter)
+	deadLetter.Time = time.Now()
+	deadLetter.WorkerID = failure.WorkerID
+	deadLetter.Position = failure.Position
+	deadLetter.Error = failure.Error
+	deadLetter.StackTrace = failure.StackTrace
+	deadLetter.Attempts = failure.Attempts
+	deadLetter.InputText = fmt.Sprint(failure.Input)
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&failure.Input); err != nil {
+		return nil, err
+	}
+	deadLetter.Payload = payload.Bytes()
+	return deadLetter, nil
+}
+
+// Input decodes the failed input out of the dead letter's payload, so that it can be replayed. The type of the input
+// must be registered with gob, which RunPipeline does for every type of the pipeline.
+func (deadLetter *DeadLetter) Input() (input interface{}, err error) {
+	err = gob.NewDecoder(bytes.NewReader(deadLetter.Payload)).Decode(&input)
+	return
+}
+
+// ReadDeadLetters reads every dead letter from a file written by the master
+func ReadDeadLetters(path string) ([]*DeadLetter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	deadLetters := make([]*DeadLetter, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		deadLetter := new(DeadLetter)
+		if err = json.Unmarshal(scanner.Bytes(), deadLetter); err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, scanner.Err()
+}
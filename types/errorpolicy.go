@@ -0,0 +1,55 @@
+package types
+
+import (
+	"strconv"
+	"time"
+)
+
+// ErrorFunc is a stage function that reports failure by returning an error instead of panicking
+type ErrorFunc func(arg interface{}) (interface{}, error)
+
+// ErrorAction is what a worker does with an input that its stage failed to process
+type ErrorAction int
+
+// The actions a worker can take once a stage has failed to process an input, and has run out of retries
+const (
+	AbortOnError      ErrorAction = 0 // Stop the whole pipeline
+	SkipOnError       ErrorAction = 1 // Drop the input and carry on with the next one
+	DeadLetterOnError ErrorAction = 2 // Send the input to the master's dead-letter store and carry on
+)
+
+// ErrorPolicy controls how a worker handles errors returned by its stage's ErrorFunc
+type ErrorPolicy struct {
+	MaxRetries int           // The number of times to retry a failed input before giving up on it
+	Backoff    time.Duration // The time to wait before the first retry. Doubles with every following retry
+	OnFailure  ErrorAction   // What to do with the input once every retry has failed
+}
+
+// DefaultErrorPolicy aborts the pipeline on the first error, so that no error goes unnoticed
+var DefaultErrorPolicy = ErrorPolicy{MaxRetries: 0, Backoff: 0, OnFailure: AbortOnError}
+
+// RetryDelay returns the time to wait before the given retry, starting at 1
+func (policy *ErrorPolicy) RetryDelay(retry int) time.Duration {
+	return policy.Backoff * time.Duration(1<<uint(retry-1))
+}
+
+// StageFailure describes an input that a stage failed to process
+type StageFailure struct {
+	WorkerID   string      // The ID of the worker that failed to process the input
+	Position   int         // The position of the stage that failed to process the input
+	Input      interface{} // The input that could not be processed
+	Error      string      // The error returned by (or the panic raised in) the last attempt
+	StackTrace string      // The stack trace of the worker if the last attempt panicked, otherwise empty
+	Attempts   int         // The number of times the stage attempted to process the input
+}
+
+// String converts the StageFailure into a String
+func (failure *StageFailure) String() string {
+	failureString := "StageFailure {"
+	failureString += " Worker: " + failure.WorkerID
+	failureString += " Position: " + strconv.Itoa(failure.Position)
+	failureString += " Attempts: " + strconv.Itoa(failure.Attempts)
+	failureString += " Error: " + failure.Error
+	failureString += " }"
+	return failureString
+}
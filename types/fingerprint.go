@@ -0,0 +1,135 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// Fingerprint identifies the build of the program running a pipeline, along with the stages of the pipeline. The
+// master compares the fingerprint reported by every worker with its own, since a worker running a stale build on one
+// node would run different stage functions than the master expects.
+type Fingerprint struct {
+	Path       string   // The path to the executable. Reported for error messages only, not compared
+	Executable string   // The SHA-256 hash of the executable
+	Stages     []string // The identity of every stage of the pipeline, in order
+	Edges      []Edge   // The edges between the stages, including the implicit ones of a linear pipeline
+}
+
+// NewFingerprint computes the fingerprint of the running executable and the given pipeline
+func NewFingerprint(pipeline *Pipeline) (*Fingerprint, error) {
+	fingerprint := new(Fingerprint)
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	fingerprint.Path = path
+	if fingerprint.Executable, err = hashFile(path); err != nil {
+		return nil, err
+	}
+	fingerprint.Stages = make([]string, 0)
+	for _, stage := range pipeline.Stages {
+		fingerprint.Stages = append(fingerprint.Stages, stage.Identity())
+	}
+	fingerprint.Edges = append(make([]Edge, 0), pipeline.GetEdges()...)
+	return fingerprint, nil
+}
+
+// Identity describes the kind of the stage and its name, such as "batch main.tokenize". The name is the one given with
+// StageDefinition.Named, or else the name of the function the stage runs. Two builds of the same program give the
+// same identity to a stage as long as its function has not been renamed or moved.
+func (stage *StageDefinition) Identity() string {
+	var kind string
+	var function interface{}
+	switch {
+	case stage.StatefulFunc != nil:
+		kind, function = "stateful", stage.StatefulFunc
+	case stage.BatchFunction != nil:
+		kind, function = "batch", stage.BatchFunction
+	case stage.FilterFunction != nil:
+		kind, function = "filter", stage.FilterFunction
+	case stage.FlatMapFunction != nil:
+		kind, function = "flatmap", stage.FlatMapFunction
+	case stage.ErrorFunction != nil:
+		kind, function = "error", stage.ErrorFunction
+	default:
+		kind, function = "map", stage.Function
+	}
+	if stage.Name != "" {
+		return kind + " " + stage.Name
+	}
+	return kind + " " + FunctionName(function)
+}
+
+// Mismatch describes how the other fingerprint differs from this one. Returns an empty string if they match.
+func (fingerprint *Fingerprint) Mismatch(other *Fingerprint) string {
+	if other == nil {
+		return "no fingerprint was reported"
+	}
+	differences := make([]string, 0)
+	if other.Executable != fingerprint.Executable {
+		differences = append(differences, fmt.Sprintf("the executable hash is %.12s instead of %.12s",
+			other.Executable, fingerprint.Executable))
+	}
+	if len(other.Stages) != len(fingerprint.Stages) {
+		differences = append(differences, fmt.Sprintf("the pipeline has %d stages instead of %d", len(other.Stages),
+			len(fingerprint.Stages)))
+	} else {
+		for position, identity := range fingerprint.Stages {
+			if other.Stages[position] != identity {
+				differences = append(differences, fmt.Sprintf("stage %d is %q instead of %q", position,
+					other.Stages[position], identity))
+			}
+		}
+	}
+	if !sameEdges(other.Edges, fingerprint.Edges) {
+		differences = append(differences, fmt.Sprintf("the edges are %v instead of %v", other.Edges,
+			fingerprint.Edges))
+	}
+	return strings.Join(differences, "; ")
+}
+
+// sameEdges returns true if both lists hold the same edges in the same order. An empty list and a nil list are the
+// same, since gob decodes an empty list as nil.
+func sameEdges(edges []Edge, otherEdges []Edge) bool {
+	if len(edges) != len(otherEdges) {
+		return false
+	}
+	for index, edge := range edges {
+		if otherEdges[index] != edge {
+			return false
+		}
+	}
+	return true
+}
+
+// FunctionName returns the fully qualified name of the given function, such as "main.tokenize", or "none" if it is nil
+func FunctionName(function interface{}) string {
+	value := reflect.ValueOf(function)
+	if !value.IsValid() || value.IsNil() {
+		return "none"
+	}
+	if runtimeFunction := runtime.FuncForPC(value.Pointer()); runtimeFunction != nil {
+		return runtimeFunction.Name()
+	}
+	return "unknown"
+}
+
+// hashFile returns the hex-encoded SHA-256 hash of the file at the given path
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
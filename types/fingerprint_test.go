@@ -0,0 +1,84 @@
+package types
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+)
+
+func fingerprintTestStage(arg interface{}) interface{} {
+	return arg
+}
+
+func otherFingerprintTestStage(arg interface{}) interface{} {
+	return nil
+}
+
+// TestFingerprintGobRoundTrip checks that a fingerprint sent by a worker matches the master's after crossing the wire,
+// for linear pipelines, whose edges are implicit, as well as for pipelines with explicit edges
+func TestFingerprintGobRoundTrip(t *testing.T) {
+	linear := NewPipeline([]AnyFunc{fingerprintTestStage, fingerprintTestStage})
+	fanOut := NewPipeline([]AnyFunc{fingerprintTestStage, fingerprintTestStage, fingerprintTestStage})
+	fanOut.Connect(0, 1)
+	fanOut.Connect(0, 2)
+	single := NewPipeline([]AnyFunc{fingerprintTestStage})
+	tests := []struct {
+		name     string    // The name of the test case
+		pipeline *Pipeline // The pipeline the fingerprint is computed for
+	}{
+		{"linear", linear},
+		{"fan-out", fanOut},
+		{"single stage", single},
+	}
+	for _, test := range tests {
+		fingerprint, err := NewFingerprint(test.pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buffer bytes.Buffer
+		if err = gob.NewEncoder(&buffer).Encode(fingerprint); err != nil {
+			t.Fatal(err)
+		}
+		received := new(Fingerprint)
+		if err = gob.NewDecoder(&buffer).Decode(received); err != nil {
+			t.Fatal(err)
+		}
+		if mismatch := fingerprint.Mismatch(received); mismatch != "" {
+			t.Errorf("%s: the fingerprint does not match itself after a gob round trip: %s", test.name, mismatch)
+		}
+	}
+}
+
+// TestFingerprintMismatch checks that every kind of difference between two fingerprints is reported
+func TestFingerprintMismatch(t *testing.T) {
+	master, err := NewFingerprint(NewPipeline([]AnyFunc{fingerprintTestStage, fingerprintTestStage}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed, _ := NewFingerprint(NewPipeline([]AnyFunc{fingerprintTestStage, otherFingerprintTestStage}))
+	longer, _ := NewFingerprint(NewPipeline([]AnyFunc{fingerprintTestStage, fingerprintTestStage,
+		fingerprintTestStage}))
+	rebuilt, _ := NewFingerprint(NewPipeline([]AnyFunc{fingerprintTestStage, fingerprintTestStage}))
+	rebuilt.Executable = "0000"
+	reversed := NewPipeline([]AnyFunc{fingerprintTestStage, fingerprintTestStage})
+	reversed.Connect(1, 0)
+	rewired, _ := NewFingerprint(reversed)
+	tests := []struct {
+		name  string       // The name of the test case
+		other *Fingerprint // The fingerprint reported by the worker
+		want  string       // A part of the expected mismatch. Empty if the fingerprints should match
+	}{
+		{"missing", nil, "no fingerprint"},
+		{"renamed stage", renamed, "stage 1"},
+		{"extra stage", longer, "3 stages instead of 2"},
+		{"different executable", rebuilt, "executable hash"},
+		{"different edges", rewired, "edges"},
+	}
+	for _, test := range tests {
+		mismatch := master.Mismatch(test.other)
+		if !strings.Contains(mismatch, test.want) {
+			t.Errorf("%s: got mismatch %q, want it to contain %q", test.name, mismatch, test.want)
+		}
+	}
+}
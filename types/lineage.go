@@ -0,0 +1,77 @@
+package types
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math/big"
+)
+
+// Part locates an item among the items a stage derived from a single input, such as the outputs of a flat-map stage or
+// of a batch
+type Part struct {
+	Index int // The position of the item among the items derived from the input
+	Count int // The number of items derived from the input
+}
+
+// DeriveParts returns the parts of the index-th of count items derived from an input with the given parts. An item
+// that is the only one derived from its input keeps the parts of the input.
+func DeriveParts(parts []Part, index int, count int) []Part {
+	if count <= 1 {
+		return parts
+	}
+	derived := make([]Part, len(parts), len(parts)+1)
+	copy(derived, parts)
+	return append(derived, Part{Index: index, Count: count})
+}
+
+// Span returns the share of its source item that an item with the given parts stands for, as an interval within
+// [0, 1]. The items derived from an input split the input's interval into equal shares, in order, so that together the
+// items derived from a source item cover [0, 1] exactly once.
+func Span(parts []Part) (start *big.Rat, end *big.Rat) {
+	start = new(big.Rat)
+	width := big.NewRat(1, 1)
+	for _, part := range parts {
+		width.Quo(width, big.NewRat(int64(part.Count), 1))
+		start.Add(start, new(big.Rat).Mul(width, big.NewRat(int64(part.Index), 1)))
+	}
+	end = new(big.Rat).Add(start, width)
+	return
+}
+
+// SourceID returns the ID of the item with the given sequence number produced by a source stage worker. IDs are
+// derived from what an item derives from, rather than counted, so that an item sent again, whether after a connection
+// failed or by the worker replacing a failed one, keeps its ID and is recognized as a duplicate.
+func SourceID(position int, origin string, sequence uint64) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(origin))
+	writeIDFields(hash, uint64(position), sequence)
+	return nonZeroID(hash.Sum64())
+}
+
+// DerivedID returns the ID of the index-th of count items derived by the stage at the given position from the input
+// with the given ID. count is 0 for the skip that replaces an input that produced no item. Since the ID of the input
+// is part of it, the items derived from the same source item along different branches of the pipeline get different
+// IDs.
+func DerivedID(position int, inputID uint64, index int, count int) uint64 {
+	hash := fnv.New64a()
+	writeIDFields(hash, uint64(position), inputID, uint64(index), uint64(count))
+	return nonZeroID(hash.Sum64())
+}
+
+// writeIDFields writes the given fields to the hash an ID is computed with
+func writeIDFields(hash io.Writer, fields ...uint64) {
+	buffer := make([]byte, 8)
+	for _, field := range fields {
+		binary.BigEndian.PutUint64(buffer, field)
+		hash.Write(buffer)
+	}
+}
+
+// nonZeroID returns the given ID, unless it is 0, which is reserved for messages that have no ID
+func nonZeroID(id uint64) uint64 {
+	if id == 0 {
+		return 1
+	}
+	return id
+}
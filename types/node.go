@@ -46,17 +46,16 @@ func (pipelineNode *PipelineNode) HasEnoughMemory(requirement uint64) bool {
 	return false
 }
 
-// RemoveWorker removes the worker from the Workers list
+// RemoveWorker removes the worker from the Workers list. Does nothing if the worker is not in the list.
 func (pipelineNode *PipelineNode) RemoveWorker(workerID string) {
-	var indexToRemove int
+	indexToRemove, found := 0, false
 	for index, worker := range pipelineNode.Workers {
 		if worker.ID == workerID {
-			indexToRemove = index
+			indexToRemove, found = index, true
+			break
 		}
 	}
-	if indexToRemove == len(pipelineNode.Workers) {
-		pipelineNode.Workers = pipelineNode.Workers[:indexToRemove]
-	} else {
+	if found {
 		pipelineNode.Workers = append(pipelineNode.Workers[:indexToRemove], pipelineNode.Workers[indexToRemove+1:]...)
 	}
 }
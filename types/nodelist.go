@@ -29,6 +29,9 @@ func (nodeList *PipelineNodeList) FindNode(nodeAddress string) (pipelineNode *Pi
 // RemoveWorker removes the worker from the correct stage
 func (nodeList *PipelineNodeList) RemoveWorker(workerID string) {
 	node := nodeList.FindNodeWithWorker(workerID)
+	if node == nil {
+		return
+	}
 	node.RemoveWorker(workerID)
 }
 
@@ -60,6 +63,16 @@ func (nodeList *PipelineNodeList) AddNode(node *PipelineNode) {
 	nodeList.List = append(nodeList.List, node)
 }
 
+// RemoveNode removes the node with the given address from the PipelineNodeList
+func (nodeList *PipelineNodeList) RemoveNode(nodeAddress string) {
+	for index, node := range nodeList.List {
+		if node.Address == nodeAddress {
+			nodeList.List = append(nodeList.List[:index], nodeList.List[index+1:]...)
+			return
+		}
+	}
+}
+
 // Length returns the number of nodes in the PipelineNodeList
 func (nodeList *PipelineNodeList) Length() int {
 	return len(nodeList.List)
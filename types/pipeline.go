@@ -0,0 +1,208 @@
+package types
+
+import (
+	"encoding/gob"
+	"time"
+)
+
+// StageDefinition describes a single stage of the pipeline, as written by the user of the library
+type StageDefinition struct {
+	Position        int           // The position of the stage in the pipeline's list of stages
+	Function        AnyFunc       // The function executed by the workers running this stage
+	ErrorFunction   ErrorFunc     // If not nil, executed instead of Function, with errors handled according to ErrorPolicy
+	ErrorPolicy     *ErrorPolicy  // How errors returned by ErrorFunction, and panics in the other functions, are handled
+	FlatMapFunction FlatMapFunc   // If not nil, executed instead of Function. Each emitted output is sent on separately
+	FilterFunction  FilterFunc    // If not nil, executed instead of Function. Inputs it rejects are dropped
+	BatchFunction   BatchFunc     // If not nil, executed instead of Function on batches of up to BatchSize inputs
+	BatchSize       int           // The maximum number of inputs passed to BatchFunction at once
+	BatchTimeout    time.Duration // The maximum time to wait for a batch to fill up once it has its first input
+	PartitionKey    KeyFunc       // If not nil, inputs are routed to the workers of this stage by their key
+	StatefulFunc    StatefulFunc  // If not nil, executed instead of Function, with the worker's keyed state
+	Ordered         bool          // Whether the inputs of this stage are processed in the order they were produced in
+	ReorderCapacity int           // The maximum number of out-of-order inputs held back by each worker of this stage
+	ReorderTimeout  time.Duration // The maximum time an out-of-order input is held back for
+	Routing         RoutingPolicy // How the upstream workers choose which worker of this stage receives an input
+	Name            string        // Identifies the stage in fingerprints. If empty, the name of its function is used
+}
+
+// DefaultReorderCapacity is the number of out-of-order inputs held back by an ordered stage if no capacity is given
+const DefaultReorderCapacity = 1000
+
+// DefaultReorderTimeout is the time an out-of-order input is held back for by an ordered stage if no maximum is given
+const DefaultReorderTimeout = 10 * time.Second
+
+// InOrder makes the workers of this stage process their inputs in the order the source stage produced them, by holding
+// back inputs that arrive early in a reorder buffer. The stages in between tell the ordered stage about the inputs they
+// drop, so it does not wait for them. An input that is still missing, because it was lost upstream, is given up on once
+// capacity inputs are held back, or once an input has been held back for maxWait. A capacity or maxWait that is not
+// positive is replaced by DefaultReorderCapacity or DefaultReorderTimeout, since an unlimited buffer would grow without
+// bound behind a lost input. Returns the stage, so that it can be chained with the function that added the stage.
+func (stage *StageDefinition) InOrder(capacity int, maxWait time.Duration) *StageDefinition {
+	if capacity <= 0 {
+		capacity = DefaultReorderCapacity
+	}
+	if maxWait <= 0 {
+		maxWait = DefaultReorderTimeout
+	}
+	stage.Ordered = true
+	stage.ReorderCapacity = capacity
+	stage.ReorderTimeout = maxWait
+	return stage
+}
+
+// PartitionBy partitions the inputs of the stage by the key returned by the given function, so that inputs with the
+// same key are processed by the same worker, even after the stage is scaled. The key is extracted by the upstream
+// workers, before sending an input. Returns the stage, so that it can be chained with the function that added the
+// stage.
+func (stage *StageDefinition) PartitionBy(key KeyFunc) *StageDefinition {
+	stage.PartitionKey = key
+	return stage
+}
+
+// RouteBy sets the policy with which the upstream workers choose which worker of this stage receives an input. Use
+// LeastLoaded or PowerOfTwoChoices when the workers of the stage run on nodes of different speeds. Returns the stage,
+// so that it can be chained with the function that added the stage.
+func (stage *StageDefinition) RouteBy(policy RoutingPolicy) *StageDefinition {
+	stage.Routing = policy
+	return stage
+}
+
+// OnError sets the policy applied to the inputs that make this stage's function panic. Only the policy's OnFailure
+// action is used for a panic, since the filter, flat-map, stateful and batch functions are not retried. Stages added
+// with AddErrorStage also use it for the errors their function returns. Returns the stage, so that it can be chained
+// with the function that added the stage.
+func (stage *StageDefinition) OnError(policy ErrorPolicy) *StageDefinition {
+	stage.ErrorPolicy = &policy
+	return stage
+}
+
+// Named sets the name that identifies the stage in the fingerprint the master compares with the workers'. Stages that
+// wrap a function in a closure, as the typed builder does, should be named after the wrapped function, since every
+// closure created by the same code has the same name. Returns the stage, so that it can be chained with the function
+// that added the stage.
+func (stage *StageDefinition) Named(name string) *StageDefinition {
+	stage.Name = name
+	return stage
+}
+
+// Pipeline describes the stages of a pipeline, along with the types of the values passed between them
+type Pipeline struct {
+	Stages        []*StageDefinition // The stages of the pipeline, in order
+	Edges         []Edge             // The edges between the stages. If empty, each stage feeds into the next one
+	RegisterTypes []interface{}      // A value of every type passed between the stages, to be registered with gob
+	Codec         string             // The name of the codec the items are encoded with. If empty, gob is used
+	Compression   Compression        // How the items are compressed. If empty, they are not compressed
+}
+
+// NewPipeline creates a pipeline out of a list of functions. registerTypes should contain a value of every type that
+// is passed between the functions.
+func NewPipeline(functionList []AnyFunc, registerTypes ...interface{}) *Pipeline {
+	pipeline := new(Pipeline)
+	pipeline.Stages = make([]*StageDefinition, 0)
+	pipeline.Edges = make([]Edge, 0)
+	pipeline.RegisterTypes = make([]interface{}, 0)
+	for _, function := range functionList {
+		pipeline.AddStage(function)
+	}
+	pipeline.AddRegisterTypes(registerTypes...)
+	return pipeline
+}
+
+// UseCodec encodes the items passed between the stages with the codec registered under the given name, except along
+// edges added with ConnectWithCodec. The results sent back to the master are encoded with it too.
+func (pipeline *Pipeline) UseCodec(name string) {
+	pipeline.Codec = name
+}
+
+// GetCodec returns the name of the codec the items passed between the stages are encoded with
+func (pipeline *Pipeline) GetCodec() string {
+	if pipeline.Codec == "" {
+		return GobCodec
+	}
+	return pipeline.Codec
+}
+
+// AddStage appends a stage running the given function to the end of the pipeline
+func (pipeline *Pipeline) AddStage(function AnyFunc) *StageDefinition {
+	stage := new(StageDefinition)
+	stage.Function = function
+	return pipeline.appendStage(stage)
+}
+
+// AddErrorStage appends a stage running the given error-returning function to the end of the pipeline. Errors are
+// handled according to the given policy.
+func (pipeline *Pipeline) AddErrorStage(function ErrorFunc, policy ErrorPolicy) *StageDefinition {
+	stage := new(StageDefinition)
+	stage.ErrorFunction = function
+	stage.ErrorPolicy = &policy
+	return pipeline.appendStage(stage)
+}
+
+// AddStatefulStage appends a stage running the given function with access to the keyed state of its worker to the end
+// of the pipeline. Every value stored in the state must be of a type passed to AddRegisterTypes.
+func (pipeline *Pipeline) AddStatefulStage(function StatefulFunc) *StageDefinition {
+	stage := new(StageDefinition)
+	stage.StatefulFunc = function
+	return pipeline.appendStage(stage)
+}
+
+// AddFlatMapStage appends a stage running the given emitter-style function to the end of the pipeline
+func (pipeline *Pipeline) AddFlatMapStage(function FlatMapFunc) *StageDefinition {
+	stage := new(StageDefinition)
+	stage.FlatMapFunction = function
+	return pipeline.appendStage(stage)
+}
+
+// AddFilterStage appends a stage that drops every input rejected by the given function to the end of the pipeline
+func (pipeline *Pipeline) AddFilterStage(function FilterFunc) *StageDefinition {
+	stage := new(StageDefinition)
+	stage.FilterFunction = function
+	return pipeline.appendStage(stage)
+}
+
+// AddBatchStage appends a stage that processes batches of inputs to the end of the pipeline. A batch is processed as
+// soon as it holds batchSize inputs, or batchTimeout after its first input arrived, whichever comes first. Batching
+// has no effect on the first stage, which has no inputs.
+func (pipeline *Pipeline) AddBatchStage(function BatchFunc, batchSize int, batchTimeout time.Duration) *StageDefinition {
+	stage := new(StageDefinition)
+	stage.BatchFunction = function
+	stage.BatchSize = batchSize
+	stage.BatchTimeout = batchTimeout
+	return pipeline.appendStage(stage)
+}
+
+// appendStage sets the position of the stage, and appends it to the end of the pipeline
+func (pipeline *Pipeline) appendStage(stage *StageDefinition) *StageDefinition {
+	stage.Position = len(pipeline.Stages)
+	pipeline.Stages = append(pipeline.Stages, stage)
+	return stage
+}
+
+// AddRegisterTypes adds values of types that are passed between the stages. nil values are ignored, since they
+// carry no type information.
+func (pipeline *Pipeline) AddRegisterTypes(registerTypes ...interface{}) {
+	for _, registerType := range registerTypes {
+		if registerType != nil {
+			pipeline.RegisterTypes = append(pipeline.RegisterTypes, registerType)
+		}
+	}
+}
+
+// Length returns the number of stages in the pipeline
+func (pipeline *Pipeline) Length() int {
+	return len(pipeline.Stages)
+}
+
+// Register registers every type passed between the stages with gob. Should be called once, before any stage results
+// are encoded or decoded.
+func (pipeline *Pipeline) Register() {
+	gob.Register(new(StageFailure))
+	gob.Register(make([]interface{}, 0))
+	gob.Register(NextStageAddress{})
+	gob.Register(new(Acknowledgement))
+	gob.Register(new(Barrier))
+	gob.Register(new(WorkerCheckpoint))
+	for _, registerType := range pipeline.RegisterTypes {
+		gob.Register(registerType)
+	}
+}
@@ -0,0 +1,35 @@
+package types
+
+// RoutingPolicy decides which worker of a scaled stage receives the next input. It has no effect on partitioned
+// stages, whose inputs are always routed by their key.
+type RoutingPolicy int
+
+const (
+	// RoundRobin sends the inputs to the workers of the stage in turn. This is the default.
+	RoundRobin RoutingPolicy = iota
+	// LeastLoaded sends every input to the worker with the smallest load, i.e. the smallest backlog reported in its
+	// last acknowledgement plus the number of inputs sent to it that it has not acknowledged yet
+	LeastLoaded
+	// PowerOfTwoChoices picks two workers of the stage at random, and sends the input to the less loaded of the two.
+	// It avoids sending every input to the same worker between two acknowledgements.
+	PowerOfTwoChoices
+)
+
+// String returns the name of the routing policy
+func (policy RoutingPolicy) String() string {
+	switch policy {
+	case LeastLoaded:
+		return "LeastLoaded"
+	case PowerOfTwoChoices:
+		return "PowerOfTwoChoices"
+	default:
+		return "RoundRobin"
+	}
+}
+
+// Acknowledgement tells a worker that the results it sent with the given IDs have been processed. The backlog of the
+// acknowledging worker is piggybacked on it, so that the sending worker can route its next results by load.
+type Acknowledgement struct {
+	MessageIDs []uint64 // The IDs of the processed results
+	Backlog    int      // The number of inputs waiting in the input queue of the acknowledging worker
+}
@@ -0,0 +1,51 @@
+package types
+
+// EndOfStreamMarker is the type of the EndOfStream value
+type EndOfStreamMarker struct{}
+
+// EndOfStream is returned by the function of the first stage to signal that it has no more items to produce. Once a
+// first stage worker receives it, it stops calling its function and the end of the stream is propagated through the
+// rest of the pipeline.
+var EndOfStream = EndOfStreamMarker{}
+
+// Source produces the items that are fed into the pipeline by the first stage
+type Source interface {
+	// Next returns the next item produced by the source. ok is false when the source is exhausted.
+	Next() (item interface{}, ok bool)
+}
+
+// NewSourceFunc wraps a Source in a function that can be used as the first stage of the pipeline. The function returns
+// EndOfStream once the source is exhausted.
+func NewSourceFunc(source Source) AnyFunc {
+	return func(arg interface{}) interface{} {
+		item, ok := source.Next()
+		if !ok {
+			return EndOfStream
+		}
+		return item
+	}
+}
+
+// SliceSource is a Source that produces the items of a slice, in order
+type SliceSource struct {
+	Items []interface{} // The items to produce
+	index int           // The index of the next item to produce
+}
+
+// NewSliceSource creates a new SliceSource out of the given items
+func NewSliceSource(items []interface{}) *SliceSource {
+	sliceSource := new(SliceSource)
+	sliceSource.Items = items
+	sliceSource.index = 0
+	return sliceSource
+}
+
+// Next returns the next item in the slice
+func (sliceSource *SliceSource) Next() (item interface{}, ok bool) {
+	if sliceSource.index >= len(sliceSource.Items) {
+		return nil, false
+	}
+	item = sliceSource.Items[sliceSource.index]
+	sliceSource.index++
+	return item, true
+}
@@ -0,0 +1,277 @@
+package types
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+// Host key policies, which decide what happens when a node's host key is not in the known_hosts file
+const (
+	StrictHostKeys    = "strict"     // Nodes whose host key is not in the known_hosts file are refused
+	AcceptNewHostKeys = "accept-new" // The host keys of new nodes are added to the known_hosts file
+)
+
+// maxPassphraseAttempts is the number of times the passphrase of an encrypted key is asked for before giving up
+const maxPassphraseAttempts = 3
+
+// SSHOptions describes how the master logs into the nodes with SSH. The same options are shared by every connection,
+// so that the keys are loaded, and their passphrases asked for, only once. The User, Port and IdentityFiles apply to
+// every node, unless the SSH config file sets them for the node.
+type SSHOptions struct {
+	User           string                // The username to log in as
+	Port           int                   // The port of the SSH server on the nodes
+	ConfigPath     string                // The path to the OpenSSH client configuration file, usually ~/.ssh/config
+	KnownHostsPath string                // The path to the known_hosts file the host keys of the nodes are checked against
+	HostKeyPolicy  string                // What to do with a host key that is not in the known_hosts file: strict or accept-new
+	IdentityFiles  []string              // The paths to the private keys to log in with
+	UseAgent       bool                  // Whether to log in with the keys held by the ssh-agent, if one is running
+	signers        []ssh.Signer          // The keys loaded from the identity files
+	agentClient    agent.Agent           // The client of the running ssh-agent. nil if there is none
+	tried          []string              // Describes the authentication methods that are tried, for error messages
+	config         *SSHConfig            // The SSH config file, read along with the keys
+	hostSigners    map[string]ssh.Signer // The keys loaded from the identity files set in the config file, by path
+	loadError      error                 // The error that occurred while loading the keys, if any
+	loadOnce       sync.Once             // Makes sure the keys are only loaded once
+	hostKeysLock   sync.Mutex            // Guards hostSigners
+	knownHostsLock sync.Mutex            // Guards the known_hosts file
+}
+
+// NewSSHOptions creates the options for logging in as the given user on the given port. By default, host keys are
+// checked strictly against ~/.ssh/known_hosts, and the ssh-agent and the default keys in ~/.ssh are used.
+func NewSSHOptions(remoteUser string, port int) *SSHOptions {
+	options := new(SSHOptions)
+	options.User = remoteUser
+	options.Port = port
+	options.ConfigPath = filepath.Join(homeDir(), ".ssh", "config")
+	options.KnownHostsPath = filepath.Join(homeDir(), ".ssh", "known_hosts")
+	options.HostKeyPolicy = StrictHostKeys
+	options.IdentityFiles = make([]string, 0)
+	options.UseAgent = true
+	return options
+}
+
+// defaultIdentityFiles are the keys in ~/.ssh that are tried when no identity files are configured
+var defaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Resolve looks the given node up in the SSH config file, and returns how to log into it
+func (options *SSHOptions) Resolve(alias string) (*SSHEndpoint, error) {
+	options.loadOnce.Do(options.load)
+	if options.loadError != nil {
+		return nil, options.loadError
+	}
+	return options.config.Lookup(alias, options.User, options.Port)
+}
+
+// clientConfig creates the configuration for logging into the endpoint with the options. The identity files set for
+// the endpoint in the config file are tried after the ssh-agent and the configured identity files.
+func (options *SSHOptions) clientConfig(endpoint *SSHEndpoint) (*ssh.ClientConfig, error) {
+	options.loadOnce.Do(options.load)
+	if options.loadError != nil {
+		return nil, options.loadError
+	}
+	methods := make([]ssh.AuthMethod, 0)
+	if options.agentClient != nil {
+		methods = append(methods, ssh.PublicKeysCallback(options.agentClient.Signers))
+	}
+	signers := append([]ssh.Signer(nil), options.signers...)
+	for _, path := range endpoint.IdentityFiles {
+		if signer := options.hostSigner(expandHome(path)); signer != nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no SSH key to log in with: no ssh-agent is running, and none of the identity files " +
+			"could be loaded")
+	}
+	config := new(ssh.ClientConfig)
+	config.User = endpoint.User
+	config.Auth = methods
+	config.HostKeyCallback = options.checkHostKey
+	return config, nil
+}
+
+// hostSigner loads an identity file set for a host in the config file, the first time it is needed. Returns nil if
+// the key cannot be used.
+func (options *SSHOptions) hostSigner(path string) ssh.Signer {
+	options.hostKeysLock.Lock()
+	defer options.hostKeysLock.Unlock()
+	if signer, ok := options.hostSigners[path]; ok {
+		return signer
+	}
+	signer, err := loadIdentityFile(path)
+	if err != nil {
+		fmt.Println("WARNING: Skipping SSH key", path+":", err)
+	}
+	options.hostSigners[path] = signer
+	return signer
+}
+
+// describeAuthentication lists the authentication methods that are tried for the endpoint, for error messages
+func (options *SSHOptions) describeAuthentication(endpoint *SSHEndpoint) string {
+	tried := append([]string(nil), options.tried...)
+	for _, path := range endpoint.IdentityFiles {
+		if options.hostSigner(expandHome(path)) != nil {
+			tried = append(tried, expandHome(path))
+		}
+	}
+	if len(tried) == 0 {
+		return "no keys"
+	}
+	return strings.Join(tried, ", ")
+}
+
+// load reads the SSH config file, connects to the ssh-agent and loads the identity files. Keys that cannot be used are
+// skipped with a warning.
+func (options *SSHOptions) load() {
+	if options.config, options.loadError = ReadSSHConfig(options.ConfigPath); options.loadError != nil {
+		options.loadError = fmt.Errorf("could not read the SSH config file %s: %v", options.ConfigPath,
+			options.loadError)
+		return
+	}
+	options.hostSigners = make(map[string]ssh.Signer)
+	if socket := os.Getenv("SSH_AUTH_SOCK"); options.UseAgent && socket != "" {
+		if connection, err := net.Dial("unix", socket); err != nil {
+			fmt.Println("WARNING: Could not connect to the ssh-agent:", err)
+		} else {
+			options.agentClient = agent.NewClient(connection)
+			options.tried = append(options.tried, "ssh-agent")
+		}
+	}
+	identityFiles := options.IdentityFiles
+	explicit := len(identityFiles) > 0
+	if !explicit {
+		for _, name := range defaultIdentityFiles {
+			identityFiles = append(identityFiles, filepath.Join(homeDir(), ".ssh", name))
+		}
+	}
+	for _, path := range identityFiles {
+		path = expandHome(path)
+		signer, err := loadIdentityFile(path)
+		if os.IsNotExist(err) && !explicit {
+			continue
+		}
+		if err != nil {
+			fmt.Println("WARNING: Skipping SSH key", path+":", err)
+			continue
+		}
+		options.signers = append(options.signers, signer)
+		options.tried = append(options.tried, path)
+	}
+}
+
+// loadIdentityFile loads the private key at the given path. The passphrase of an encrypted key is asked for on the
+// terminal.
+func loadIdentityFile(path string) (ssh.Signer, error) {
+	keyData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseIdentity(path, keyData, readPassphrase)
+}
+
+// parseIdentity parses the private key read from the given path. Both the legacy PEM format and the OpenSSH format
+// written by ssh-keygen are supported. If the key is encrypted, askPassphrase is called to ask for its passphrase, up to
+// maxPassphraseAttempts times.
+func parseIdentity(path string, keyData []byte, askPassphrase func(prompt string) ([]byte, error)) (ssh.Signer,
+	error) {
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if _, encrypted := err.(*ssh.PassphraseMissingError); !encrypted {
+		return signer, err
+	}
+	for attempt := 0; attempt < maxPassphraseAttempts; attempt++ {
+		passphrase, err := askPassphrase("Enter passphrase for SSH key " + path + ": ")
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(keyData, passphrase)
+		if err != x509.IncorrectPasswordError {
+			return signer, err
+		}
+		fmt.Println("Incorrect passphrase")
+	}
+	return nil, errors.New("incorrect passphrase")
+}
+
+// readPassphrase asks for a passphrase on the terminal, without echoing it. Fails if the master is not run from a
+// terminal, in which case encrypted keys must be added to the ssh-agent instead.
+func readPassphrase(prompt string) ([]byte, error) {
+	terminal := int(os.Stdin.Fd())
+	if !term.IsTerminal(terminal) {
+		return nil, errors.New("the key is encrypted, and its passphrase cannot be asked for without a terminal; " +
+			"add it to the ssh-agent with ssh-add")
+	}
+	fmt.Print(prompt)
+	defer fmt.Println()
+	return term.ReadPassword(terminal)
+}
+
+// checkHostKey checks the host key of a node against the known_hosts file. With the accept-new policy, the key of a
+// node that is not in the file yet is added to it. A key that differs from the one in the file is always refused.
+func (options *SSHOptions) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	options.knownHostsLock.Lock()
+	defer options.knownHostsLock.Unlock()
+	path := expandHome(options.KnownHostsPath)
+	if _, err := os.Stat(path); os.IsNotExist(err) && options.HostKeyPolicy == AcceptNewHostKeys {
+		if err = ioutil.WriteFile(path, nil, 0600); err != nil {
+			return err
+		}
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return fmt.Errorf("could not read the known_hosts file: %v", err)
+	}
+	err = callback(hostname, remote, key)
+	keyError, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return err
+	}
+	if len(keyError.Want) > 0 {
+		return fmt.Errorf("the host key of %s does not match the one in %s line %d. Someone could be intercepting "+
+			"the connection, or the node was reinstalled", hostname, keyError.Want[0].Filename, keyError.Want[0].Line)
+	}
+	if options.HostKeyPolicy != AcceptNewHostKeys {
+		return fmt.Errorf("the host key of %s (%s %s) is not in %s. Add it with ssh-keyscan, or set SSHHostKeyPolicy "+
+			"to %s", hostname, key.Type(), ssh.FingerprintSHA256(key), path, AcceptNewHostKeys)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Println("Adding the host key of", hostname, "("+ssh.FingerprintSHA256(key)+") to", path)
+	_, err = file.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	return err
+}
+
+// homeDir returns the home directory of the current user
+func homeDir() string {
+	currentUser, err := user.Current()
+	if err != nil {
+		return os.Getenv("HOME")
+	}
+	return currentUser.HomeDir
+}
+
+// expandHome replaces a leading ~ in the path with the home directory of the current user
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return filepath.Join(homeDir(), path[1:])
+	}
+	return path
+}
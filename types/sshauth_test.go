@@ -0,0 +1,68 @@
+package types
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestParseIdentity checks that encrypted keys in both the OpenSSH and the legacy PEM format are decrypted with the
+// passphrase asked for, and that a wrong passphrase is asked for again
+func TestParseIdentity(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	directory, err := ioutil.TempDir("", "sshauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	tests := []struct {
+		name        string   // The name of the test case
+		keygenArgs  []string // The arguments that select the type and format of the key
+		passphrase  string   // The passphrase the key is encrypted with
+		answers     []string // The passphrases given when asked, in order
+		wantErr     bool     // Whether loading the key should fail
+		wantPrompts int      // The number of times the passphrase should be asked for
+	}{
+		{"unencrypted ed25519", []string{"-t", "ed25519"}, "", nil, false, 0},
+		{"encrypted ed25519", []string{"-t", "ed25519"}, "secret", []string{"secret"}, false, 1},
+		{"encrypted OpenSSH ecdsa", []string{"-t", "ecdsa"}, "secret", []string{"secret"}, false, 1},
+		{"encrypted PEM rsa", []string{"-t", "rsa", "-b", "2048", "-m", "PEM"}, "secret", []string{"secret"}, false,
+			1},
+		{"wrong then right", []string{"-t", "ed25519"}, "secret", []string{"wrong", "secret"}, false, 2},
+		{"always wrong", []string{"-t", "ed25519"}, "secret", []string{"a", "b", "c"}, true, maxPassphraseAttempts},
+	}
+	for index, test := range tests {
+		path := filepath.Join(directory, "key"+string(rune('a'+index)))
+		args := append([]string{"-q", "-f", path, "-N", test.passphrase}, test.keygenArgs...)
+		if output, err := exec.Command("ssh-keygen", args...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: ssh-keygen failed: %v: %s", test.name, err, output)
+		}
+		keyData, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prompts := 0
+		askPassphrase := func(prompt string) ([]byte, error) {
+			if prompts >= len(test.answers) {
+				return nil, errors.New("asked too many times")
+			}
+			prompts++
+			return []byte(test.answers[prompts-1]), nil
+		}
+		signer, err := parseIdentity(path, keyData, askPassphrase)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", test.name, err, test.wantErr)
+		}
+		if err == nil && signer == nil {
+			t.Errorf("%s: got no signer", test.name)
+		}
+		if prompts != test.wantPrompts {
+			t.Errorf("%s: asked for the passphrase %d times, want %d", test.name, prompts, test.wantPrompts)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package types
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SSHConfig holds the host blocks of an OpenSSH client configuration file, such as ~/.ssh/config. Only the options
+// needed for logging into the nodes are used: HostName, User, Port, IdentityFile and ProxyJump. Match blocks and
+// Include directives are ignored.
+type SSHConfig struct {
+	blocks []*sshConfigBlock // The host blocks, in the order they appear in the file
+}
+
+// sshConfigBlock is a Host block of a configuration file
+type sshConfigBlock struct {
+	patterns []string            // The host patterns of the block. A pattern starting with ! excludes the host
+	options  map[string][]string // The values of the options in the block, by lower-case keyword
+}
+
+// SSHEndpoint describes how to log into a single host, after resolving its alias with the configuration file
+type SSHEndpoint struct {
+	Alias         string   // The name the host was looked up by
+	HostName      string   // The real host name or address of the host
+	User          string   // The user to log in as
+	Port          int      // The port of the SSH server
+	IdentityFiles []string // The private keys to log in with, in addition to the ones in the SSHOptions
+	ProxyJump     []string // The jump hosts to go through, in order, each as [user@]host[:port]
+}
+
+// ReadSSHConfig reads the OpenSSH client configuration file at the given path. A missing file is read as an empty
+// configuration.
+func ReadSSHConfig(path string) (*SSHConfig, error) {
+	config := new(SSHConfig)
+	config.blocks = make([]*sshConfigBlock, 0)
+	file, err := os.Open(expandHome(path))
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// Options before the first Host block apply to every host
+	block := &sshConfigBlock{patterns: []string{"*"}, options: make(map[string][]string)}
+	config.blocks = append(config.blocks, block)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		keyword, values := parseSSHConfigLine(scanner.Text())
+		switch keyword {
+		case "":
+			continue
+		case "host":
+			block = &sshConfigBlock{patterns: values, options: make(map[string][]string)}
+			config.blocks = append(config.blocks, block)
+		case "match":
+			// Match blocks are not supported, so their options are read into a block that never matches
+			block = &sshConfigBlock{patterns: []string{}, options: make(map[string][]string)}
+		default:
+			if len(values) == 0 {
+				return nil, fmt.Errorf("%s line %d: %s has no value", path, lineNumber, keyword)
+			}
+			block.options[keyword] = append(block.options[keyword], strings.Join(values, " "))
+		}
+	}
+	return config, scanner.Err()
+}
+
+// parseSSHConfigLine splits a line of a configuration file into its lower-case keyword and its values. Returns an
+// empty keyword for blank lines and comments.
+func parseSSHConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	separator := strings.IndexAny(line, " \t=")
+	if separator < 0 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:separator])
+	rest := strings.TrimLeft(line[separator:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+	values := make([]string, 0)
+	for rest != "" {
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			if end := strings.Index(rest[1:], "\""); end >= 0 {
+				value, rest = rest[1:end+1], rest[end+2:]
+			} else {
+				value, rest = rest[1:], ""
+			}
+		} else if space := strings.IndexAny(rest, " \t"); space >= 0 {
+			value, rest = rest[:space], rest[space:]
+		} else {
+			value, rest = rest, ""
+		}
+		values = append(values, value)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return keyword, values
+}
+
+// matches returns true if the block applies to the given host alias
+func (block *sshConfigBlock) matches(alias string) bool {
+	matched := false
+	for _, pattern := range block.patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if ok, _ := filepath.Match(pattern[1:], alias); ok {
+				return false
+			}
+		} else if ok, _ := filepath.Match(pattern, alias); ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// get returns the first value of the option for the given host alias, as OpenSSH does, or an empty string if no block
+// applying to the host sets the option
+func (config *SSHConfig) get(alias string, keyword string) string {
+	for _, block := range config.blocks {
+		if values := block.options[keyword]; len(values) > 0 && block.matches(alias) {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// getAll returns every distinct value of the option for the given host alias, from every block applying to the host
+func (config *SSHConfig) getAll(alias string, keyword string) []string {
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, block := range config.blocks {
+		if !block.matches(alias) {
+			continue
+		}
+		for _, value := range block.options[keyword] {
+			if !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// Lookup resolves a host alias into the endpoint to log into. defaultUser and defaultPort are used if the
+// configuration file does not set the User or the Port of the host. The %h, %p, %r and %% tokens in identity file
+// paths are expanded.
+func (config *SSHConfig) Lookup(alias string, defaultUser string, defaultPort int) (*SSHEndpoint, error) {
+	endpoint := new(SSHEndpoint)
+	endpoint.Alias = alias
+	endpoint.HostName = alias
+	if hostName := config.get(alias, "hostname"); hostName != "" {
+		endpoint.HostName = strings.Replace(hostName, "%h", alias, -1)
+	}
+	endpoint.User = defaultUser
+	if user := config.get(alias, "user"); user != "" {
+		endpoint.User = user
+	}
+	endpoint.Port = defaultPort
+	if port := config.get(alias, "port"); port != "" {
+		number, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("the SSH config sets an invalid Port for %s: %s", alias, port)
+		}
+		endpoint.Port = number
+	}
+	endpoint.IdentityFiles = make([]string, 0)
+	for _, identityFile := range config.getAll(alias, "identityfile") {
+		identityFile = strings.NewReplacer("%%", "%", "%h", endpoint.HostName, "%p", strconv.Itoa(endpoint.Port),
+			"%r", endpoint.User).Replace(identityFile)
+		endpoint.IdentityFiles = append(endpoint.IdentityFiles, identityFile)
+	}
+	endpoint.ProxyJump = make([]string, 0)
+	if proxyJump := config.get(alias, "proxyjump"); proxyJump != "" && proxyJump != "none" {
+		for _, jump := range strings.Split(proxyJump, ",") {
+			endpoint.ProxyJump = append(endpoint.ProxyJump, strings.TrimSpace(jump))
+		}
+	}
+	return endpoint, nil
+}
+
+// parseJump splits a ProxyJump entry of the form [user@]host[:port] into its parts. Parts that are not given are
+// returned empty, or as 0 for the port.
+func parseJump(jump string) (user string, host string, port int, err error) {
+	if at := strings.LastIndex(jump, "@"); at >= 0 {
+		user, jump = jump[:at], jump[at+1:]
+	}
+	host = jump
+	if strings.HasPrefix(jump, "[") || strings.Count(jump, ":") == 1 {
+		var portString string
+		if host, portString, err = net.SplitHostPort(jump); err != nil {
+			return "", "", 0, fmt.Errorf("invalid jump host %q: %v", jump, err)
+		}
+		if port, err = strconv.Atoi(portString); err != nil {
+			return "", "", 0, fmt.Errorf("invalid port in jump host %q", jump)
+		}
+	}
+	return user, host, port, nil
+}
+
+// Address returns the host name and port of the endpoint, joined for dialing
+func (endpoint *SSHEndpoint) Address() string {
+	return net.JoinHostPort(endpoint.HostName, strconv.Itoa(endpoint.Port))
+}
+
+// String describes the endpoint as user@host:port, along with its alias if it differs from the host name
+func (endpoint *SSHEndpoint) String() string {
+	description := endpoint.User + "@" + endpoint.Address()
+	if endpoint.Alias != endpoint.HostName {
+		description = endpoint.Alias + " (" + description + ")"
+	}
+	return description
+}
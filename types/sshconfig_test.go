@@ -0,0 +1,162 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// sshConfigTestFile is the configuration file the lookups are tested against
+const sshConfigTestFile = `# Nodes of the cluster
+Host node*.cluster !node9.cluster
+    HostName %h.internal.example.com
+    IdentityFile ~/.ssh/%h_%r_%p
+    ProxyJump gateway@bastion.example.com:2222,[fe80::1]:22
+
+Host head
+    HostName 10.0.0.1
+    User admin
+    Port 2200
+    IdentityFile "~/.ssh/head key"
+    ProxyJump none
+
+Host head node*.cluster
+    HostName ignored.example.com
+    Port 2300
+    IdentityFile ~/.ssh/%h_%r_%p
+
+# Defaults for every host
+Host *
+    User = cluster
+
+Match host *
+    HostName matched.example.com
+`
+
+// TestSSHConfigLookup checks that host aliases are resolved the way OpenSSH resolves them: the first value of an
+// option wins, identity files add up, and the %h, %p and %r tokens are expanded
+func TestSSHConfigLookup(t *testing.T) {
+	directory, err := ioutil.TempDir("", "sshconfig")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "config")
+	if err = ioutil.WriteFile(path, []byte(sshConfigTestFile), 0600); err != nil {
+		t.Fatalf("could not write the SSH config: %v", err)
+	}
+	config, err := ReadSSHConfig(path)
+	if err != nil {
+		t.Fatalf("could not read the SSH config: %v", err)
+	}
+	tests := []struct {
+		name  string      // The name of the test case
+		alias string      // The host alias to look up
+		want  SSHEndpoint // The expected endpoint, looked up with user "default" and port 22
+	}{
+		{
+			"explicit host", "head",
+			SSHEndpoint{Alias: "head", HostName: "10.0.0.1", User: "admin", Port: 2200,
+				IdentityFiles: []string{"~/.ssh/head key", "~/.ssh/10.0.0.1_admin_2200"}, ProxyJump: []string{}},
+		},
+		{
+			"pattern with %h", "node1.cluster",
+			SSHEndpoint{Alias: "node1.cluster", HostName: "node1.cluster.internal.example.com", User: "cluster",
+				Port: 2300, IdentityFiles: []string{"~/.ssh/node1.cluster.internal.example.com_cluster_2300"},
+				ProxyJump: []string{"gateway@bastion.example.com:2222", "[fe80::1]:22"}},
+		},
+		{
+			"negated pattern", "node9.cluster",
+			SSHEndpoint{Alias: "node9.cluster", HostName: "ignored.example.com", User: "cluster", Port: 2300,
+				IdentityFiles: []string{"~/.ssh/ignored.example.com_cluster_2300"}, ProxyJump: []string{}},
+		},
+		{
+			"unknown host", "other",
+			SSHEndpoint{Alias: "other", HostName: "other", User: "cluster", Port: 22, IdentityFiles: []string{},
+				ProxyJump: []string{}},
+		},
+	}
+	for _, test := range tests {
+		endpoint, err := config.Lookup(test.alias, "default", 22)
+		if err != nil {
+			t.Errorf("%s: got error %v, want none", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*endpoint, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *endpoint, test.want)
+		}
+	}
+}
+
+// TestSSHConfigMissingFile checks that a missing configuration file is read as an empty configuration
+func TestSSHConfigMissingFile(t *testing.T) {
+	config, err := ReadSSHConfig(filepath.Join(os.TempDir(), "gopipeline-missing-ssh-config"))
+	if err != nil {
+		t.Fatalf("got error %v, want none", err)
+	}
+	endpoint, err := config.Lookup("node1", "user", 22)
+	if err != nil || endpoint.Address() != "node1:22" || endpoint.User != "user" {
+		t.Errorf("got %v with error %v, want user@node1:22", endpoint, err)
+	}
+}
+
+// TestParseSSHConfigLine checks that keywords are lower-cased and values split the way OpenSSH splits them
+func TestParseSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		name        string   // The name of the test case
+		line        string   // The line to parse
+		wantKeyword string   // The expected keyword
+		wantValues  []string // The expected values
+	}{
+		{"blank line", "   ", "", nil},
+		{"comment", "  # Host node1", "", nil},
+		{"space separated", "HostName node1.example.com", "hostname", []string{"node1.example.com"}},
+		{"equals separated", "Port=2222", "port", []string{"2222"}},
+		{"spaced equals", "  User = admin  ", "user", []string{"admin"}},
+		{"several values", "Host\tnode1 node2", "host", []string{"node1", "node2"}},
+		{"quoted value", `IdentityFile "~/my keys/id_rsa"`, "identityfile", []string{"~/my keys/id_rsa"}},
+		{"no value", "Host", "host", nil},
+	}
+	for _, test := range tests {
+		keyword, values := parseSSHConfigLine(test.line)
+		if keyword != test.wantKeyword || len(values) != len(test.wantValues) ||
+			(len(values) > 0 && !reflect.DeepEqual(values, test.wantValues)) {
+			t.Errorf("%s: got %q %q, want %q %q", test.name, keyword, values, test.wantKeyword, test.wantValues)
+		}
+	}
+}
+
+// TestParseJump checks that ProxyJump entries are split into their user, host and port
+func TestParseJump(t *testing.T) {
+	tests := []struct {
+		name      string // The name of the test case
+		jump      string // The ProxyJump entry
+		wantUser  string // The expected user, or empty if none is given
+		wantHost  string // The expected host
+		wantPort  int    // The expected port, or 0 if none is given
+		wantError bool   // True if the entry is invalid
+	}{
+		{"host only", "bastion", "", "bastion", 0, false},
+		{"user and host", "admin@bastion", "admin", "bastion", 0, false},
+		{"host and port", "bastion:2222", "", "bastion", 2222, false},
+		{"user, host and port", "admin@bastion.example.com:2222", "admin", "bastion.example.com", 2222, false},
+		{"IPv6 address", "fe80::1", "", "fe80::1", 0, false},
+		{"bracketed IPv6 and port", "admin@[fe80::1]:22", "admin", "fe80::1", 22, false},
+		{"invalid port", "bastion:ssh", "", "", 0, true},
+	}
+	for _, test := range tests {
+		user, host, port, err := parseJump(test.jump)
+		if test.wantError {
+			if err == nil {
+				t.Errorf("%s: got no error, want one", test.name)
+			}
+			continue
+		}
+		if err != nil || user != test.wantUser || host != test.wantHost || port != test.wantPort {
+			t.Errorf("%s: got %q %q %d with error %v, want %q %q %d", test.name, user, host, port, err,
+				test.wantUser, test.wantHost, test.wantPort)
+		}
+	}
+}
@@ -1,12 +1,11 @@
 package types
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"os/user"
-	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -14,35 +13,54 @@ import (
 // The SSHConnection contains information about an SSH connection, and methods for running commands over the SSH connection
 // @see: https://github.com/jilieryuyi/ssh-simple-client/blob/master/main.go
 type SSHConnection struct {
-	Address        string       // The IP address of the server
-	User           string       // The username on the server
-	PrivateKeyPath string       // Path to private key
-	Port           int          // The port on which to connect to the server
-	session        *ssh.Session // The session for running commands
-	client         *ssh.Client  // The client for creating sessions
+	Address string        // The IP address of the server, or its alias in the SSH config file
+	User    string        // The username on the server
+	Port    int           // The port on which to connect to the server
+	session *ssh.Session  // The session for running commands
+	client  *ssh.Client   // The client for creating sessions
+	jumps   []*ssh.Client // The clients of the jump hosts the connection is tunnelled through, in order
 }
 
-// NewSSHConnection creates a new SSHConnection object
-func NewSSHConnection(address string, remoteUser string, port int) *SSHConnection {
+// NewSSHConnection creates a new SSHConnection object, logged into the given address with the given options. The
+// address is looked up in the SSH config file first, and the connection is tunnelled through the jump hosts set for it
+// with ProxyJump. Returns an error naming the node, or the jump host, if a host key cannot be verified, or if none of
+// the keys could log into it.
+func NewSSHConnection(address string, options *SSHOptions) (*SSHConnection, error) {
+	endpoint, err := options.Resolve(address)
+	if err != nil {
+		return nil, fmt.Errorf("could not log into %s: %v", address, err)
+	}
 	sshConnection := new(SSHConnection)
 	sshConnection.Address = address
-	sshConnection.User = remoteUser
-	usr, err := user.Current()
-	if err != nil {
-		panic(err)
+	sshConnection.User = endpoint.User
+	sshConnection.Port = endpoint.Port
+	if sshConnection.jumps, err = dialJumps(endpoint, options); err != nil {
+		return nil, err
+	}
+	if sshConnection.client, err = createClient(sshConnection.lastJump(), endpoint, options); err != nil {
+		closeClients(sshConnection.jumps)
+		return nil, err
 	}
-	sshConnection.PrivateKeyPath = usr.HomeDir + "/.ssh/id_rsa"
-	sshConnection.Port = port
-	sshConnection.client = createClient(sshConnection.User, sshConnection.Address, sshConnection.Port)
-	return sshConnection
+	return sshConnection, nil
 }
 
 // RunCommand runs a single command through the SSH Connection, does not wait for results
 func (conn *SSHConnection) RunCommand(command string, callback CallbackFunc, args ...interface{}) {
+	conn.RunCommandWithInput(command, nil, callback, args...)
+}
+
+// RunCommandWithInput runs a single command through the SSH Connection like RunCommand, and writes the given input to
+// the command's standard input. Since the input travels through the encrypted SSH session, and not on the command line,
+// it is not visible to other users of the remote machine.
+func (conn *SSHConnection) RunCommandWithInput(command string, input []byte, callback CallbackFunc,
+	args ...interface{}) {
 	session, err := conn.client.NewSession()
 	if err != nil {
 		panic(err)
 	}
+	if input != nil {
+		session.Stdin = bytes.NewReader(input)
+	}
 	output, err := session.CombinedOutput(command)
 	fmt.Println(string(output))
 	if err != nil {
@@ -56,62 +74,150 @@ func (conn *SSHConnection) RunCommand(command string, callback CallbackFunc, arg
 	}
 }
 
-// Close closes connection
+// Output runs a single command through the SSH Connection, waits for it to finish, and returns its standard output.
+// The connection is closed afterwards.
+func (conn *SSHConnection) Output(command string) ([]byte, error) {
+	defer conn.Close()
+	session, err := conn.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return session.Output(command)
+}
+
+// Close closes connection, then the connections to the jump hosts it was tunnelled through
 func (conn *SSHConnection) Close() error {
 	err := conn.client.Close()
+	closeClients(conn.jumps)
 	return err
 }
 
-// Creates a client connection to the given address with the given user
-func createClient(remoteUser string, address string, port int) *ssh.Client {
-	publicKeyConfig := getPublicKeyConfig(remoteUser)
-	connectionType := "tcp"
-	addressAndPort := address + ":" + strconv.Itoa(port)
-	if strings.Count(address, ":") > 0 {
-		connectionType = "tcp6"
-		addressAndPort = "[" + address + "]:" + strconv.Itoa(port)
-	}
-	sshClient, err := ssh.Dial(connectionType, addressAndPort, publicKeyConfig)
+// lastJump returns the client of the last jump host the connection goes through, or nil if it goes directly
+func (conn *SSHConnection) lastJump() *ssh.Client {
+	if len(conn.jumps) == 0 {
+		return nil
+	}
+	return conn.jumps[len(conn.jumps)-1]
+}
+
+// IsHostReachable returns true if the SSH server of the given host accepts connections within the timeout. A host
+// behind jump hosts is reached by logging into the jump hosts.
+func IsHostReachable(host string, options *SSHOptions, timeout time.Duration) bool {
+	endpoint, err := options.Resolve(host)
 	if err != nil {
-		panic(err)
+		return false
+	}
+	if len(endpoint.ProxyJump) == 0 {
+		connection, err := net.DialTimeout("tcp", endpoint.Address(), timeout)
+		if err != nil {
+			return false
+		}
+		connection.Close()
+		return true
+	}
+	reachable := make(chan bool, 1)
+	go func() {
+		jumps, err := dialJumps(endpoint, options)
+		if err != nil {
+			reachable <- false
+			return
+		}
+		defer closeClients(jumps)
+		connection, err := jumps[len(jumps)-1].Dial("tcp", endpoint.Address())
+		if err == nil {
+			connection.Close()
+		}
+		reachable <- err == nil
+	}()
+	select {
+	case result := <-reachable:
+		return result
+	case <-time.After(timeout):
+		return false
 	}
-	return sshClient
 }
 
-// Creates an ssh config based on the private key of the current user
-// @see: https://golang-basic.blogspot.com/2014/06/step-by-step-guide-to-ssh-using-go.html
-// Big Question: Why is it using the private key???? I thought it needed the public key??
-func getPublicKeyConfig(remoteUser string) (publicKeyConfig *ssh.ClientConfig) {
-	// Get private key signer
-	privateKeySigner, err := getPrivateKeySigner()
+// dialJumps logs into the jump hosts of the endpoint, in order, each through the one before it. The jump hosts are
+// looked up in the SSH config file, but the ProxyJump set for a jump host itself is not followed.
+func dialJumps(endpoint *SSHEndpoint, options *SSHOptions) ([]*ssh.Client, error) {
+	jumps := make([]*ssh.Client, 0)
+	var via *ssh.Client
+	for _, jump := range endpoint.ProxyJump {
+		jumpEndpoint, err := resolveJump(jump, options)
+		if err == nil {
+			via, err = createClient(via, jumpEndpoint, options)
+		}
+		if err != nil {
+			closeClients(jumps)
+			return nil, fmt.Errorf("could not reach %s through jump host %s: %v", endpoint.Alias, jump, err)
+		}
+		jumps = append(jumps, via)
+	}
+	return jumps, nil
+}
+
+// resolveJump looks a ProxyJump entry of the form [user@]host[:port] up in the SSH config file. The user and port
+// given in the entry take precedence over the ones in the file.
+func resolveJump(jump string, options *SSHOptions) (*SSHEndpoint, error) {
+	jumpUser, host, port, err := parseJump(jump)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	endpoint, err := options.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	if jumpUser != "" {
+		endpoint.User = jumpUser
+	}
+	if port != 0 {
+		endpoint.Port = port
+	}
+	return endpoint, nil
+}
+
+// closeClients closes the given clients in reverse order, so that every tunnel is closed before the client it goes
+// through
+func closeClients(clients []*ssh.Client) {
+	for index := len(clients) - 1; index >= 0; index-- {
+		clients[index].Close()
+	}
+}
+
+// Creates a client connection to the given endpoint with the given options. The connection is tunnelled through the
+// via client if it is not nil.
+func createClient(via *ssh.Client, endpoint *SSHEndpoint, options *SSHOptions) (*ssh.Client, error) {
+	config, err := options.clientConfig(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not log into %s: %v", endpoint, err)
+	}
+	var sshClient *ssh.Client
+	if via == nil {
+		sshClient, err = ssh.Dial("tcp", endpoint.Address(), config)
+	} else {
+		sshClient, err = tunnelClient(via, endpoint.Address(), config)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, fmt.Errorf("could not log into %s: none of the keys were accepted (tried %s)", endpoint,
+				options.describeAuthentication(endpoint))
+		}
+		return nil, fmt.Errorf("could not log into %s: %v", endpoint, err)
 	}
-	// Create the ssh config
-	publicKeyConfig = &ssh.ClientConfig{
-		User: remoteUser,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(privateKeySigner),
-		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
-	}
-	return
+	return sshClient, nil
 }
 
-// Retrieves the public key signer from the current user's home directory
-// @see: https://golang-basic.blogspot.com/2014/06/step-by-step-guide-to-ssh-using-go.html
-func getPrivateKeySigner() (privateKeySigner ssh.Signer, err error) {
-	usr, _ := user.Current()
-	privateKeyFile := usr.HomeDir + "/.ssh/id_rsa"
-	privateKeyBuffer, err := ioutil.ReadFile(privateKeyFile)
+// tunnelClient opens a connection to the given address through the via client, and logs into it over the tunnel
+func tunnelClient(via *ssh.Client, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	connection, err := via.Dial("tcp", address)
 	if err != nil {
-		return
+		return nil, err
 	}
-	privateKeySigner, err = ssh.ParsePrivateKey(privateKeyBuffer)
+	clientConnection, channels, requests, err := ssh.NewClientConn(connection, address, config)
 	if err != nil {
-		return
+		connection.Close()
+		return nil, err
 	}
-	return
+	return ssh.NewClient(clientConnection, channels, requests), nil
 }
@@ -7,9 +7,13 @@ import (
 
 // PipelineStage struct refers to a stage in the pipeline
 type PipelineStage struct {
-	Position int       // The Stage's position in the pipeline
-	Workers  []*Worker // The list of workers executing this stage
-	Scaled   bool      // Marks whether or not this stage has been scaled up or not
+	Position   int       // The Stage's position in the pipeline
+	Workers    []*Worker // The list of workers executing this stage
+	Scaled     bool      // Marks whether or not this stage has been scaled up or not
+	Finished   []string  // The IDs of the workers that have processed the end of the stream and exited
+	Upstream   []int     // The positions of the stages that send their outputs to this stage
+	Downstream []int     // The positions of the stages that this stage sends its outputs to
+	Stateful   bool      // Whether the workers of this stage keep state that must be handed over when they are moved
 }
 
 // NewPipelineStage creates a new PipelineStage object. On creation, we don't know the stage's NetAddress or Port, so
@@ -19,6 +23,9 @@ func newPipelineStage(position int) *PipelineStage {
 	pipelineStage.Position = position
 	pipelineStage.Workers = make([]*Worker, 0)
 	pipelineStage.Scaled = false
+	pipelineStage.Finished = make([]string, 0)
+	pipelineStage.Upstream = make([]int, 0)
+	pipelineStage.Downstream = make([]int, 0)
 	return pipelineStage
 }
 
@@ -54,26 +61,73 @@ func (stage *PipelineStage) MemoryRequirement() uint64 {
 	return maxMemoryUsed
 }
 
-// RemoveWorker removes the worker from the Workers list
+// RemoveWorker removes the worker from the Workers list. Does nothing if the worker is not in the list.
 func (stage *PipelineStage) RemoveWorker(workerID string) {
-	var indexToRemove int
+	indexToRemove, found := 0, false
 	for index, worker := range stage.Workers {
 		if worker.ID == workerID {
-			indexToRemove = index
+			indexToRemove, found = index, true
+			break
 		}
 	}
-	if indexToRemove == len(stage.Workers) {
-		stage.Workers = stage.Workers[:indexToRemove]
-	} else {
+	if found {
 		stage.Workers = append(stage.Workers[:indexToRemove], stage.Workers[indexToRemove+1:]...)
 	}
 }
 
+// IsSource returns true if this stage has no upstream stages
+func (stage *PipelineStage) IsSource() bool {
+	return len(stage.Upstream) == 0
+}
+
+// IsSink returns true if this stage has no downstream stages
+func (stage *PipelineStage) IsSink() bool {
+	return len(stage.Downstream) == 0
+}
+
+// Neighbors returns the positions of the stages this stage receives inputs from or sends outputs to
+func (stage *PipelineStage) Neighbors() []int {
+	neighbors := make([]int, 0, len(stage.Upstream)+len(stage.Downstream))
+	neighbors = append(neighbors, stage.Upstream...)
+	neighbors = append(neighbors, stage.Downstream...)
+	return neighbors
+}
+
+// DroppedItems returns the number of inputs dropped by the workers of this stage, as of their last statistics report
+func (stage *PipelineStage) DroppedItems() int {
+	dropped := 0
+	for _, worker := range stage.Workers {
+		dropped += worker.Stats.Dropped
+	}
+	return dropped
+}
+
+// FinishWorker removes the worker from the Workers list, and records it as having processed the end of the stream
+func (stage *PipelineStage) FinishWorker(workerID string) {
+	stage.RemoveWorker(workerID)
+	stage.Finished = append(stage.Finished, workerID)
+}
+
+// IsFinished returns true if at least one worker of this stage has processed the end of the stream, and every other
+// worker has either done the same or failed to start
+func (stage *PipelineStage) IsFinished() bool {
+	if len(stage.Finished) == 0 {
+		return false
+	}
+	for _, worker := range stage.Workers {
+		if worker.PID != -2 {
+			return false
+		}
+	}
+	return true
+}
+
 // String converts the PipelineStage struct into a String
 func (stage *PipelineStage) String() string {
 	pipelineStageString := "PipelineStage {\n"
 	pipelineStageString += "\tPosition: " + strconv.Itoa(stage.Position) + "\n}"
 	pipelineStageString += "\tNumber of workers running: " + strconv.Itoa(len(stage.Workers)) + "\n"
-	pipelineStageString += "\tStage has been scaled: " + strconv.FormatBool(stage.Scaled) + "\n}"
+	pipelineStageString += "\tStage has been scaled: " + strconv.FormatBool(stage.Scaled) + "\n"
+	pipelineStageString += "\tNumber of dropped inputs: " + strconv.Itoa(stage.DroppedItems()) + "\n}"
 	return pipelineStageString
 }
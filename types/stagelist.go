@@ -10,18 +10,20 @@ type PipelineStageList struct {
 	List         []*PipelineStage // The list of pipeline stages
 	counter      int              // Used to set a counter-type ID to new stages
 	counterMutex sync.Mutex       // Ensures that each stage's ID is unique
-	MaxPosition  int              // The maximum position of the given stages
 }
 
-// NewPipelineStageList creates a new pipeline stage list with an empty list of stages and a nextID of 0
-func NewPipelineStageList(numStages int) *PipelineStageList {
+// NewPipelineStageList creates a new pipeline stage list with one stage for every stage of the given pipeline, and a
+// nextID of 0
+func NewPipelineStageList(pipeline *Pipeline) *PipelineStageList {
 	pipelineStageList := new(PipelineStageList)
 	pipelineStageList.counter = 0
-	for position := 0; position < numStages; position++ {
+	for position := range pipeline.Stages {
 		stage := newPipelineStage(position)
+		stage.Upstream = pipeline.Upstream(position)
+		stage.Downstream = pipeline.Downstream(position)
+		stage.Stateful = pipeline.Stages[position].StatefulFunc != nil
 		pipelineStageList.List = append(pipelineStageList.List, stage)
 	}
-	pipelineStageList.MaxPosition = numStages - 1
 	return pipelineStageList
 }
 
@@ -39,12 +41,27 @@ func (stageList *PipelineStageList) Length() int {
 	return len(stageList.List)
 }
 
-// RemoveWorker removes the worker from the correct stage
+// RemoveWorker removes the worker from the correct stage. Does nothing if no stage has a worker with the given ID,
+// for instance because the worker was already replaced or finished.
 func (stageList *PipelineStageList) RemoveWorker(workerID string) {
 	stage := stageList.FindStageWithWorker(workerID)
+	if stage == nil {
+		return
+	}
 	stage.RemoveWorker(workerID)
 }
 
+// Sinks returns the stages that have no downstream stages
+func (stageList *PipelineStageList) Sinks() []*PipelineStage {
+	sinks := make([]*PipelineStage, 0)
+	for _, stage := range stageList.List {
+		if stage.IsSink() {
+			sinks = append(sinks, stage)
+		}
+	}
+	return sinks
+}
+
 // FindStageWithWorker finds the stage that has a worker with the given ID
 func (stageList *PipelineStageList) FindStageWithWorker(id string) *PipelineStage {
 	for _, stage := range stageList.List {
@@ -95,38 +112,25 @@ func (stageList *PipelineStageList) WaitUntilAllListenerPortsUpdated() {
 	}
 }
 
-// FindBottleneck attempts to find the stage position that executes much slower than its neighbors
+// FindBottleneck attempts to find the stage position that executes much slower than its neighbors, i.e. the stages
+// it receives inputs from and the stages it sends outputs to. Source stages are never returned, since every source
+// stage worker produces the whole stream, so a second worker would produce every item again.
 func (stageList *PipelineStageList) FindBottleneck() (bottleneckPosition int, scaleNumber int) {
 	bottleneckPosition = -1
 	bottleneckValue := -1.0
-	for position := 0; position <= stageList.MaxPosition; position++ {
-		if stageList.FindByPosition(position).Scaled == true {
+	for _, stage := range stageList.List {
+		if stage.Scaled == true || stage.IsSource() {
 			continue
 		}
-		currentPositionExecutionTime := stageList.AverageExecutionTime(position)
-		nextPositionExecutionTime := float64(0.0)
-		previousPositionExecutionTime := float64(0.0)
-		if position != stageList.MaxPosition { // Check if slower than next
-			nextPositionExecutionTime = stageList.AverageExecutionTime(position + 1)
-			if nextPositionExecutionTime > 0.0 && currentPositionExecutionTime > 1.5*nextPositionExecutionTime {
-				difference := currentPositionExecutionTime - nextPositionExecutionTime
-				if bottleneckValue < difference {
-					bottleneckValue = difference
-					bottleneckPosition = position
-					scaleNumber = int(currentPositionExecutionTime / nextPositionExecutionTime)
-					continue
-				}
-			}
-		}
-		if position != 0 { // Check if slower than previous
-			previousPositionExecutionTime = stageList.AverageExecutionTime(position - 1)
-			if previousPositionExecutionTime > 0.0 && currentPositionExecutionTime > 1.5*previousPositionExecutionTime {
-				difference := currentPositionExecutionTime - previousPositionExecutionTime
+		currentPositionExecutionTime := stage.AverageExecutionTime()
+		for _, neighbor := range stage.Neighbors() {
+			neighborExecutionTime := stageList.AverageExecutionTime(neighbor)
+			if neighborExecutionTime > 0.0 && currentPositionExecutionTime > 1.5*neighborExecutionTime {
+				difference := currentPositionExecutionTime - neighborExecutionTime
 				if bottleneckValue < difference {
 					bottleneckValue = difference
-					bottleneckPosition = position
-					scaleNumber = int(currentPositionExecutionTime / previousPositionExecutionTime)
-					continue
+					bottleneckPosition = stage.Position
+					scaleNumber = int(currentPositionExecutionTime / neighborExecutionTime)
 				}
 			}
 		}
@@ -0,0 +1,62 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func bottleneckTestStage(arg interface{}) interface{} {
+	return arg
+}
+
+// TestFindBottleneck checks that the stage much slower than its neighbors is found, unless it is a source stage
+func TestFindBottleneck(t *testing.T) {
+	tests := []struct {
+		name           string          // The name of the test case
+		executionTimes []time.Duration // The execution time of the worker of each stage of a linear pipeline
+		want           int             // The position of the expected bottleneck. -1 if there should be none
+	}{
+		{"balanced", []time.Duration{10, 10, 10}, -1},
+		{"slow middle stage", []time.Duration{10, 100, 10}, 1},
+		{"slow sink", []time.Duration{10, 10, 100}, 2},
+		{"slow source", []time.Duration{100, 10, 10}, -1},
+	}
+	for _, test := range tests {
+		functions := make([]AnyFunc, len(test.executionTimes))
+		for index := range functions {
+			functions[index] = bottleneckTestStage
+		}
+		stageList := NewPipelineStageList(NewPipeline(functions))
+		for position, executionTime := range test.executionTimes {
+			stageList.AddWorker("node", position).Stats.ExecutionTime = executionTime * time.Millisecond
+		}
+		if got, _ := stageList.FindBottleneck(); got != test.want {
+			t.Errorf("%s: got bottleneck %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// TestRemoveWorker checks that removing a worker leaves the other workers of its stage alone, and that removing a
+// worker that was already removed, or that never existed, changes nothing
+func TestRemoveWorker(t *testing.T) {
+	stageList := NewPipelineStageList(NewPipeline([]AnyFunc{bottleneckTestStage, bottleneckTestStage}))
+	first := stageList.AddWorker("node", 1)
+	second := stageList.AddWorker("node", 1)
+	third := stageList.AddWorker("node", 1)
+	stage := stageList.FindByPosition(1)
+	stageList.RemoveWorker(second.ID)
+	if len(stage.Workers) != 2 || stage.Workers[0] != first || stage.Workers[1] != third {
+		t.Fatalf("got workers %v after removing worker %s, want [%v %v]", stage.Workers, second.ID, first, third)
+	}
+	for _, workerID := range []string{second.ID, "unknown"} {
+		stageList.RemoveWorker(workerID)
+		if len(stage.Workers) != 2 {
+			t.Errorf("removing worker %s left %d workers, want 2", workerID, len(stage.Workers))
+		}
+	}
+	emptyStage := stageList.FindByPosition(0)
+	emptyStage.RemoveWorker(first.ID)
+	if len(emptyStage.Workers) != 0 {
+		t.Errorf("removing a worker from an empty stage left %d workers", len(emptyStage.Workers))
+	}
+}
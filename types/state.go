@@ -0,0 +1,116 @@
+package types
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// StatefulFunc is a stage function that can read and update the keyed state of the worker running it. The state is
+// checkpointed to disk, and handed over to the replacement worker when the scheduler moves the worker to another node.
+type StatefulFunc func(arg interface{}, state *StateStore) interface{}
+
+// StateStore is a keyed store of values that is managed by the worker running a stateful stage. Every value stored in
+// it must be of a type registered with the pipeline, so that it can be checkpointed.
+type StateStore struct {
+	values map[string]interface{} // The stored values, by key
+	mutex  *sync.Mutex            // For concurrency stuff
+}
+
+// NewStateStore creates a new empty state store
+func NewStateStore() *StateStore {
+	stateStore := new(StateStore)
+	stateStore.values = make(map[string]interface{})
+	stateStore.mutex = &sync.Mutex{}
+	return stateStore
+}
+
+// Get returns the value stored under the given key. ok is false if there is no such value.
+func (stateStore *StateStore) Get(key string) (value interface{}, ok bool) {
+	stateStore.mutex.Lock()
+	defer stateStore.mutex.Unlock()
+	value, ok = stateStore.values[key]
+	return
+}
+
+// Set stores the value under the given key, replacing any previous value
+func (stateStore *StateStore) Set(key string, value interface{}) {
+	stateStore.mutex.Lock()
+	defer stateStore.mutex.Unlock()
+	stateStore.values[key] = value
+}
+
+// Delete removes the value stored under the given key
+func (stateStore *StateStore) Delete(key string) {
+	stateStore.mutex.Lock()
+	defer stateStore.mutex.Unlock()
+	delete(stateStore.values, key)
+}
+
+// Keys returns the keys of every stored value, in sorted order
+func (stateStore *StateStore) Keys() []string {
+	stateStore.mutex.Lock()
+	defer stateStore.mutex.Unlock()
+	keys := make([]string, 0, len(stateStore.values))
+	for key := range stateStore.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Snapshot encodes every stored value with gob
+func (stateStore *StateStore) Snapshot() ([]byte, error) {
+	stateStore.mutex.Lock()
+	defer stateStore.mutex.Unlock()
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(stateStore.values); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Restore replaces the stored values with those of the given snapshot
+func (stateStore *StateStore) Restore(snapshot []byte) error {
+	values := make(map[string]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&values); err != nil {
+		return err
+	}
+	stateStore.mutex.Lock()
+	defer stateStore.mutex.Unlock()
+	stateStore.values = values
+	return nil
+}
+
+// Merge adds the values of the given snapshot to the stored values, replacing the values stored under the same keys
+func (stateStore *StateStore) Merge(snapshot []byte) error {
+	values := make(map[string]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&values); err != nil {
+		return err
+	}
+	stateStore.mutex.Lock()
+	defer stateStore.mutex.Unlock()
+	for key, value := range values {
+		stateStore.values[key] = value
+	}
+	return nil
+}
+
+// Checkpoint writes a snapshot of the stored values to the file at the given path. The snapshot is written to a
+// temporary file first, so that a crash during the checkpoint never leaves a partial checkpoint behind.
+func (stateStore *StateStore) Checkpoint(path string) ([]byte, error) {
+	snapshot, err := stateStore.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(path+".tmp", snapshot, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
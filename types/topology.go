@@ -0,0 +1,157 @@
+package types
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Edge connects the outputs of one stage to the inputs of another. Every output of the From stage is sent to every
+// stage it has an edge to.
+type Edge struct {
+	From        int         // The position of the stage whose outputs are sent along the edge
+	To          int         // The position of the stage that receives them
+	Codec       string      // The name of the codec the outputs are encoded with. If empty, the pipeline's is used
+	Compression Compression // How the outputs are compressed. If empty, the pipeline's compression is used
+}
+
+// Connect adds an edge from the stage at position from to the stage at position to. Once a pipeline has at least one
+// edge, stages are no longer implicitly connected to the next stage in the list, so every edge must be added.
+func (pipeline *Pipeline) Connect(from int, to int) {
+	pipeline.Edges = append(pipeline.Edges, Edge{From: from, To: to})
+}
+
+// ConnectWithCodec adds an edge like Connect, along which the outputs are encoded with the codec registered under the
+// given name instead of the pipeline's codec
+func (pipeline *Pipeline) ConnectWithCodec(from int, to int, codec string) {
+	pipeline.Edges = append(pipeline.Edges, Edge{From: from, To: to, Codec: codec})
+}
+
+// EdgeCodec returns the name of the codec with which the outputs of the stage at position from are sent to the stage
+// at position to
+func (pipeline *Pipeline) EdgeCodec(from int, to int) string {
+	for _, edge := range pipeline.GetEdges() {
+		if edge.From == from && edge.To == to && edge.Codec != "" {
+			return edge.Codec
+		}
+	}
+	return pipeline.GetCodec()
+}
+
+// GetEdges returns the edges of the pipeline. If no edges were added, the stages form a chain in list order.
+func (pipeline *Pipeline) GetEdges() []Edge {
+	if len(pipeline.Edges) > 0 {
+		return pipeline.Edges
+	}
+	edges := make([]Edge, 0)
+	for position := 1; position < len(pipeline.Stages); position++ {
+		edges = append(edges, Edge{From: position - 1, To: position})
+	}
+	return edges
+}
+
+// Downstream returns the positions of the stages that receive the outputs of the stage at the given position
+func (pipeline *Pipeline) Downstream(position int) []int {
+	downstream := make([]int, 0)
+	for _, edge := range pipeline.GetEdges() {
+		if edge.From == position {
+			downstream = append(downstream, edge.To)
+		}
+	}
+	return downstream
+}
+
+// Upstream returns the positions of the stages whose outputs are sent to the stage at the given position
+func (pipeline *Pipeline) Upstream(position int) []int {
+	upstream := make([]int, 0)
+	for _, edge := range pipeline.GetEdges() {
+		if edge.To == position {
+			upstream = append(upstream, edge.From)
+		}
+	}
+	return upstream
+}
+
+// IsSource returns true if the stage at the given position has no upstream stages, and therefore produces items
+// instead of processing them
+func (pipeline *Pipeline) IsSource(position int) bool {
+	return len(pipeline.Upstream(position)) == 0
+}
+
+// IsSink returns true if the stage at the given position has no downstream stages, and therefore its results are the
+// results of the pipeline
+func (pipeline *Pipeline) IsSink(position int) bool {
+	return len(pipeline.Downstream(position)) == 0
+}
+
+// OrderedDownstream returns true if a stage that processes its inputs in order is downstream of the stage at the given
+// position, whether directly or through other stages
+func (pipeline *Pipeline) OrderedDownstream(position int) bool {
+	for _, nextPosition := range pipeline.Downstream(position) {
+		if pipeline.Stages[nextPosition].Ordered || pipeline.OrderedDownstream(nextPosition) {
+			return true
+		}
+	}
+	return false
+}
+
+// TopologicalOrder returns the positions of the stages ordered so that every stage comes after all of its upstream
+// stages. Returns an error if the stages contain a cycle.
+func (pipeline *Pipeline) TopologicalOrder() ([]int, error) {
+	numUpstream := make([]int, len(pipeline.Stages))
+	for _, edge := range pipeline.GetEdges() {
+		numUpstream[edge.To]++
+	}
+	ready := make([]int, 0)
+	for position := range pipeline.Stages {
+		if numUpstream[position] == 0 {
+			ready = append(ready, position)
+		}
+	}
+	order := make([]int, 0, len(pipeline.Stages))
+	for len(ready) > 0 {
+		position := ready[0]
+		ready = ready[1:]
+		order = append(order, position)
+		for _, downstream := range pipeline.Downstream(position) {
+			numUpstream[downstream]--
+			if numUpstream[downstream] == 0 {
+				ready = append(ready, downstream)
+			}
+		}
+	}
+	if len(order) != len(pipeline.Stages) {
+		return nil, errors.New("The pipeline's stages contain a cycle")
+	}
+	return order, nil
+}
+
+// Validate checks that the pipeline has at least one stage, that every edge connects two existing stages, and that the
+// stages form a directed acyclic graph
+func (pipeline *Pipeline) Validate() error {
+	if len(pipeline.Stages) == 0 {
+		return errors.New("The pipeline has no stages")
+	}
+	for _, edge := range pipeline.GetEdges() {
+		if edge.From < 0 || edge.From >= len(pipeline.Stages) || edge.To < 0 || edge.To >= len(pipeline.Stages) {
+			return errors.New("The pipeline has an edge to a stage that does not exist: " +
+				strconv.Itoa(edge.From) + " -> " + strconv.Itoa(edge.To))
+		}
+		if edge.From == edge.To {
+			return errors.New("The pipeline has an edge from a stage to itself: " + strconv.Itoa(edge.From))
+		}
+		if edge.Codec != "" && LookupCodec(edge.Codec) == nil {
+			return errors.New("The pipeline has an edge with a codec that is not registered: " + edge.Codec)
+		}
+		if !isSupportedCompression(edge.Compression.Algorithm) {
+			return errors.New("The pipeline has an edge with an unknown compression: " + edge.Compression.Algorithm)
+		}
+	}
+	if LookupCodec(pipeline.GetCodec()) == nil {
+		return errors.New("The pipeline uses a codec that is not registered: " + pipeline.GetCodec())
+	}
+	if !isSupportedCompression(pipeline.Compression.Algorithm) {
+		return errors.New("The pipeline uses an unknown compression: " + pipeline.Compression.Algorithm)
+	}
+	_, err := pipeline.TopologicalOrder()
+	return err
+}
@@ -4,18 +4,67 @@ package types
 // AnyFunc is any function with any number of input parameters and a single return value
 type AnyFunc func(arg interface{}) interface{}
 
+// BatchFunc is a stage function that processes a batch of inputs at once, and returns zero or more outputs for the
+// whole batch
+type BatchFunc func(args []interface{}) []interface{}
+
+// FilterFunc is a stage function that decides whether an input is forwarded to the next stage unchanged (true) or
+// dropped (false)
+type FilterFunc func(arg interface{}) bool
+
+// DropMarker is the type of the Drop value
+type DropMarker struct{}
+
+// Drop can be returned by a stage function instead of a result, to drop the input. Dropped inputs are never sent to
+// the next stage.
+var Drop = DropMarker{}
+
+// Emitter is passed to a FlatMapFunc, which calls it once for every output it produces
+type Emitter func(output interface{})
+
+// FlatMapFunc is a stage function that can produce zero or more outputs for a single input, by passing each of them
+// to emit
+type FlatMapFunc func(arg interface{}, emit Emitter)
+
+// KeyFunc extracts the partitioning key of an item. Items with the same key are always sent to the same worker of a
+// partitioned stage.
+type KeyFunc func(item interface{}) string
+
 // CallbackFunc is a callback function
 type CallbackFunc func(args ...interface{})
 
+// ResultSink is called by the master process with every result produced by the last stage of the pipeline. The master
+// receives the results of every worker running the last stage along a separate connection, but calls the sink with
+// one result at a time, so the sink does not need to be safe for concurrent use.
+type ResultSink func(result interface{})
+
+// NewChannelSink creates a ResultSink that writes every result it receives to the given channel
+func NewChannelSink(results chan<- interface{}) ResultSink {
+	return func(result interface{}) {
+		results <- result
+	}
+}
+
 // Message is a generic form of the messages passed between GoPipeline nodes
 type Message struct {
 	Sender      string      // The ID Of the sender
 	Description int         // The message description
 	Contents    interface{} // The contents of the message, can be of any type
+	Origin      string      // The ID of the source stage worker that produced the item this result derives from
+	Sequence    uint64      // The position of that item in the stream of items produced by the source stage worker
+	Parts       []Part      // Where this result is among the results derived from that item. Empty if it is the only one
+	ID          uint64      // Identifies a result by the items it derives from, for acknowledgements and deduplication
+}
+
+// NextStageAddress is the message content that tells a worker where to send the results for a downstream stage
+type NextStageAddress struct {
+	Position int    // The position of the downstream stage
+	Address  string // The address of the listener of a worker running the downstream stage
 }
 
 // MessageStageInfo is the message struct for sending a stage's information to master
 type MessageStageInfo struct {
-	Address string // The address of the stage
-	PID     int    // The id of the worker process running the stage
+	Address     string       // The address of the stage
+	PID         int          // The id of the worker process running the stage
+	Fingerprint *Fingerprint // The fingerprint of the worker's executable and pipeline
 }
@@ -1,14 +1,22 @@
 package types
 
+import "time"
+
 // Worker represents a worker process running a particular stage on a particular node
 type Worker struct {
-	ID      string       // The ID of the worker
-	Host    string       // The node on which the worker is running
-	Stage   int          // The position of the stage it is running
-	Address string       // The address of the listener on this Worker
-	PID     int          // The PID of the worker
-	Stats   *WorkerStats // The performance statistics for this worker
-	Exiting bool         // Marks the worker as exiting, so it's not considered for communication
+	ID            string       // The ID of the worker
+	Host          string       // The node on which the worker is running
+	Stage         int          // The position of the stage it is running
+	Address       string       // The address of the listener on this Worker
+	PID           int          // The PID of the worker
+	Stats         *WorkerStats // The performance statistics for this worker
+	Exiting       bool         // Marks the worker as exiting, so it's not considered for communication
+	Upstream      []string     // The IDs of the workers that have been told to send their results to this worker
+	AwaitState    bool         // Whether the worker waits for the state of the worker it replaces before starting
+	Replacement   string       // The ID of the worker replacing this one, if it is being moved
+	Origin        string       // For source stage workers, the ID of the failed worker whose stream it carries on
+	Resume        uint64       // For source stage workers, the number of items of that stream it does not send again
+	LastHeartbeat time.Time    // The time at which the worker last sent its statistics to the master
 }
 
 // NewWorker creates a new worker
@@ -21,5 +29,19 @@ func NewWorker(id string, host string, stage int) *Worker {
 	worker.PID = -1
 	worker.Stats = new(WorkerStats)
 	worker.Exiting = false
+	worker.Upstream = make([]string, 0)
+	worker.AwaitState = false
+	worker.Replacement = ""
+	worker.Origin = ""
+	worker.Resume = 0
 	return worker
 }
+
+// SourceOrigin returns the ID under which a source stage worker numbers its items: the ID of the failed worker whose
+// stream it carries on, or its own ID
+func (worker *Worker) SourceOrigin() string {
+	if worker.Origin != "" {
+		return worker.Origin
+	}
+	return worker.ID
+}
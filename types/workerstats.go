@@ -13,6 +13,24 @@ type WorkerStats struct {
 	MaxWorkerMemoryUsage uint64        // The maximum amount of memory used by the worker process
 	ExecutionTime        time.Duration // The amount of time to process the worker's stage
 	Backlog              int           // The number of unprocessed items in the input queue
+	Inputs               int           // The number of inputs processed by the stage
+	Outputs              int           // The number of outputs produced by the stage
+	Dropped              int           // The number of inputs dropped by the stage instead of being forwarded
+	Retries              int           // The number of times a failed input has been retried
+	Failures             int           // The number of inputs that could not be processed, even after retrying
+	Panics               int           // The number of times the stage's function panicked
+	ReorderDepth         int           // The number of inputs currently held back by the reorder buffer
+	MaxReorderDepth      int           // The maximum number of inputs held back by the reorder buffer at once
+	ReorderWaitTime      time.Duration // The average time inputs are held back by the reorder buffer
+	ReorderSkipped       int           // The number of missing inputs the reorder buffer gave up waiting for
+	Retransmits          int           // The number of unacknowledged results sent again after a connection was lost
+	Duplicates           int           // The number of inputs received more than once, and therefore ignored
+	Delivered            uint64        // For source stage workers, the number of leading items acknowledged downstream
+	InputBlockedTime     time.Duration // The total time received inputs waited for room in the full input queue
+	OutputBlockedTime    time.Duration // The total time the stage waited for room in the full output queue
+	CreditBlockedTime    time.Duration // The total time results waited for credits from the next workers
+	UncompressedBytes    uint64        // The total size of the payloads sent compressed, before compression
+	CompressedBytes      uint64        // The total size of the same payloads, after compression
 	lock                 sync.Mutex    // For concurrency reasons
 }
 
@@ -25,6 +43,24 @@ func (workerStats *WorkerStats) String() string {
 	workerStatsString += " MaxWorkerMemoryUsage: " + strconv.FormatUint(workerStats.MaxWorkerMemoryUsage, 10)
 	workerStatsString += " ExecutionTime: " + strconv.FormatInt(workerStats.ExecutionTime.Nanoseconds(), 10)
 	workerStatsString += " Backlog: " + strconv.Itoa(workerStats.Backlog)
+	workerStatsString += " Inputs: " + strconv.Itoa(workerStats.Inputs)
+	workerStatsString += " Outputs: " + strconv.Itoa(workerStats.Outputs)
+	workerStatsString += " Dropped: " + strconv.Itoa(workerStats.Dropped)
+	workerStatsString += " Retries: " + strconv.Itoa(workerStats.Retries)
+	workerStatsString += " Failures: " + strconv.Itoa(workerStats.Failures)
+	workerStatsString += " Panics: " + strconv.Itoa(workerStats.Panics)
+	workerStatsString += " ReorderDepth: " + strconv.Itoa(workerStats.ReorderDepth)
+	workerStatsString += " MaxReorderDepth: " + strconv.Itoa(workerStats.MaxReorderDepth)
+	workerStatsString += " ReorderWaitTime: " + strconv.FormatInt(workerStats.ReorderWaitTime.Nanoseconds(), 10)
+	workerStatsString += " ReorderSkipped: " + strconv.Itoa(workerStats.ReorderSkipped)
+	workerStatsString += " Retransmits: " + strconv.Itoa(workerStats.Retransmits)
+	workerStatsString += " Duplicates: " + strconv.Itoa(workerStats.Duplicates)
+	workerStatsString += " Delivered: " + strconv.FormatUint(workerStats.Delivered, 10)
+	workerStatsString += " InputBlockedTime: " + strconv.FormatInt(workerStats.InputBlockedTime.Nanoseconds(), 10)
+	workerStatsString += " OutputBlockedTime: " + strconv.FormatInt(workerStats.OutputBlockedTime.Nanoseconds(), 10)
+	workerStatsString += " CreditBlockedTime: " + strconv.FormatInt(workerStats.CreditBlockedTime.Nanoseconds(), 10)
+	workerStatsString += " UncompressedBytes: " + strconv.FormatUint(workerStats.UncompressedBytes, 10)
+	workerStatsString += " CompressedBytes: " + strconv.FormatUint(workerStats.CompressedBytes, 10)
 	workerStatsString += " }"
 	workerStats.lock.Unlock()
 	return workerStatsString
@@ -71,6 +107,126 @@ func (workerStats *WorkerStats) UpdateBacklog(backlog int) {
 	workerStats.lock.Unlock()
 }
 
+// GetBacklog returns the number of unprocessed items in the input queue
+func (workerStats *WorkerStats) GetBacklog() int {
+	workerStats.lock.Lock()
+	defer workerStats.lock.Unlock()
+	return workerStats.Backlog
+}
+
+// UpdateDelivered records the number of items a source stage worker produced before the first one whose results the
+// next workers have not all acknowledged yet
+func (workerStats *WorkerStats) UpdateDelivered(delivered uint64) {
+	workerStats.lock.Lock()
+	workerStats.Delivered = delivered
+	workerStats.lock.Unlock()
+}
+
+// AddItemCounts adds the number of processed inputs, the number of outputs they produced, and the number of outputs
+// that were dropped, to the item counts
+func (workerStats *WorkerStats) AddItemCounts(numInputs int, numOutputs int, numDropped int) {
+	workerStats.lock.Lock()
+	workerStats.Inputs += numInputs
+	workerStats.Outputs += numOutputs
+	workerStats.Dropped += numDropped
+	workerStats.lock.Unlock()
+}
+
+// AddRetry increments the number of retries
+func (workerStats *WorkerStats) AddRetry() {
+	workerStats.lock.Lock()
+	workerStats.Retries++
+	workerStats.lock.Unlock()
+}
+
+// AddFailure increments the number of inputs that could not be processed
+func (workerStats *WorkerStats) AddFailure() {
+	workerStats.lock.Lock()
+	workerStats.Failures++
+	workerStats.lock.Unlock()
+}
+
+// AddPanic increments the number of times the stage's function panicked
+func (workerStats *WorkerStats) AddPanic() {
+	workerStats.lock.Lock()
+	workerStats.Panics++
+	workerStats.lock.Unlock()
+}
+
+// UpdateReorderDepth updates the number of inputs held back by the reorder buffer
+func (workerStats *WorkerStats) UpdateReorderDepth(depth int) {
+	workerStats.lock.Lock()
+	workerStats.ReorderDepth = depth
+	if workerStats.MaxReorderDepth < depth {
+		workerStats.MaxReorderDepth = depth
+	}
+	workerStats.lock.Unlock()
+}
+
+// UpdateReorderWaitTime uses a weighted running average to calculate the average time inputs are held back by the
+// reorder buffer
+func (workerStats *WorkerStats) UpdateReorderWaitTime(waitTime time.Duration) {
+	newWaitTime := float64(waitTime) * (2. / 3.)
+	workerStats.lock.Lock()
+	if workerStats.ReorderWaitTime == 0 {
+		workerStats.ReorderWaitTime = waitTime
+	} else {
+		oldWaitTime := float64(workerStats.ReorderWaitTime) * (1. / 3.)
+		workerStats.ReorderWaitTime = time.Duration(oldWaitTime + newWaitTime)
+	}
+	workerStats.lock.Unlock()
+}
+
+// AddReorderSkipped adds the number of missing inputs the reorder buffer gave up waiting for
+func (workerStats *WorkerStats) AddReorderSkipped(numSkipped int) {
+	workerStats.lock.Lock()
+	workerStats.ReorderSkipped += numSkipped
+	workerStats.lock.Unlock()
+}
+
+// AddRetransmit increments the number of results sent again after a connection was lost
+func (workerStats *WorkerStats) AddRetransmit() {
+	workerStats.lock.Lock()
+	workerStats.Retransmits++
+	workerStats.lock.Unlock()
+}
+
+// AddDuplicate increments the number of inputs received more than once
+func (workerStats *WorkerStats) AddDuplicate() {
+	workerStats.lock.Lock()
+	workerStats.Duplicates++
+	workerStats.lock.Unlock()
+}
+
+// AddInputBlockedTime adds the time a received input waited for room in the full input queue
+func (workerStats *WorkerStats) AddInputBlockedTime(blockedTime time.Duration) {
+	workerStats.lock.Lock()
+	workerStats.InputBlockedTime += blockedTime
+	workerStats.lock.Unlock()
+}
+
+// AddOutputBlockedTime adds the time the stage waited for room in the full output queue
+func (workerStats *WorkerStats) AddOutputBlockedTime(blockedTime time.Duration) {
+	workerStats.lock.Lock()
+	workerStats.OutputBlockedTime += blockedTime
+	workerStats.lock.Unlock()
+}
+
+// AddCreditBlockedTime adds the time a result waited for credits from the next worker it was sent to
+func (workerStats *WorkerStats) AddCreditBlockedTime(blockedTime time.Duration) {
+	workerStats.lock.Lock()
+	workerStats.CreditBlockedTime += blockedTime
+	workerStats.lock.Unlock()
+}
+
+// AddCompressedBytes adds the size of a payload that was sent compressed, before and after compression
+func (workerStats *WorkerStats) AddCompressedBytes(uncompressed int, compressed int) {
+	workerStats.lock.Lock()
+	workerStats.UncompressedBytes += uint64(uncompressed)
+	workerStats.CompressedBytes += uint64(compressed)
+	workerStats.lock.Unlock()
+}
+
 // Copy returns a copy of the WorkerStats struct
 func (workerStats *WorkerStats) Copy() *WorkerStats {
 	workerStatsCopy := new(WorkerStats)
@@ -79,6 +235,24 @@ func (workerStats *WorkerStats) Copy() *WorkerStats {
 	workerStatsCopy.WorkerMemoryUsage = workerStats.WorkerMemoryUsage
 	workerStatsCopy.ExecutionTime = workerStats.ExecutionTime
 	workerStatsCopy.Backlog = workerStats.Backlog
+	workerStatsCopy.Inputs = workerStats.Inputs
+	workerStatsCopy.Outputs = workerStats.Outputs
+	workerStatsCopy.Dropped = workerStats.Dropped
+	workerStatsCopy.Retries = workerStats.Retries
+	workerStatsCopy.Failures = workerStats.Failures
+	workerStatsCopy.Panics = workerStats.Panics
+	workerStatsCopy.ReorderDepth = workerStats.ReorderDepth
+	workerStatsCopy.MaxReorderDepth = workerStats.MaxReorderDepth
+	workerStatsCopy.ReorderWaitTime = workerStats.ReorderWaitTime
+	workerStatsCopy.ReorderSkipped = workerStats.ReorderSkipped
+	workerStatsCopy.Retransmits = workerStats.Retransmits
+	workerStatsCopy.Duplicates = workerStats.Duplicates
+	workerStatsCopy.Delivered = workerStats.Delivered
+	workerStatsCopy.InputBlockedTime = workerStats.InputBlockedTime
+	workerStatsCopy.OutputBlockedTime = workerStats.OutputBlockedTime
+	workerStatsCopy.CreditBlockedTime = workerStats.CreditBlockedTime
+	workerStatsCopy.UncompressedBytes = workerStats.UncompressedBytes
+	workerStatsCopy.CompressedBytes = workerStats.CompressedBytes
 	workerStats.lock.Unlock()
 	return workerStatsCopy
 }
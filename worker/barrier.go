@@ -0,0 +1,187 @@
+package worker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// barrierAlignmentTimeout is the maximum time the barrier of a checkpoint is waited for from every previous worker.
+// Once it runs out, this worker gives up on the checkpoint and lets the held back inputs through.
+const barrierAlignmentTimeout = 30 * time.Second
+
+// barriers aligns the barriers received from the previous workers
+var barriers = NewBarrierAligner()
+
+// sourceBarriers holds the IDs of the checkpoints a worker running a source stage has been told to start
+var sourceBarriers = make(chan int, 16)
+
+// alignment keeps track of the barriers of a single checkpoint
+type alignment struct {
+	expected []string        // The IDs of the previous workers to expect the barrier from. nil until the master sends them
+	arrived  map[string]bool // The IDs of the previous workers whose barrier has arrived
+	aligned  chan struct{}   // Closed once the barrier has arrived from every expected worker, or the alignment timed out
+	done     bool            // Whether aligned has been closed
+}
+
+// BarrierAligner waits for the barrier of a checkpoint to arrive from every previous worker. Since the barriers are
+// sent along the same connections as the results, the connection a barrier arrived on is held back until the barrier
+// has arrived on every other connection. At that point, every input received before the barriers has been pushed into
+// the queue, so the barrier is pushed in after them.
+type BarrierAligner struct {
+	alignments map[int]*alignment // The alignments in progress, by checkpoint ID
+	finished   map[string]bool    // The IDs of the previous workers that have sent the end of the stream
+	queue      *Queue             // The queue into which to push the barriers
+	mutex      *sync.Mutex        // For concurrency stuff
+}
+
+// NewBarrierAligner creates a barrier aligner. The queue has to be set with SetQueue before barriers can be pushed.
+func NewBarrierAligner() *BarrierAligner {
+	aligner := new(BarrierAligner)
+	aligner.alignments = make(map[int]*alignment)
+	aligner.finished = make(map[string]bool)
+	aligner.queue = nil
+	aligner.mutex = &sync.Mutex{}
+	return aligner
+}
+
+// SetQueue sets the queue into which aligned barriers are pushed
+func (aligner *BarrierAligner) SetQueue(queue *Queue) {
+	aligner.mutex.Lock()
+	aligner.queue = queue
+	aligner.mutex.Unlock()
+}
+
+// Expect records the IDs of the previous workers the master expects the barrier of the checkpoint to arrive from
+func (aligner *BarrierAligner) Expect(barrier *types.Barrier) {
+	aligner.mutex.Lock()
+	defer aligner.mutex.Unlock()
+	current := aligner.getAlignment(barrier.CheckpointID)
+	current.expected = barrier.Upstream
+	if current.expected == nil {
+		current.expected = make([]string, 0)
+	}
+	aligner.checkAlignment(barrier.CheckpointID, current)
+}
+
+// Arrive records the barrier of the checkpoint received from the given previous worker, and blocks until it has
+// arrived from every other previous worker
+func (aligner *BarrierAligner) Arrive(checkpointID int, senderID string) {
+	aligner.mutex.Lock()
+	current := aligner.getAlignment(checkpointID)
+	current.arrived[senderID] = true
+	aligner.checkAlignment(checkpointID, current)
+	aligner.mutex.Unlock()
+	<-current.aligned
+}
+
+// Finished records that the given previous worker has sent the end of the stream, and will therefore send no more
+// barriers
+func (aligner *BarrierAligner) Finished(senderID string) {
+	aligner.mutex.Lock()
+	defer aligner.mutex.Unlock()
+	aligner.finished[senderID] = true
+	for checkpointID, current := range aligner.alignments {
+		aligner.checkAlignment(checkpointID, current)
+	}
+}
+
+// getAlignment returns the alignment of the checkpoint, creating it if necessary. An alignment that does not complete
+// within barrierAlignmentTimeout is abandoned. Must be called with the mutex locked.
+func (aligner *BarrierAligner) getAlignment(checkpointID int) *alignment {
+	current, ok := aligner.alignments[checkpointID]
+	if ok {
+		return current
+	}
+	current = new(alignment)
+	current.expected = nil
+	current.arrived = make(map[string]bool)
+	current.aligned = make(chan struct{})
+	current.done = false
+	aligner.alignments[checkpointID] = current
+	time.AfterFunc(barrierAlignmentTimeout, func() {
+		aligner.mutex.Lock()
+		defer aligner.mutex.Unlock()
+		if !current.done {
+			logMessage("Gave up on aligning the barriers of checkpoint " + strconv.Itoa(checkpointID))
+			current.done = true
+			close(current.aligned)
+		}
+		delete(aligner.alignments, checkpointID)
+	})
+	return current
+}
+
+// checkAlignment pushes the barrier into the queue once it has arrived from every expected worker, and lets the held
+// back connections go. Must be called with the mutex locked.
+func (aligner *BarrierAligner) checkAlignment(checkpointID int, current *alignment) {
+	if current.done || current.expected == nil {
+		return
+	}
+	for _, senderID := range current.expected {
+		if !current.arrived[senderID] && !aligner.finished[senderID] {
+			return
+		}
+	}
+	if reorderBuffer != nil {
+		reorderBuffer.Flush()
+	}
+	aligner.queue.Push(newBarrierMessage(StageID, checkpointID))
+	current.done = true
+	close(current.aligned)
+	logPrint("Aligned the barriers of checkpoint " + strconv.Itoa(checkpointID))
+}
+
+// handleBarrierMessage passes a barrier sent by a previous worker to the aligner, and blocks until it is aligned.
+// Returns false if the message is not a barrier.
+func handleBarrierMessage(message *types.Message) bool {
+	if message.Description != common.MsgBarrier {
+		return false
+	}
+	barrier := message.Contents.(*types.Barrier)
+	barriers.Arrive(barrier.CheckpointID, message.Sender)
+	return true
+}
+
+// newBarrierMessage creates the barrier of the checkpoint that is passed on to the next workers
+func newBarrierMessage(myID string, checkpointID int) *types.Message {
+	barrier := new(types.Barrier)
+	barrier.CheckpointID = checkpointID
+	message := new(types.Message)
+	message.Sender = myID
+	message.Description = common.MsgBarrier
+	message.Contents = barrier
+	return message
+}
+
+// snapshotPath returns the path of the file in the user's home directory to which the last snapshot is written
+func snapshotPath() string {
+	return userHomeDir() + "/gopipeline" + StageNumber + "." + StageID + ".checkpoint"
+}
+
+// takeSnapshot checkpoints the state of this worker once the barrier of the checkpoint has passed it, writes the
+// snapshot to local disk and sends it to the master. For source stage workers, sequence is the number of items
+// produced before the barrier.
+func takeSnapshot(checkpointID int, sequence uint64) {
+	workerCheckpoint := new(types.WorkerCheckpoint)
+	workerCheckpoint.CheckpointID = checkpointID
+	workerCheckpoint.WorkerID = StageID
+	workerCheckpoint.Position = stagePosition
+	workerCheckpoint.Sequence = sequence
+	if isStateful {
+		snapshot, err := checkpointState()
+		if err != nil {
+			logMessage("Could not checkpoint the state: " + err.Error())
+			return
+		}
+		workerCheckpoint.State = snapshot
+	}
+	if err := workerCheckpoint.Write(snapshotPath()); err != nil {
+		logMessage("Could not write the snapshot: " + err.Error())
+	}
+	sendToMaster(common.MsgCheckpointDone, workerCheckpoint)
+	logPrint("Took the snapshot for checkpoint " + strconv.Itoa(checkpointID))
+}
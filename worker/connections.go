@@ -1,16 +1,29 @@
 package worker
 
 import (
-	"encoding/gob"
-	"net"
+	"errors"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
+	"github.com/ffrankies/gopipeline/types"
 )
 
 // Connections is a list of Connection objects
 type Connections struct {
-	Cons    []*Connection // The list of Connection objects
-	mutex   *sync.Mutex   // For concurrency stuff
-	counter int           // The roundRobin counter
+	Cons         []*Connection       // The list of Connection objects
+	mutex        *sync.Mutex         // For concurrency stuff
+	added        *sync.Cond          // Signalled when a connection is added to the list, or when the list is closed
+	closed       bool                // Whether the list has been closed. No connection is chosen once it is
+	counter      int                 // The roundRobin counter
+	partitionKey types.KeyFunc       // If not nil, the key by which items are routed to the connections
+	ring         *HashRing           // Maps item keys to connection addresses. Only used if partitionKey is not nil
+	policy       types.RoutingPolicy // How the connection for an item is chosen if partitionKey is nil
+	codec        string              // The name of the codec preferred when opening a connection
+	compression  types.Compression   // How the payloads sent along the connections are compressed
 }
 
 // NewConnections creates a new empty list of connections
@@ -18,77 +31,554 @@ func NewConnections() *Connections {
 	connections := new(Connections)
 	connections.Cons = make([]*Connection, 0)
 	connections.mutex = &sync.Mutex{}
+	connections.added = sync.NewCond(connections.mutex)
 	connections.counter = 0
+	connections.policy = types.RoundRobin
+	connections.codec = types.GobCodec
+	connections.compression = types.Compression{Algorithm: types.NoCompression}
 	return connections
 }
 
-// AddConnection adds a new connection to the list of connections
+// NewRoutedConnections creates a new empty list of connections that chooses the connection for every item with the
+// given routing policy
+func NewRoutedConnections(policy types.RoutingPolicy) *Connections {
+	connections := NewConnections()
+	connections.policy = policy
+	return connections
+}
+
+// NewPartitionedConnections creates a new empty list of connections that routes items with the same key, as returned
+// by partitionKey, along the same connection
+func NewPartitionedConnections(partitionKey types.KeyFunc) *Connections {
+	connections := NewConnections()
+	connections.partitionKey = partitionKey
+	connections.ring = NewHashRing()
+	return connections
+}
+
+// AddConnection adds a new connection to the list of connections, and starts reading the acknowledgements sent back
+// along it
 func (connections *Connections) AddConnection(address string) {
-	connection := NewConnection(address)
+	connection := NewConnection(address, connections.codec, connections.compression)
 	connections.mutex.Lock()
 	connections.Cons = append(connections.Cons, connection)
+	if connections.ring != nil {
+		connections.ring.Add(address)
+	}
+	connections.added.Broadcast()
 	connections.mutex.Unlock()
+	go connection.readAcknowledgements(connections.fail)
 }
 
-// Select uses round robin returns the next Connection's encoder along which to send the data
-func (connections *Connections) Select() *gob.Encoder {
-	for len(connections.Cons) == 0 {
-		// Busy wait lol
-	}
+// Select uses the routing policy of the connections to return the next Connection along which to send the data.
+// Blocks until there is at least one connection. Returns nil once the list has been closed.
+func (connections *Connections) Select() *Connection {
 	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	for len(connections.Cons) == 0 && !connections.closed {
+		connections.added.Wait()
+	}
+	if connections.closed {
+		return nil
+	}
+	switch connections.policy {
+	case types.LeastLoaded:
+		return connections.selectLeastLoaded()
+	case types.PowerOfTwoChoices:
+		return connections.selectPowerOfTwoChoices()
+	default:
+		connections.counter++
+		connections.counter %= len(connections.Cons)
+		return connections.Cons[connections.counter]
+	}
+}
+
+// selectLeastLoaded returns the connection to the least loaded worker. Ties are broken in round robin order, so that
+// idle workers share the inputs. Must be called with the mutex locked.
+func (connections *Connections) selectLeastLoaded() *Connection {
 	connections.counter++
-	connections.counter %= len(connections.Cons)
-	encoder := connections.Cons[connections.counter].Encoder
-	connections.mutex.Unlock()
-	return encoder
+	numConnections := len(connections.Cons)
+	var leastLoaded *Connection
+	smallestLoad := 0
+	for offset := 0; offset < numConnections; offset++ {
+		connection := connections.Cons[(connections.counter+offset)%numConnections]
+		load := connection.Load()
+		if leastLoaded == nil || load < smallestLoad {
+			leastLoaded = connection
+			smallestLoad = load
+		}
+	}
+	return leastLoaded
 }
 
-// RemoveConnection closes the connection to the address of the worker given and removes the connection from the connection list.
-func (connections *Connections) RemoveConnection(address string) {
-	var indexToRemove int
+// selectPowerOfTwoChoices picks two connections at random, and returns the one to the less loaded worker. Must be
+// called with the mutex locked.
+func (connections *Connections) selectPowerOfTwoChoices() *Connection {
+	numConnections := len(connections.Cons)
+	if numConnections == 1 {
+		return connections.Cons[0]
+	}
+	first := rand.Intn(numConnections)
+	second := rand.Intn(numConnections - 1)
+	if second >= first {
+		second++
+	}
+	if connections.Cons[second].Load() < connections.Cons[first].Load() {
+		return connections.Cons[second]
+	}
+	return connections.Cons[first]
+}
+
+// SelectFor returns the connection along which to send the given item. If the connections are partitioned, the
+// connection is chosen by the item's key, otherwise by the routing policy. Blocks until there is at least one
+// connection. Returns nil once the list has been closed.
+func (connections *Connections) SelectFor(item interface{}) *Connection {
+	if connections.partitionKey == nil {
+		return connections.Select()
+	}
+	key := connections.partitionKey(item)
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	for !connections.closed {
+		if address, ok := connections.ring.Get(key); ok {
+			for _, connection := range connections.Cons {
+				if connection.Address == address {
+					return connection
+				}
+			}
+		}
+		connections.added.Wait()
+	}
+	return nil
+}
+
+// Send sends a result message along one of the connections, and keeps it until it is acknowledged, at which point the
+// delivery is told. If the connection fails, every message it has not acknowledged is sent again along the remaining
+// connections. If the connection was closed while the message waited for credits, it is removed from the list and
+// the message is sent along another connection. Skips have no contents to partition by, so they follow the routing
+// policy. Returns errConnectionsClosed if the list was closed before the message could be sent.
+func (connections *Connections) Send(message *types.Message, delivery *delivery) error {
+	for {
+		var connection *Connection
+		if message.Description == common.MsgSequenceSkip {
+			connection = connections.Select()
+		} else {
+			connection = connections.SelectFor(message.Contents)
+		}
+		if connection == nil {
+			return errConnectionsClosed
+		}
+		err := connection.Send(message, delivery)
+		if err == errConnectionClosed {
+			connections.remove(connection)
+			continue
+		}
+		if err != nil {
+			logMessage("Could not send to " + connection.Address + ": " + err.Error())
+			connections.fail(connection)
+		}
+		return nil
+	}
+}
+
+// Length returns the number of connections in the list
+func (connections *Connections) Length() int {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	return len(connections.Cons)
+}
+
+// detach removes the connection to the given address from the list, without closing it. Returns nil if there is no
+// connection to the given address.
+func (connections *Connections) detach(address string) *Connection {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	if connections.ring != nil {
+		connections.ring.Remove(address)
+	}
 	for index, connection := range connections.Cons {
 		if connection.Address == address {
-			connection.Close()
-			indexToRemove = index
-			break
+			connections.Cons = append(connections.Cons[:index], connections.Cons[index+1:]...)
+			return connection
+		}
+	}
+	return nil
+}
+
+// remove removes the given connection from the list, without closing it. Does nothing if the connection is no longer
+// in the list.
+func (connections *Connections) remove(connection *Connection) {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	for index, candidate := range connections.Cons {
+		if candidate == connection {
+			connections.Cons = append(connections.Cons[:index], connections.Cons[index+1:]...)
+			if connections.ring != nil {
+				connections.ring.Remove(connection.Address)
+			}
+			return
+		}
+	}
+}
+
+// replay sends every message that the given connection has not acknowledged along the remaining connections. The
+// messages keep their IDs, so that a next worker that already received one recognizes it as a duplicate.
+func (connections *Connections) replay(connection *Connection) {
+	for _, result := range connection.takeUnacknowledged() {
+		WorkerStatistics.AddRetransmit()
+		if err := connections.Send(result.message, result.delivery); err != nil {
+			logMessage("Could not send the results of " + connection.Address + " again: " + err.Error())
+			return
 		}
 	}
-	if indexToRemove == len(connections.Cons) {
-		connections.Cons = connections.Cons[:indexToRemove]
-	} else {
-		connections.Cons = append(connections.Cons[:indexToRemove], connections.Cons[indexToRemove+1:]...)
+}
+
+// fail removes a connection that could not be written to or read from, and replays its unacknowledged messages
+func (connections *Connections) fail(connection *Connection) {
+	if connections.detach(connection.Address) == nil {
+		return
+	}
+	logMessage("Lost the connection to " + connection.Address)
+	connection.Close()
+	connections.replay(connection)
+}
+
+// RemoveConnection closes the connection to the address of the worker given and removes the connection from the connection list.
+// The messages the worker has not acknowledged are sent again along the remaining connections in the background, since
+// that can wait for a connection to be added. Does nothing if there is no connection to the given address.
+func (connections *Connections) RemoveConnection(address string) {
+	connection := connections.detach(address)
+	if connection == nil {
+		return
+	}
+	connection.Close()
+	go connections.replay(connection)
+}
+
+// Broadcast sends the given message along every connection in the list, without waiting for acknowledgements
+func (connections *Connections) Broadcast(message *types.Message) error {
+	connections.mutex.Lock()
+	cons := append([]*Connection(nil), connections.Cons...)
+	connections.mutex.Unlock()
+	for _, connection := range cons {
+		if err := connection.sendUnacknowledged(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForAcknowledgements blocks until every message sent along the connections has been acknowledged
+func (connections *Connections) WaitForAcknowledgements() {
+	for {
+		numUnacknowledged := 0
+		connections.mutex.Lock()
+		for _, connection := range connections.Cons {
+			numUnacknowledged += connection.NumUnacknowledged()
+		}
+		connections.mutex.Unlock()
+		if numUnacknowledged == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-// CloseAll closes all the connections
+// CloseAll closes all the connections, and closes the list, so that sending along it fails from then on instead of
+// waiting for a connection
 func (connections *Connections) CloseAll() {
+	connections.mutex.Lock()
+	defer connections.mutex.Unlock()
+	connections.closed = true
+	connections.added.Broadcast()
 	for _, connection := range connections.Cons {
 		connection.Close()
 	}
 }
 
+// StageConnections groups the connections to the next nodes by the position of the stage they run, so that every
+// output can be sent to one worker of every downstream stage
+type StageConnections struct {
+	Stages    map[int]*Connections // The connections to the workers of each downstream stage, by stage position
+	Positions []int                // The positions of the downstream stages
+	mutex     *sync.Mutex          // For concurrency stuff
+}
+
+// NewStageConnections creates a new list of connections with an empty group for every stage downstream of the stage at
+// the given position. The connections to a stage with a PartitionKey are partitioned by that key, and the others
+// follow the stage's routing policy. Items are sent to each stage with the codec and compression of the edge leading to
+// it.
+func NewStageConnections(pipeline *types.Pipeline, position int) *StageConnections {
+	downstream := pipeline.Downstream(position)
+	stageConnections := new(StageConnections)
+	stageConnections.Stages = make(map[int]*Connections)
+	stageConnections.Positions = make([]int, 0, len(downstream))
+	stageConnections.mutex = &sync.Mutex{}
+	for _, nextPosition := range downstream {
+		stage := pipeline.Stages[nextPosition]
+		var connections *Connections
+		if stage.PartitionKey != nil {
+			connections = NewPartitionedConnections(stage.PartitionKey)
+		} else {
+			connections = NewRoutedConnections(stage.Routing)
+		}
+		connections.codec = pipeline.EdgeCodec(position, nextPosition)
+		connections.compression = pipeline.EdgeCompression(position, nextPosition)
+		stageConnections.Stages[nextPosition] = connections
+		stageConnections.Positions = append(stageConnections.Positions, nextPosition)
+	}
+	return stageConnections
+}
+
+// group returns the connections to the workers of the stage at the given position, creating them if needed
+func (stageConnections *StageConnections) group(position int) *Connections {
+	stageConnections.mutex.Lock()
+	defer stageConnections.mutex.Unlock()
+	connections, ok := stageConnections.Stages[position]
+	if !ok {
+		connections = NewConnections()
+		stageConnections.Stages[position] = connections
+		stageConnections.Positions = append(stageConnections.Positions, position)
+	}
+	return connections
+}
+
+// AddConnection adds a new connection to a worker of the stage at the given position
+func (stageConnections *StageConnections) AddConnection(nextStage types.NextStageAddress) {
+	stageConnections.group(nextStage.Position).AddConnection(nextStage.Address)
+}
+
+// SendToAll sends the given message to one worker of every downstream stage, chosen by the message's contents for
+// partitioned stages. Every copy of the message is kept until the worker it was sent to acknowledges it, and the
+// delivery, if not nil, waits for every copy to be acknowledged. Returns errConnectionsClosed if the connections to a
+// downstream stage were closed before the message could be sent to it.
+func (stageConnections *StageConnections) SendToAll(message *types.Message, delivery *delivery) error {
+	positions := stageConnections.positions()
+	delivery.expect(len(positions))
+	for _, position := range positions {
+		if err := stageConnections.group(position).Send(message, delivery); err != nil {
+			return err
+		}
+	}
+	delivery.acknowledged()
+	return nil
+}
+
+// RemoveConnection closes the connection to the address of the worker given, whichever stage it runs
+func (stageConnections *StageConnections) RemoveConnection(address string) {
+	for _, position := range stageConnections.positions() {
+		stageConnections.group(position).RemoveConnection(address)
+	}
+}
+
+// Broadcast sends the given message along every connection to every downstream stage
+func (stageConnections *StageConnections) Broadcast(message *types.Message) error {
+	for _, position := range stageConnections.positions() {
+		if err := stageConnections.group(position).Broadcast(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForAcknowledgements blocks until every message sent to every downstream stage has been acknowledged
+func (stageConnections *StageConnections) WaitForAcknowledgements() {
+	for _, position := range stageConnections.positions() {
+		stageConnections.group(position).WaitForAcknowledgements()
+	}
+}
+
+// CloseAll closes all the connections to every downstream stage
+func (stageConnections *StageConnections) CloseAll() {
+	for _, position := range stageConnections.positions() {
+		stageConnections.group(position).CloseAll()
+	}
+}
+
+// positions returns a copy of the positions of the downstream stages
+func (stageConnections *StageConnections) positions() []int {
+	stageConnections.mutex.Lock()
+	defer stageConnections.mutex.Unlock()
+	return append([]int(nil), stageConnections.Positions...)
+}
+
+// errConnectionsClosed is returned when sending along a list of connections that has been closed
+var errConnectionsClosed = errors.New("the connections have been closed")
+
+// pendingResult is a result sent along a connection that was not acknowledged yet
+type pendingResult struct {
+	message  *types.Message // The copy of the result that was sent
+	delivery *delivery      // Told once the result is acknowledged. nil if nothing waits for the acknowledgement
+	order    uint64         // The number of results sent along the connection before this one
+}
+
+// initialCredits is the number of results that can be sent along a new connection before the next worker has granted
+// any credits
+const initialCredits = 1
+
+// errConnectionClosed is returned when sending along a connection that has been closed
+var errConnectionClosed = errors.New("the connection has been closed")
+
 // Connection maintains a connection to the next node
 type Connection struct {
-	Address string       // The address of the next node
-	Con     net.Conn     // The connection to the next node
-	Encoder *gob.Encoder // The encoder for sending data along the connections
+	Address        string                    // The address of the next node
+	Con            *protocol.Conn            // The connection to the next node
+	unacknowledged map[uint64]*pendingResult // The results sent along the connection that were not acknowledged yet
+	numSent        uint64                    // The number of results sent along the connection
+	credits        int                       // The number of unacknowledged results the next node has room for
+	backlog        int                       // The backlog reported by the next node in its last acknowledgement
+	closed         bool                      // Whether the connection has been closed
+	mutex          *sync.Mutex               // Guards the bookkeeping above. Not held while writing to Con
+	creditsChanged *sync.Cond                // Signalled when the credits or the unacknowledged results change
 }
 
-// NewConnection creates a new connection object
-func NewConnection(address string) *Connection {
+// NewConnection creates a new connection object, offering the given codec and compression algorithm first during the
+// handshake. Payloads larger than the compression threshold are compressed, and their sizes are added to the stats.
+func NewConnection(address string, codec string, compression types.Compression) *Connection {
 	connection := new(Connection)
 	connection.Address = address
-	con, err := net.Dial("tcp", address)
+	con, err := protocol.Dial(address, 0, protocol.FeaturesFor(codec, compression.Algorithm))
 	if err != nil {
 		panic(err)
 	}
+	if err = con.CompressAbove(compression.Threshold, WorkerStatistics.AddCompressedBytes); err != nil {
+		panic(err)
+	}
 	connection.Con = con
-	connection.Encoder = gob.NewEncoder(connection.Con)
+	connection.unacknowledged = make(map[uint64]*pendingResult)
+	connection.numSent = 0
+	connection.credits = initialCredits
+	connection.backlog = 0
+	connection.closed = false
+	connection.mutex = &sync.Mutex{}
+	connection.creditsChanged = sync.NewCond(connection.mutex)
 	return connection
 }
 
-// Close closes the connection
+// Send sends a copy of the message along the connection and keeps it, under the message's ID, until it is
+// acknowledged. The ID is given to the message when it is created, and is kept when the message is sent again. Blocks
+// while the next node has no room for another result, i.e. while the number of unacknowledged results has reached the
+// credits it granted. Returns errConnectionClosed if the connection was closed before the message was sent. The mutex
+// is released before the message is written to the network, so that a slow next node does not hold up the
+// acknowledgements and credits it sends back, nor the other workers choosing a connection by load.
+func (connection *Connection) Send(message *types.Message, delivery *delivery) error {
+	messageCopy := *message
+	connection.mutex.Lock()
+	if !connection.closed && len(connection.unacknowledged) >= connection.credits {
+		timerStart := time.Now()
+		for !connection.closed && len(connection.unacknowledged) >= connection.credits {
+			connection.creditsChanged.Wait()
+		}
+		WorkerStatistics.AddCreditBlockedTime(time.Since(timerStart))
+	}
+	if connection.closed {
+		connection.mutex.Unlock()
+		return errConnectionClosed
+	}
+	connection.unacknowledged[messageCopy.ID] = &pendingResult{message: &messageCopy, delivery: delivery,
+		order: connection.numSent}
+	connection.numSent++
+	connection.mutex.Unlock()
+	return connection.Con.Encode(&messageCopy)
+}
+
+// sendUnacknowledged sends a message along the connection without keeping it. Con serializes its writes itself.
+func (connection *Connection) sendUnacknowledged(message *types.Message) error {
+	return connection.Con.Encode(message)
+}
+
+// Acknowledge forgets the messages acknowledged by the next node, since it has processed them, records the backlog it
+// reported, and tells the deliveries waiting for the messages
+func (connection *Connection) Acknowledge(acknowledgement *types.Acknowledgement) {
+	delivered := make([]*delivery, 0, len(acknowledgement.MessageIDs))
+	connection.mutex.Lock()
+	for _, messageID := range acknowledgement.MessageIDs {
+		if result, ok := connection.unacknowledged[messageID]; ok {
+			delivered = append(delivered, result.delivery)
+			delete(connection.unacknowledged, messageID)
+		}
+	}
+	connection.backlog = acknowledgement.Backlog
+	connection.creditsChanged.Broadcast()
+	connection.mutex.Unlock()
+	for _, delivery := range delivered {
+		delivery.acknowledged()
+	}
+}
+
+// Grant sets the number of unacknowledged results the next node has room for
+func (connection *Connection) Grant(credits int) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.credits = credits
+	connection.creditsChanged.Broadcast()
+}
+
+// Load returns the estimated load of the next node: its last reported backlog, plus the results sent to it that it has
+// not acknowledged yet
+func (connection *Connection) Load() int {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.backlog + len(connection.unacknowledged)
+}
+
+// NumUnacknowledged returns the number of messages sent along the connection that were not acknowledged yet
+func (connection *Connection) NumUnacknowledged() int {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return len(connection.unacknowledged)
+}
+
+// takeUnacknowledged removes the results sent along the connection that were not acknowledged yet, and returns them in
+// the order they were sent in. An acknowledgement that arrives afterwards is ignored, since the results are sent again.
+func (connection *Connection) takeUnacknowledged() []*pendingResult {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	results := make([]*pendingResult, 0, len(connection.unacknowledged))
+	for _, result := range connection.unacknowledged {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].order < results[j].order })
+	connection.unacknowledged = make(map[uint64]*pendingResult)
+	connection.creditsChanged.Broadcast()
+	return results
+}
+
+// readAcknowledgements reads the acknowledgements and credits sent back by the next node, until the connection is
+// closed. If the connection fails before it was closed, onFailure is called with it.
+func (connection *Connection) readAcknowledgements(onFailure func(*Connection)) {
+	for {
+		message := new(types.Message)
+		if err := connection.Con.Decode(message); err != nil {
+			connection.mutex.Lock()
+			closed := connection.closed
+			connection.mutex.Unlock()
+			if !closed {
+				onFailure(connection)
+			}
+			return
+		}
+		if message.Description == common.MsgAcknowledge {
+			if acknowledgement, ok := message.Contents.(*types.Acknowledgement); ok {
+				connection.Acknowledge(acknowledgement)
+			}
+		}
+		if message.Description == common.MsgCredit {
+			connection.Grant(message.Contents.(int))
+		}
+	}
+}
+
+// Close closes the connection. Does nothing if the connection was already closed.
 func (connection *Connection) Close() {
+	connection.mutex.Lock()
+	if connection.closed {
+		connection.mutex.Unlock()
+		return
+	}
+	connection.closed = true
+	connection.creditsChanged.Broadcast()
+	connection.mutex.Unlock()
 	err := connection.Con.Close()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,120 @@
+package worker
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// pipeConnection returns a connection to a next worker that is served in memory, along with the next worker's end of
+// it, without dialing
+func pipeConnection(t *testing.T, address string) (*Connection, *protocol.Conn) {
+	localEnd, remoteEnd := net.Pipe()
+	accepted := make(chan *protocol.Conn, 1)
+	go func() {
+		remote, err := protocol.Server(remoteEnd, protocol.DefaultFeatures())
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- remote
+	}()
+	con, err := protocol.Client(localEnd, protocol.DefaultFeatures())
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection := &Connection{Address: address, Con: con, unacknowledged: make(map[uint64]*pendingResult),
+		credits: initialCredits, mutex: &sync.Mutex{}}
+	connection.creditsChanged = sync.NewCond(connection.mutex)
+	return connection, <-accepted
+}
+
+// addTestConnection adds an existing connection to the list, as AddConnection does with the connection it dials
+func addTestConnection(connections *Connections, connection *Connection) {
+	connections.mutex.Lock()
+	connections.Cons = append(connections.Cons, connection)
+	connections.added.Broadcast()
+	connections.mutex.Unlock()
+}
+
+// sendAsync sends the message along the connections in the background, and returns where the result of Send arrives
+func sendAsync(connections *Connections, message *types.Message) chan error {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- connections.Send(message, nil)
+	}()
+	return sent
+}
+
+// TestSendSkipsClosedConnection checks that a message is not sent along a connection that was closed without being
+// removed from the list, as CloseAll leaves them, and that the closed connection is dropped instead of being chosen
+// over and over again
+func TestSendSkipsClosedConnection(t *testing.T) {
+	connections := NewConnections()
+	closed, _ := pipeConnection(t, "closed:1")
+	closed.Close()
+	addTestConnection(connections, closed)
+	message := &types.Message{Description: common.MsgStageResult, Contents: "item", ID: 42}
+	sent := sendAsync(connections, message)
+	select {
+	case err := <-sent:
+		t.Fatalf("Send returned %v with only a closed connection, want it to wait for another one", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if numConnections := connections.Length(); numConnections != 0 {
+		t.Errorf("the closed connection is still in the list of %d connections", numConnections)
+	}
+	open, nextWorker := pipeConnection(t, "open:1")
+	addTestConnection(connections, open)
+	received := new(types.Message)
+	if err := nextWorker.Decode(received); err != nil {
+		t.Fatal(err)
+	}
+	if received.ID != message.ID || received.Contents != message.Contents {
+		t.Errorf("the next worker received %v, want %v", received, message)
+	}
+	if err := <-sent; err != nil {
+		t.Errorf("got error %v, want none", err)
+	}
+	if open.NumUnacknowledged() != 1 {
+		t.Errorf("%d messages wait for an acknowledgement, want 1", open.NumUnacknowledged())
+	}
+	connections.CloseAll()
+	nextWorker.Close()
+}
+
+// TestSendAfterCloseAll checks that sending along a closed list of connections fails, both when the list still holds
+// its closed connections and when it is empty, and that a send waiting for a connection gives up when it is closed
+func TestSendAfterCloseAll(t *testing.T) {
+	message := &types.Message{Description: common.MsgStageResult, Contents: "item", ID: 42}
+	waiting := NewConnections()
+	waitingSend := sendAsync(waiting, message)
+	populated := NewConnections()
+	connection, nextWorker := pipeConnection(t, "next:1")
+	defer nextWorker.Close()
+	addTestConnection(populated, connection)
+	waiting.CloseAll()
+	populated.CloseAll()
+	for name, sent := range map[string]chan error{"waiting": waitingSend, "populated": sendAsync(populated, message),
+		"partitioned": sendAsync(closedPartitionedConnections(), message)} {
+		select {
+		case err := <-sent:
+			if err != errConnectionsClosed {
+				t.Errorf("%s: got error %v, want %v", name, err, errConnectionsClosed)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: Send still has not returned a second after the connections were closed", name)
+		}
+	}
+}
+
+// closedPartitionedConnections returns a closed list of connections partitioned by item
+func closedPartitionedConnections() *Connections {
+	connections := NewPartitionedConnections(func(item interface{}) string { return item.(string) })
+	connections.CloseAll()
+	return connections
+}
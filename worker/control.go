@@ -0,0 +1,247 @@
+package worker
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// reconnectTimeout is the time for which a lost control session is reconnected to the master before the worker gives
+// up and exits
+const reconnectTimeout = 30 * time.Second
+
+// reconnectDelay is the time between two attempts to reconnect a lost control session
+const reconnectDelay = 500 * time.Millisecond
+
+// control is this worker's control session with the master
+var control *ControlSession
+
+// errSessionClosed is returned when sending along a control session that has been closed
+var errSessionClosed = errors.New("the control session has been closed")
+
+// CommandHandler handles a command sent by the master, and returns false if it does not know the command
+type CommandHandler func(message *types.Message) bool
+
+// ControlSession is the single long-lived connection between this worker and the master. The worker sends its info,
+// statistics and notifications along it, and the master sends its commands back along it. Commands are handled one at
+// a time, in the order they were sent, and every command is answered with a reply carrying the command's ID once it
+// has been handled. If the connection is lost, it is reconnected.
+type ControlSession struct {
+	masterAddress string         // The address of the master's listener
+	connection    *protocol.Conn // The current connection to the master. nil while reconnecting
+	closed        bool           // Whether the session has been closed for good
+	mutex         *sync.Mutex    // Guards connection and closed. Not held while dialing or writing
+	connected     *sync.Cond     // Signalled when the session is reconnected or closed
+}
+
+// NewControlSession opens the control session of this worker with the master at the given address
+func NewControlSession(masterAddress string) *ControlSession {
+	session := new(ControlSession)
+	session.masterAddress = masterAddress
+	session.closed = false
+	session.mutex = &sync.Mutex{}
+	session.connected = sync.NewCond(session.mutex)
+	connection, err := session.connect()
+	if err != nil {
+		panic(err)
+	}
+	session.connection = connection
+	return session
+}
+
+// connect opens a new connection to the master, and tells the master which worker it belongs to
+func (session *ControlSession) connect() (*protocol.Conn, error) {
+	connection, err := protocol.Dial(session.masterAddress, 2*time.Second, protocol.DefaultFeatures())
+	if err != nil {
+		return nil, err
+	}
+	message := new(types.Message)
+	message.Sender = StageID
+	message.Description = common.MsgOpenSession
+	if err = connection.Encode(message); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return connection, nil
+}
+
+// current returns the current connection to the master, waiting while the session is being reconnected. Returns
+// errSessionClosed once the session has been closed.
+func (session *ControlSession) current() (*protocol.Conn, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	for session.connection == nil && !session.closed {
+		session.connected.Wait()
+	}
+	if session.closed {
+		return nil, errSessionClosed
+	}
+	return session.connection, nil
+}
+
+// reconnect replaces the given lost connection with a new one. If another goroutine has already replaced it, or is
+// replacing it, waits for that instead. Keeps trying for reconnectTimeout, after which the master is assumed to be
+// gone and the worker exits. The mutex is not held while trying, so that closing the session is not held up.
+func (session *ControlSession) reconnect(lost *protocol.Conn) error {
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		return errSessionClosed
+	}
+	if session.connection != lost {
+		session.mutex.Unlock()
+		_, err := session.current()
+		return err
+	}
+	session.connection = nil
+	session.mutex.Unlock()
+	lost.Close()
+	deadline := time.Now().Add(reconnectTimeout)
+	for {
+		connection, err := session.connect()
+		if err == nil {
+			session.mutex.Lock()
+			defer session.mutex.Unlock()
+			if session.closed {
+				connection.Close()
+				return errSessionClosed
+			}
+			session.connection = connection
+			session.connected.Broadcast()
+			logPrint("Reconnected the control session")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			logMessage("Could not reconnect to the master: " + err.Error())
+			os.Exit(1)
+		}
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// Send sends a message to the master. If the connection was lost, it is reconnected and the message is sent again.
+// The connection serializes its writes itself.
+func (session *ControlSession) Send(message *types.Message) error {
+	connection, err := session.current()
+	if err != nil {
+		return err
+	}
+	if err = connection.Encode(message); err == nil {
+		return nil
+	}
+	if err = session.reconnect(connection); err != nil {
+		return err
+	}
+	if connection, err = session.current(); err != nil {
+		return err
+	}
+	return connection.Encode(message)
+}
+
+// Serve starts handling the commands sent by the master with the given handler. Commands sent before Serve is called
+// wait in the connection until then.
+func (session *ControlSession) Serve(handler CommandHandler) {
+	go session.readCommands(handler)
+}
+
+// readCommands reads the commands sent by the master, and handles each of them before reading the next one, so that
+// a command never overtakes one sent before it. If the connection is lost, it is reconnected and reading continues
+// along the new connection.
+func (session *ControlSession) readCommands(handler CommandHandler) {
+	for {
+		connection, err := session.current()
+		if err != nil {
+			return
+		}
+		for {
+			message := new(types.Message)
+			if err := connection.Decode(message); err != nil {
+				break
+			}
+			session.handle(handler, message)
+		}
+		if err := session.reconnect(connection); err != nil {
+			return
+		}
+	}
+}
+
+// handle handles a single command and replies to it. Handlers must not block for long, since the commands that follow
+// wait for them; work that can wait on other workers, such as sending results again, is done in the background.
+func (session *ControlSession) handle(handler CommandHandler, command *types.Message) {
+	if !handler(command) {
+		logMessage("Received invalid command from the master of type: " + strconv.Itoa(command.Description))
+	}
+	session.reply(command)
+}
+
+// reply tells the master that the given command has been handled
+func (session *ControlSession) reply(command *types.Message) {
+	message := new(types.Message)
+	message.Sender = StageID
+	message.Description = common.MsgReply
+	message.ID = command.ID
+	if err := session.Send(message); err != nil {
+		logMessage("Could not reply to the master: " + err.Error())
+	}
+}
+
+// Close closes the session for good, and wakes up the goroutines waiting for it to be reconnected
+func (session *ControlSession) Close() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.closed = true
+	session.connected.Broadcast()
+	if session.connection != nil {
+		session.connection.Close()
+	}
+}
+
+// handleCommand handles the commands the master sends to every worker. tracker is nil for workers running a source
+// stage, which tell barriers apart from the other workers. Returns false if the command is unknown.
+func handleCommand(message *types.Message, tracker *EndOfStreamTracker) bool {
+	if message.Description == common.MsgAddNextStageAddr {
+		connections.AddConnection(message.Contents.(types.NextStageAddress))
+		logPrint("Received next node address")
+		return true
+	}
+	if message.Description == common.MsgBreakConnection {
+		connections.RemoveConnection(message.Contents.(string))
+		logPrint("Removed the worker from the list of connections")
+		return true
+	}
+	if message.Description == common.MsgBarrier {
+		barrier := message.Contents.(*types.Barrier)
+		if tracker == nil {
+			sourceBarriers <- barrier.CheckpointID
+		} else {
+			barriers.Expect(barrier)
+		}
+		logPrint("Received barrier from master")
+		return true
+	}
+	if handleStateMessage(message) {
+		return true
+	}
+	if tracker != nil && handleEndOfStreamMessage(tracker, message) {
+		return true
+	}
+	return false
+}
+
+// sendToMaster sends a message from this worker to the master along the control session
+func sendToMaster(description int, contents interface{}) {
+	message := new(types.Message)
+	message.Sender = StageID
+	message.Description = description
+	message.Contents = contents
+	if err := control.Send(message); err != nil {
+		logMessage("Could not send message to the master: " + err.Error())
+	}
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// TestControlSessionOrder checks that the commands sent by the master are handled one at a time, in the order they
+// were sent, even when handling one of them takes a while, and that the replies come back in the same order
+func TestControlSessionOrder(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	master := make(chan *protocol.Conn, 1)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn, err := protocol.Server(connection, protocol.DefaultFeatures())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		master <- conn
+	}()
+	session := NewControlSession(listener.Addr().String())
+	defer session.Close()
+	masterEnd := <-master
+	opened := new(types.Message)
+	if err = masterEnd.Decode(opened); err != nil || opened.Description != common.MsgOpenSession {
+		t.Fatalf("got %v with error %v, want the session to be opened first", opened, err)
+	}
+	var handled []uint64
+	var mutex sync.Mutex
+	session.Serve(func(command *types.Message) bool {
+		if command.ID == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		mutex.Lock()
+		handled = append(handled, command.ID)
+		mutex.Unlock()
+		return true
+	})
+	const numCommands = 5
+	for id := uint64(1); id <= numCommands; id++ {
+		command := &types.Message{Sender: "master", Description: common.MsgDrainStage, ID: id}
+		if err = masterEnd.Encode(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := uint64(1); id <= numCommands; id++ {
+		reply := new(types.Message)
+		if err = masterEnd.Decode(reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Description != common.MsgReply || reply.ID != id {
+			t.Errorf("got reply %d of type %d, want the reply to command %d", reply.ID, reply.Description, id)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for index, id := range handled {
+		if id != uint64(index+1) {
+			t.Fatalf("the commands were handled in the order %v", handled)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package worker
+
+import (
+	"sync"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// deduplicationWindow is the number of result IDs remembered for every source stage worker. A result that is received
+// again after more than this many other results deriving from the same source stage worker is not recognized as a
+// duplicate.
+const deduplicationWindow = 100000
+
+// acknowledgers holds the acknowledger of the connection from every previous worker, by the ID of the previous worker
+var acknowledgers = make(map[string]*Acknowledger)
+
+// acknowledgersMutex guards acknowledgers and creditRound
+var acknowledgersMutex = &sync.Mutex{}
+
+// creditRound counts the times the room in the input queue was shared out between the previous workers, so that
+// credits computed in an earlier round are never sent after those of a later one
+var creditRound uint64
+
+// deduplicator recognizes the results that have already been received
+var deduplicator = NewDeduplicator(deduplicationWindow)
+
+// Acknowledger sends acknowledgements and credits back along the connection from a previous worker
+type Acknowledger struct {
+	connection *protocol.Conn // The connection from the previous worker
+	credits    int            // The credits last granted to the previous worker. 0 if none were granted yet
+	round      uint64         // The round in which the credits last granted were computed
+	mutex      *sync.Mutex    // For concurrency stuff
+}
+
+// NewAcknowledger creates an acknowledger for the given connection from a previous worker
+func NewAcknowledger(connection *protocol.Conn) *Acknowledger {
+	acknowledger := new(Acknowledger)
+	acknowledger.connection = connection
+	acknowledger.credits = 0
+	acknowledger.mutex = &sync.Mutex{}
+	return acknowledger
+}
+
+// Acknowledge tells the previous worker that the results with the given IDs have been processed, along with the
+// current backlog of this worker
+func (acknowledger *Acknowledger) Acknowledge(messageIDs []uint64) {
+	acknowledgement := new(types.Acknowledgement)
+	acknowledgement.MessageIDs = messageIDs
+	acknowledgement.Backlog = WorkerStatistics.GetBacklog()
+	message := new(types.Message)
+	message.Sender = StageID
+	message.Description = common.MsgAcknowledge
+	message.Contents = acknowledgement
+	acknowledger.mutex.Lock()
+	defer acknowledger.mutex.Unlock()
+	if err := acknowledger.connection.Encode(message); err != nil {
+		logMessage("Could not send acknowledgement: " + err.Error())
+	}
+}
+
+// Grant tells the previous worker how many unacknowledged results this worker has room for. The credits are only sent
+// if they changed, since every acknowledgement frees up room for another result, and only if they were computed in a
+// later round than the credits last granted.
+func (acknowledger *Acknowledger) Grant(credits int, round uint64) {
+	acknowledger.mutex.Lock()
+	defer acknowledger.mutex.Unlock()
+	if round < acknowledger.round || acknowledger.credits == credits {
+		return
+	}
+	acknowledger.credits = credits
+	acknowledger.round = round
+	message := new(types.Message)
+	message.Sender = StageID
+	message.Description = common.MsgCredit
+	message.Contents = credits
+	if err := acknowledger.connection.Encode(message); err != nil {
+		logMessage("Could not send credits: " + err.Error())
+	}
+}
+
+// Deduplicator remembers the IDs of the most recent results received, for every source stage worker. Since the ID of a
+// result is derived from the items it derives from, a result sent again by the worker that replaced a failed one is
+// recognized too. A duplicate of a result that is still being processed is held back until the result has been
+// processed, since acknowledging it earlier would let the worker that sent it forget the result while it could still
+// be lost along with this worker.
+type Deduplicator struct {
+	seen    map[string]map[uint64]bool             // The IDs of the results received, by their source stage worker
+	order   map[string][]uint64                    // The same IDs, in the order they were received in
+	pending map[string]map[uint64][]*types.Message // The duplicates held back, by the origin and ID of the result
+	window  int                                    // The number of IDs remembered for every source stage worker
+	mutex   *sync.Mutex                            // For concurrency stuff
+}
+
+// NewDeduplicator creates a deduplicator that remembers the given number of IDs for every source stage worker
+func NewDeduplicator(window int) *Deduplicator {
+	deduplicator := new(Deduplicator)
+	deduplicator.seen = make(map[string]map[uint64]bool)
+	deduplicator.order = make(map[string][]uint64)
+	deduplicator.pending = make(map[string]map[uint64][]*types.Message)
+	deduplicator.window = window
+	deduplicator.mutex = &sync.Mutex{}
+	return deduplicator
+}
+
+// IsDuplicate returns true if the result has already been received, and remembers it as being processed otherwise.
+// held is true if the result is a duplicate of a result that is still being processed, in which case it is returned
+// by Processed once that result has been processed, and must not be acknowledged until then.
+func (deduplicator *Deduplicator) IsDuplicate(message *types.Message) (duplicate bool, held bool) {
+	deduplicator.mutex.Lock()
+	defer deduplicator.mutex.Unlock()
+	seen, ok := deduplicator.seen[message.Origin]
+	if !ok {
+		seen = make(map[uint64]bool)
+		deduplicator.seen[message.Origin] = seen
+		deduplicator.pending[message.Origin] = make(map[uint64][]*types.Message)
+	}
+	pending := deduplicator.pending[message.Origin]
+	duplicates, processing := pending[message.ID]
+	if seen[message.ID] {
+		if processing {
+			pending[message.ID] = append(duplicates, message)
+		}
+		return true, processing
+	}
+	seen[message.ID] = true
+	if !processing {
+		pending[message.ID] = make([]*types.Message, 0)
+	}
+	order := append(deduplicator.order[message.Origin], message.ID)
+	if len(order) > deduplicator.window {
+		delete(seen, order[0])
+		order = order[1:]
+	}
+	deduplicator.order[message.Origin] = order
+	return false, false
+}
+
+// Processed records that the result has been processed, and returns the duplicates of it that were held back
+func (deduplicator *Deduplicator) Processed(message *types.Message) []*types.Message {
+	deduplicator.mutex.Lock()
+	defer deduplicator.mutex.Unlock()
+	pending := deduplicator.pending[message.Origin]
+	duplicates := pending[message.ID]
+	delete(pending, message.ID)
+	return duplicates
+}
+
+// registerAcknowledger records the acknowledger of the connection from the given previous worker. The first time a
+// previous worker is seen, the room in the input queue is shared out again between all of them.
+func registerAcknowledger(sender string, acknowledger *Acknowledger) {
+	acknowledgersMutex.Lock()
+	if acknowledgers[sender] == acknowledger {
+		acknowledgersMutex.Unlock()
+		return
+	}
+	acknowledgers[sender] = acknowledger
+	credits, round, recipients := shareCredits()
+	acknowledgersMutex.Unlock()
+	grantCredits(credits, round, recipients)
+}
+
+// forgetAcknowledger forgets the acknowledger of a connection from a previous worker once the connection is closed,
+// and shares out its room in the input queue between the remaining previous workers
+func forgetAcknowledger(acknowledger *Acknowledger) {
+	acknowledgersMutex.Lock()
+	for sender, registered := range acknowledgers {
+		if registered == acknowledger {
+			delete(acknowledgers, sender)
+		}
+	}
+	credits, round, recipients := shareCredits()
+	acknowledgersMutex.Unlock()
+	grantCredits(credits, round, recipients)
+}
+
+// shareCredits shares the room in the input queue out evenly between the previous workers, so that together they
+// never have more unacknowledged results than the queue can hold. Every previous worker gets at least one credit, so
+// that none of them is starved. Returns the credits of every previous worker, the round they were computed in, and
+// the acknowledgers to grant them to. Must be called with acknowledgersMutex locked.
+func shareCredits() (credits int, round uint64, recipients []*Acknowledger) {
+	creditRound++
+	recipients = make([]*Acknowledger, 0, len(acknowledgers))
+	for _, acknowledger := range acknowledgers {
+		recipients = append(recipients, acknowledger)
+	}
+	if len(recipients) == 0 {
+		return 0, creditRound, recipients
+	}
+	credits = queueCapacity / len(recipients)
+	if credits < 1 {
+		credits = 1
+	}
+	return credits, creditRound, recipients
+}
+
+// grantCredits sends the credits shared out by shareCredits to the previous workers. It is called with
+// acknowledgersMutex unlocked, so that a previous worker that is slow to read does not hold up the others.
+func grantCredits(credits int, round uint64, recipients []*Acknowledger) {
+	for _, acknowledger := range recipients {
+		acknowledger.Grant(credits, round)
+	}
+}
+
+// receiveResult pushes a result received from a previous worker into the input queue, unless it is a duplicate. Since
+// the previous worker is still waiting for its acknowledgement, a duplicate is acknowledged straight away if the
+// original has already been processed, and along with the original otherwise. The first result received along a
+// connection grants the previous worker its share of the room in the input queue.
+func receiveResult(acknowledger *Acknowledger, queue *Queue, message *types.Message) {
+	registerAcknowledger(message.Sender, acknowledger)
+	if duplicate, held := deduplicator.IsDuplicate(message); duplicate {
+		WorkerStatistics.AddDuplicate()
+		if !held {
+			acknowledger.Acknowledge([]uint64{message.ID})
+		}
+		logPrint("Ignored a duplicate input from " + message.Sender)
+		return
+	}
+	pushInput(queue, message)
+}
+
+// acknowledgeInputs tells the previous workers that the given inputs have been processed, along with the duplicates of
+// the inputs that were held back while they were being processed
+func acknowledgeInputs(messages []*types.Message) {
+	messageIDs := make(map[string][]uint64)
+	for _, message := range messages {
+		messageIDs[message.Sender] = append(messageIDs[message.Sender], message.ID)
+		for _, duplicate := range deduplicator.Processed(message) {
+			messageIDs[duplicate.Sender] = append(messageIDs[duplicate.Sender], duplicate.ID)
+		}
+	}
+	for sender, ids := range messageIDs {
+		acknowledgersMutex.Lock()
+		acknowledger := acknowledgers[sender]
+		acknowledgersMutex.Unlock()
+		if acknowledger != nil {
+			acknowledger.Acknowledge(ids)
+		}
+	}
+}
+
+// delivery waits for the next workers to acknowledge every copy of the results derived from a group of inputs, and
+// then calls onDelivered. It counts one pending acknowledgement per result until the result has been sent, so that it
+// cannot complete while copies of a result are still being sent. The methods do nothing on a nil delivery.
+type delivery struct {
+	remaining   int         // The number of acknowledgements still expected, plus the number of results not sent yet
+	onDelivered func()      // Called once every acknowledgement has been received
+	mutex       *sync.Mutex // For concurrency stuff
+}
+
+// newDelivery creates a delivery for the given number of results. If there are no results, onDelivered is called
+// straight away.
+func newDelivery(numResults int, onDelivered func()) *delivery {
+	delivery := new(delivery)
+	delivery.remaining = numResults
+	delivery.onDelivered = onDelivered
+	delivery.mutex = &sync.Mutex{}
+	if numResults == 0 {
+		onDelivered()
+	}
+	return delivery
+}
+
+// expect adds the given number of copies of a result, about to be sent, to the acknowledgements expected
+func (delivery *delivery) expect(numCopies int) {
+	if delivery == nil {
+		return
+	}
+	delivery.mutex.Lock()
+	delivery.remaining += numCopies
+	delivery.mutex.Unlock()
+}
+
+// acknowledged records that a copy of a result was acknowledged, or that every copy of a result has been sent
+func (delivery *delivery) acknowledged() {
+	if delivery == nil {
+		return
+	}
+	delivery.mutex.Lock()
+	delivery.remaining--
+	done := delivery.remaining == 0
+	delivery.mutex.Unlock()
+	if done {
+		delivery.onDelivered()
+	}
+}
@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// TestDeduplicator checks that a result is recognized as a duplicate by its origin and ID, whichever worker sent it
+func TestDeduplicator(t *testing.T) {
+	first := types.SourceID(0, "source", 0)
+	second := types.SourceID(0, "source", 1)
+	tests := []struct {
+		name     string          // The name of the test case
+		messages []types.Message // The results received, in order
+		want     []bool          // Whether each result should be recognized as a duplicate
+	}{
+		{"distinct", []types.Message{{Origin: "source", ID: first}, {Origin: "source", ID: second}},
+			[]bool{false, false}},
+		{"replayed", []types.Message{{Sender: "a", Origin: "source", ID: first},
+			{Sender: "a", Origin: "source", ID: first}}, []bool{false, true}},
+		{"sent again by a replacement", []types.Message{{Sender: "a", Origin: "source", ID: first},
+			{Sender: "b", Origin: "source", ID: first}}, []bool{false, true}},
+		{"same ID from another origin", []types.Message{{Origin: "source", ID: first},
+			{Origin: "other", ID: first}}, []bool{false, false}},
+		{"forgotten outside the window", []types.Message{{Origin: "source", ID: first},
+			{Origin: "source", ID: second}, {Origin: "source", ID: types.SourceID(0, "source", 2)},
+			{Origin: "source", ID: first}}, []bool{false, false, false, false}},
+	}
+	for _, test := range tests {
+		deduplicator := NewDeduplicator(2)
+		for index := range test.messages {
+			if got, _ := deduplicator.IsDuplicate(&test.messages[index]); got != test.want[index] {
+				t.Errorf("%s: result %d: got duplicate %v, want %v", test.name, index, got, test.want[index])
+			}
+		}
+	}
+}
+
+// TestDeduplicatorHoldsDuplicates checks that a duplicate received while the original is still being processed is only
+// released once the original has been processed, while a duplicate received afterwards can be acknowledged at once
+func TestDeduplicatorHoldsDuplicates(t *testing.T) {
+	deduplicator := NewDeduplicator(10)
+	id := types.SourceID(0, "source", 0)
+	original := &types.Message{Sender: "failed", Origin: "source", ID: id}
+	replayed := &types.Message{Sender: "replacement", Origin: "source", ID: id}
+	late := &types.Message{Sender: "replacement", Origin: "source", ID: id}
+	if duplicate, held := deduplicator.IsDuplicate(original); duplicate || held {
+		t.Fatalf("original: got duplicate %v and held %v, want neither", duplicate, held)
+	}
+	if duplicate, held := deduplicator.IsDuplicate(replayed); !duplicate || !held {
+		t.Fatalf("replayed while processing: got duplicate %v and held %v, want both", duplicate, held)
+	}
+	released := deduplicator.Processed(original)
+	if len(released) != 1 || released[0] != replayed {
+		t.Fatalf("got %d duplicates released with the original, want the replayed one", len(released))
+	}
+	if duplicate, held := deduplicator.IsDuplicate(late); !duplicate || held {
+		t.Errorf("replayed after processing: got duplicate %v and held %v, want a duplicate that is not held",
+			duplicate, held)
+	}
+	if released = deduplicator.Processed(original); len(released) != 0 {
+		t.Errorf("got %d duplicates released twice", len(released))
+	}
+}
+
+// TestDerivedIDs checks that the results derived from an input get IDs that are stable, and distinct from each other,
+// from the input's, and from those of the same results derived along another branch of the pipeline
+func TestDerivedIDs(t *testing.T) {
+	input := types.SourceID(0, "source", 7)
+	ids := map[uint64]string{input: "input"}
+	tests := []struct {
+		name     string // The name of the test case
+		position int    // The position of the stage deriving the result
+		index    int    // The index of the result among those derived from the input
+		count    int    // The number of results derived from the input. 0 for a skip
+	}{
+		{"only result", 1, 0, 1},
+		{"first of two", 1, 0, 2},
+		{"second of two", 1, 1, 2},
+		{"skip", 1, 0, 0},
+		{"other branch", 2, 0, 1},
+	}
+	for _, test := range tests {
+		id := types.DerivedID(test.position, input, test.index, test.count)
+		if id != types.DerivedID(test.position, input, test.index, test.count) {
+			t.Errorf("%s: the ID changed when derived again", test.name)
+		}
+		if other, ok := ids[id]; ok {
+			t.Errorf("%s: got the same ID as %s", test.name, other)
+		}
+		ids[id] = test.name
+	}
+}
+
+// TestDelivery checks that the inputs are only acknowledged once every copy of every result derived from them has been
+// sent and acknowledged
+func TestDelivery(t *testing.T) {
+	tests := []struct {
+		name       string // The name of the test case
+		numResults int    // The number of results derived from the inputs
+		numCopies  int    // The number of copies sent of each result
+	}{
+		{"no results", 0, 1},
+		{"one result", 1, 1},
+		{"fan out", 1, 3},
+		{"flat map", 4, 2},
+	}
+	for _, test := range tests {
+		delivered := 0
+		delivery := newDelivery(test.numResults, func() { delivered++ })
+		for result := 0; result < test.numResults; result++ {
+			delivery.expect(test.numCopies)
+			delivery.acknowledged()
+		}
+		for copies := 0; copies < test.numResults*test.numCopies; copies++ {
+			if delivered != 0 {
+				t.Errorf("%s: delivered with %d acknowledgements missing", test.name,
+					test.numResults*test.numCopies-copies)
+			}
+			delivery.acknowledged()
+		}
+		if delivered != 1 {
+			t.Errorf("%s: delivered %d times, want once", test.name, delivered)
+		}
+	}
+}
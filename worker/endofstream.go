@@ -0,0 +1,129 @@
+package worker
+
+import (
+	"os"
+	"sync"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// EndOfStreamTracker keeps track of the end-of-stream markers received from the workers of the previous stage. The
+// master tells the tracker which previous workers to expect markers from once every one of them has finished. Since
+// the markers are sent along the same connections as the results, the stream has been fully received once every
+// expected marker has arrived.
+type EndOfStreamTracker struct {
+	received  map[string]bool // The IDs of the previous workers whose markers have been received
+	expected  []string        // The IDs of the previous workers to expect markers from. nil until the master sends them
+	completed bool            // Whether the end of the stream has already been pushed to the queue
+	queue     *Queue          // The queue into which to push the end of the stream
+	mutex     *sync.Mutex     // For concurrency stuff
+}
+
+// NewEndOfStreamTracker creates a tracker that pushes the end of the stream into the given queue
+func NewEndOfStreamTracker(queue *Queue) *EndOfStreamTracker {
+	tracker := new(EndOfStreamTracker)
+	tracker.received = make(map[string]bool)
+	tracker.expected = nil
+	tracker.completed = false
+	tracker.queue = queue
+	tracker.mutex = &sync.Mutex{}
+	return tracker
+}
+
+// MarkerReceived records the end-of-stream marker sent by the previous worker with the given ID
+func (tracker *EndOfStreamTracker) MarkerReceived(senderID string) {
+	tracker.mutex.Lock()
+	tracker.received[senderID] = true
+	tracker.checkCompletion()
+	tracker.mutex.Unlock()
+}
+
+// Expect records the IDs of the previous workers to expect end-of-stream markers from
+func (tracker *EndOfStreamTracker) Expect(senderIDs []string) {
+	tracker.mutex.Lock()
+	tracker.expected = senderIDs
+	if tracker.expected == nil {
+		tracker.expected = make([]string, 0)
+	}
+	tracker.checkCompletion()
+	tracker.mutex.Unlock()
+}
+
+// checkCompletion pushes the end of the stream into the queue if every expected marker has been received. Must be
+// called with the mutex locked.
+func (tracker *EndOfStreamTracker) checkCompletion() {
+	if tracker.completed || tracker.expected == nil {
+		return
+	}
+	for _, senderID := range tracker.expected {
+		if tracker.received[senderID] == false {
+			return
+		}
+	}
+	tracker.completed = true
+	if reorderBuffer != nil {
+		reorderBuffer.Flush()
+	}
+	tracker.queue.Push(types.EndOfStream)
+	logPrint("Received the end of the stream from every previous worker")
+}
+
+// handleEndOfStreamMessage passes end-of-stream related messages to the tracker. Returns false if the message is not
+// related to the end of the stream.
+func handleEndOfStreamMessage(tracker *EndOfStreamTracker, message *types.Message) bool {
+	if message.Description == common.MsgEndOfStream {
+		tracker.MarkerReceived(message.Sender)
+		barriers.Finished(message.Sender)
+		logPrint("Received end of stream from " + message.Sender)
+		return true
+	}
+	if message.Description == common.MsgDrainStage {
+		expected, _ := (message.Contents).([]string)
+		tracker.Expect(expected)
+		logPrint("Received drain message from master")
+		return true
+	}
+	return false
+}
+
+// newEndOfStreamMessage creates the marker that is sent to the next workers after the last result
+func newEndOfStreamMessage(myID string) *types.Message {
+	message := new(types.Message)
+	message.Sender = myID
+	message.Description = common.MsgEndOfStream
+	return message
+}
+
+// finishStream waits until every result sent to the next workers has been acknowledged, sends them the end of the
+// stream, closes the connections to them, notifies the master that this worker is done, and exits
+func finishStream(myID string) {
+	connections.WaitForAcknowledgements()
+	if err := connections.Broadcast(newEndOfStreamMessage(myID)); err != nil {
+		logMessage(err.Error())
+	}
+	connections.CloseAll()
+	notifyMasterOfCompletion(myID, nil)
+	logPrint("Sent end of stream to the next stage")
+	os.Exit(0)
+}
+
+// notifyMasterOfCompletion tells the master that this worker has processed the end of the stream. If resultConnection
+// is not nil, the notification is sent through it so that it reaches the master after the last result. Otherwise, or
+// if it cannot be sent through it, it is sent along the control session.
+func notifyMasterOfCompletion(myID string, resultConnection *Connection) {
+	if resultConnection == nil {
+		sendToMaster(common.MsgStageDone, nil)
+		control.Close()
+		return
+	}
+	message := new(types.Message)
+	message.Sender = myID
+	message.Description = common.MsgStageDone
+	defer resultConnection.Close()
+	if err := resultConnection.Con.Encode(message); err != nil {
+		logMessage("Could not notify the master through the result connection: " + err.Error())
+		sendToMaster(common.MsgStageDone, nil)
+		control.Close()
+	}
+}
@@ -0,0 +1,183 @@
+package worker
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// panicPolicy is applied to inputs that make a stage without an ErrorFunction or an ErrorPolicy panic
+var panicPolicy = types.ErrorPolicy{MaxRetries: 0, Backoff: 0, OnFailure: types.DeadLetterOnError}
+
+// callStageFunction calls the stage's function on the given input, and returns its outputs. Errors returned by the
+// stage's ErrorFunction are retried and then handled according to the stage's ErrorPolicy. A panic in an
+// ErrorFunction is treated like an error, while a panic in any other function is handled according to the stage's
+// ErrorPolicy without being retried, or sends the input to the master's dead-letter store if the stage has none. No
+// outputs are returned for an input that could not be processed.
+func callStageFunction(stage *types.StageDefinition, stageID string, input interface{}) (outputs []interface{}) {
+	if stage.FilterFunction != nil {
+		keep, stackTrace, err := callAndRecover(func() (interface{}, error) {
+			return stage.FilterFunction(input), nil
+		})
+		if err == nil {
+			if keep.(bool) {
+				return []interface{}{input}
+			}
+			return []interface{}{types.Drop}
+		}
+		WorkerStatistics.AddFailure()
+		failure := newStageFailure(stageID, input, err, stackTrace, 1)
+		handleStageFailure(stageErrorPolicy(stage), failure)
+		return nil
+	}
+	if stage.FlatMapFunction != nil {
+		outputs, stackTrace, err := callFlatMapAndRecover(stage.FlatMapFunction, input)
+		if err == nil {
+			return outputs
+		}
+		WorkerStatistics.AddFailure()
+		failure := newStageFailure(stageID, input, err, stackTrace, 1)
+		handleStageFailure(stageErrorPolicy(stage), failure)
+		return nil
+	}
+	if stage.StatefulFunc != nil {
+		stateMutex.Lock()
+		result, stackTrace, err := callAndRecover(func() (interface{}, error) {
+			return stage.StatefulFunc(input, stageState), nil
+		})
+		stateMutex.Unlock()
+		if err == nil {
+			return []interface{}{result}
+		}
+		WorkerStatistics.AddFailure()
+		failure := newStageFailure(stageID, input, err, stackTrace, 1)
+		handleStageFailure(stageErrorPolicy(stage), failure)
+		return nil
+	}
+	if stage.ErrorFunction == nil {
+		result, stackTrace, err := callAndRecover(func() (interface{}, error) {
+			return stage.Function(input), nil
+		})
+		if err == nil {
+			return []interface{}{result}
+		}
+		WorkerStatistics.AddFailure()
+		failure := newStageFailure(stageID, input, err, stackTrace, 1)
+		handleStageFailure(stageErrorPolicy(stage), failure)
+		return nil
+	}
+	policy := stage.ErrorPolicy
+	if policy == nil {
+		policy = &types.DefaultErrorPolicy
+	}
+	errorFunction := func() (interface{}, error) {
+		return stage.ErrorFunction(input)
+	}
+	result, stackTrace, err := callAndRecover(errorFunction)
+	attempts := 1
+	for err != nil && attempts <= policy.MaxRetries {
+		WorkerStatistics.AddRetry()
+		time.Sleep(policy.RetryDelay(attempts))
+		result, stackTrace, err = callAndRecover(errorFunction)
+		attempts++
+	}
+	if err == nil {
+		return []interface{}{result}
+	}
+	WorkerStatistics.AddFailure()
+	failure := newStageFailure(stageID, input, err, stackTrace, attempts)
+	handleStageFailure(policy, failure)
+	return nil
+}
+
+// callBatchFunction calls the stage's BatchFunction on a batch of inputs, and returns its outputs. A panic handles the
+// whole batch according to the stage's ErrorPolicy, in which case no outputs are returned.
+func callBatchFunction(stage *types.StageDefinition, stageID string, inputs []interface{}) (outputs []interface{}) {
+	result, stackTrace, err := callAndRecover(func() (interface{}, error) {
+		return stage.BatchFunction(inputs), nil
+	})
+	if err == nil {
+		outputs, _ = result.([]interface{})
+		return outputs
+	}
+	WorkerStatistics.AddFailure()
+	failure := newStageFailure(stageID, inputs, err, stackTrace, 1)
+	handleStageFailure(stageErrorPolicy(stage), failure)
+	return nil
+}
+
+// callAndRecover calls the given function, recovering from any panic inside it. A panic is returned as an error, along
+// with the stack trace of the goroutine at the time of the panic.
+func callAndRecover(function func() (interface{}, error)) (result interface{}, stackTrace string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			WorkerStatistics.AddPanic()
+			result = nil
+			stackTrace = string(debug.Stack())
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	result, err = function()
+	return
+}
+
+// callFlatMapAndRecover calls the given emitter-style function, and collects the outputs it emits. If the function
+// panics, the outputs emitted before the panic are discarded, and the panic is returned as an error.
+func callFlatMapAndRecover(function types.FlatMapFunc, input interface{}) (outputs []interface{}, stackTrace string,
+	err error) {
+	_, stackTrace, err = callAndRecover(func() (interface{}, error) {
+		function(input, func(output interface{}) {
+			outputs = append(outputs, output)
+		})
+		return nil, nil
+	})
+	if err != nil {
+		outputs = nil
+	}
+	return
+}
+
+// stageErrorPolicy returns the error policy of the stage, or panicPolicy if the stage has none
+func stageErrorPolicy(stage *types.StageDefinition) *types.ErrorPolicy {
+	if stage.ErrorPolicy != nil {
+		return stage.ErrorPolicy
+	}
+	return &panicPolicy
+}
+
+// newStageFailure creates the description of an input that this worker failed to process
+func newStageFailure(stageID string, input interface{}, err error, stackTrace string, attempts int) *types.StageFailure {
+	failure := new(types.StageFailure)
+	failure.WorkerID = stageID
+	failure.Position = stagePosition
+	failure.Input = input
+	failure.Error = err.Error()
+	failure.StackTrace = stackTrace
+	failure.Attempts = attempts
+	return failure
+}
+
+// handleStageFailure applies the error policy's OnFailure action to a failed input
+func handleStageFailure(policy *types.ErrorPolicy, failure *types.StageFailure) {
+	logMessage("Failed to process input: " + failure.String())
+	if policy.OnFailure == types.SkipOnError {
+		return
+	}
+	if policy.OnFailure == types.DeadLetterOnError {
+		sendFailureToMaster(failure, common.MsgStageFailure)
+		return
+	}
+	sendFailureToMaster(failure, common.MsgAbortPipeline)
+	logMessage("Aborting the pipeline")
+	os.Exit(1)
+}
+
+// sendFailureToMaster sends a failed input to the master along the control session, either to be stored as a dead
+// letter or to abort the pipeline
+func sendFailureToMaster(failure *types.StageFailure, description int) {
+	sendToMaster(description, failure)
+}
@@ -0,0 +1,36 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// TestPanicFollowsStagePolicy checks that a panic in a filter, flat-map, stateful or batch function is handled with
+// the stage's own error policy. With SkipOnError the input is only counted as a failure; the default policy would
+// instead send it to the master, which this test does not have.
+func TestPanicFollowsStagePolicy(t *testing.T) {
+	skip := types.ErrorPolicy{OnFailure: types.SkipOnError}
+	panics := func() { panic("bad input") }
+	stages := map[string]*types.StageDefinition{
+		"filter":   {FilterFunction: func(interface{}) bool { panics(); return true }},
+		"flat-map": {FlatMapFunction: func(interface{}, types.Emitter) { panics() }},
+		"stateful": {StatefulFunc: func(interface{}, *types.StateStore) interface{} { panics(); return nil }},
+	}
+	for kind, stage := range stages {
+		stage.OnError(skip)
+		failures := WorkerStatistics.Copy().Failures
+		if outputs := callStageFunction(stage, "test", 1); outputs != nil {
+			t.Errorf("%s: got outputs %v for an input that panicked", kind, outputs)
+		}
+		if WorkerStatistics.Copy().Failures != failures+1 {
+			t.Errorf("%s: the failure was not counted", kind)
+		}
+	}
+	batch := new(types.StageDefinition)
+	batch.BatchFunction = func([]interface{}) []interface{} { panics(); return nil }
+	batch.OnError(skip)
+	if outputs := callBatchFunction(batch, "test", []interface{}{1, 2}); outputs != nil {
+		t.Errorf("batch: got outputs %v for a batch that panicked", outputs)
+	}
+}
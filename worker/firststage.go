@@ -1,9 +1,7 @@
 package worker
 
 import (
-	"encoding/gob"
-	"net"
-	"strconv"
+	"sync"
 
 	"github.com/ffrankies/gopipeline/internal/common"
 	"github.com/ffrankies/gopipeline/types"
@@ -11,53 +9,118 @@ import (
 
 var waitingForStartPipelineMessage = true
 
-// runFirstStage runs the function of a worker running the first stage
-func runFirstStage(listener net.Listener, functionList []types.AnyFunc, myID string, registerType interface{}, masterAddress string) {
-	go receiveMessages(listener)
-	setUpSignalHandler(nil, nil, masterAddress)
+// progress keeps track of the items of this source stage worker whose results the next workers have acknowledged
+var progress = newSourceProgress()
+
+// sourceProgress finds the first item of a source stage worker whose results the next workers have not all
+// acknowledged yet. The master resumes the stream from that item if the worker fails.
+type sourceProgress struct {
+	next      uint64          // Every item before this one has been acknowledged
+	delivered map[uint64]bool // The items after next that have been acknowledged
+	mutex     *sync.Mutex     // For concurrency stuff
+}
+
+// newSourceProgress creates the progress of a source stage worker that has not produced any items yet
+func newSourceProgress() *sourceProgress {
+	progress := new(sourceProgress)
+	progress.next = 0
+	progress.delivered = make(map[uint64]bool)
+	progress.mutex = &sync.Mutex{}
+	return progress
+}
+
+// start records that every item before the given one counts as acknowledged, since it is not sent on
+func (progress *sourceProgress) start(sequence uint64) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.next = sequence
+	WorkerStatistics.UpdateDelivered(progress.next)
+}
+
+// acknowledged records that the results of the item with the given sequence number have all been acknowledged
+func (progress *sourceProgress) acknowledged(sequence uint64) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	if sequence < progress.next {
+		return
+	}
+	progress.delivered[sequence] = true
+	for progress.delivered[progress.next] {
+		delete(progress.delivered, progress.next)
+		progress.next++
+	}
+	WorkerStatistics.UpdateDelivered(progress.next)
+}
+
+// runFirstStage runs the function of a worker running a source stage. Every output is numbered in the order it was
+// produced in, and sent to every downstream stage. When the master starts a checkpoint, a barrier is sent to every
+// next worker between two calls of the function. When a checkpoint is restored, or the worker replaces a failed one,
+// the outputs produced before the point to resume from are dropped. A worker replacing a failed one numbers its
+// outputs under the failed worker's ID. Once the function returns EndOfStream, the end of the stream is sent to the
+// downstream stages and the worker exits.
+func runFirstStage(stage *types.StageDefinition, myID string) {
+	control.Serve(handleSourceCommand)
+	setUpSignalHandler(nil, nil)
 	for waitingForStartPipelineMessage {
 		// Busy wait lol
 	}
+	waitForState()
+	origin := myID
+	if restoredOrigin != "" {
+		origin = restoredOrigin
+	}
+	progress.start(restoredSequence)
+	var sequence uint64
 	for {
-		gob.Register(registerType)
-		message := executeStage(functionList, 0, myID, nil)
-		encoder := connections.Select()
-		if err := encoder.Encode(message); err != nil {
-			logMessage(err.Error())
-			break
+		for _, message := range executeStage(stage, myID, nil) {
+			if message.Contents == types.EndOfStream {
+				logPrint("Source is exhausted")
+				finishStream(myID)
+			}
+			message.Origin = origin
+			message.Sequence = sequence
+			message.ID = types.SourceID(stagePosition, origin, sequence)
+			sequence++
+			if message.Sequence < restoredSequence {
+				continue
+			}
+			delivered := message.Sequence
+			err := connections.SendToAll(message, newDelivery(1, func() { progress.acknowledged(delivered) }))
+			if err != nil {
+				logMessage("Could not send computation results to next stage: " + err.Error())
+				return
+			}
+			logPrint("Sent computation results to next stage")
 		}
-		logPrint("Sent computation results to next stage")
+		passOnBarriers(myID, sequence)
 	}
 }
 
-// receiveMessage receives messages from the listener
-func receiveMessages(listener net.Listener) {
+// passOnBarriers sends the barriers of the checkpoints started by the master to every next worker, and takes a
+// snapshot for each of them. Outputs that are still being dropped after a restore count as sent.
+func passOnBarriers(myID string, sequence uint64) {
+	if sequence < restoredSequence {
+		sequence = restoredSequence
+	}
 	for {
-		message := new(types.Message)
-		connection, err := listener.Accept()
-		if err != nil {
-			panic(err)
-		}
-		decoder := gob.NewDecoder(connection)
-		decoder.Decode(message)
-		if message.Description == common.MsgAddNextStageAddr {
-			nextNodeAddress := (message.Contents).(string)
-			connections.AddConnection(nextNodeAddress)
-			logPrint("Received next node address")
-			continue
-		}
-		if message.Description == common.MsgStartWorker {
-			waitingForStartPipelineMessage = false
-			logPrint("Received start pipeline message")
-			continue
+		select {
+		case checkpointID := <-sourceBarriers:
+			takeSnapshot(checkpointID, sequence)
+			if err := connections.Broadcast(newBarrierMessage(myID, checkpointID)); err != nil {
+				logMessage(err.Error())
+			}
+		default:
+			return
 		}
-		if message.Description == common.MsgBreakConnection {
-			addressToRemove := (message.Contents).(string)
-			connections.RemoveConnection(addressToRemove)
-			logPrint("Removed the worker from the list of connections")
-			continue
-		}
-		logMessage("Received invalid message from " + message.Sender + " of type: " + strconv.Itoa(message.Description))
-		connection.Close()
 	}
 }
+
+// handleSourceCommand handles a command sent by the master to a worker running a source stage
+func handleSourceCommand(message *types.Message) bool {
+	if message.Description == common.MsgStartWorker {
+		waitingForStartPipelineMessage = false
+		logPrint("Received start pipeline message")
+		return true
+	}
+	return handleCommand(message, nil)
+}
@@ -0,0 +1,35 @@
+package worker
+
+import "testing"
+
+// TestSourceProgress checks that the point to resume a source stage worker's stream from only moves past items whose
+// results have all been acknowledged
+func TestSourceProgress(t *testing.T) {
+	tests := []struct {
+		name         string   // The name of the test case
+		start        uint64   // The item the worker started sending from
+		acknowledged []uint64 // The items acknowledged, in order
+		want         uint64   // The expected point to resume from
+	}{
+		{"nothing acknowledged", 0, nil, 0},
+		{"in order", 0, []uint64{0, 1, 2}, 3},
+		{"gap", 0, []uint64{0, 2, 3}, 1},
+		{"gap filled", 0, []uint64{1, 2, 0}, 3},
+		{"resumed", 5, []uint64{5, 6}, 7},
+		{"before the start", 5, []uint64{3, 5}, 6},
+	}
+	for _, test := range tests {
+		progress := newSourceProgress()
+		progress.start(test.start)
+		for _, sequence := range test.acknowledged {
+			progress.acknowledged(sequence)
+		}
+		if progress.next != test.want {
+			t.Errorf("%s: resume from %d, want %d", test.name, progress.next, test.want)
+		}
+		if WorkerStatistics.Copy().Delivered != test.want {
+			t.Errorf("%s: reported %d delivered items, want %d", test.name, WorkerStatistics.Copy().Delivered,
+				test.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// virtualNodesPerWorker is the number of points each worker occupies on the hash ring. More points spread the keys
+// more evenly between the workers.
+const virtualNodesPerWorker = 128
+
+// HashRing maps keys to worker addresses using consistent hashing. When a worker is added or removed, only the keys
+// that map to its points on the ring move to a different worker; every other key keeps its worker.
+type HashRing struct {
+	points    []uint32          // The sorted hashes of every virtual node on the ring
+	addresses map[uint32]string // The address of the worker owning each virtual node
+	mutex     *sync.Mutex       // For concurrency stuff
+}
+
+// NewHashRing creates a new empty hash ring
+func NewHashRing() *HashRing {
+	hashRing := new(HashRing)
+	hashRing.points = make([]uint32, 0)
+	hashRing.addresses = make(map[uint32]string)
+	hashRing.mutex = &sync.Mutex{}
+	return hashRing
+}
+
+// hashKey hashes a key or virtual node name onto the ring
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// Add places the virtual nodes of the worker with the given address on the ring
+func (hashRing *HashRing) Add(address string) {
+	hashRing.mutex.Lock()
+	defer hashRing.mutex.Unlock()
+	for replica := 0; replica < virtualNodesPerWorker; replica++ {
+		point := hashKey(address + "#" + strconv.Itoa(replica))
+		if _, taken := hashRing.addresses[point]; taken {
+			continue
+		}
+		hashRing.addresses[point] = address
+		hashRing.points = append(hashRing.points, point)
+	}
+	sort.Slice(hashRing.points, func(i, j int) bool { return hashRing.points[i] < hashRing.points[j] })
+}
+
+// Remove takes the virtual nodes of the worker with the given address off the ring
+func (hashRing *HashRing) Remove(address string) {
+	hashRing.mutex.Lock()
+	defer hashRing.mutex.Unlock()
+	points := make([]uint32, 0, len(hashRing.points))
+	for _, point := range hashRing.points {
+		if hashRing.addresses[point] == address {
+			delete(hashRing.addresses, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	hashRing.points = points
+}
+
+// Get returns the address of the worker responsible for the given key, i.e. the owner of the first virtual node at or
+// after the key's hash. Returns false if the ring is empty.
+func (hashRing *HashRing) Get(key string) (address string, ok bool) {
+	hashRing.mutex.Lock()
+	defer hashRing.mutex.Unlock()
+	if len(hashRing.points) == 0 {
+		return "", false
+	}
+	hash := hashKey(key)
+	index := sort.Search(len(hashRing.points), func(i int) bool { return hashRing.points[i] >= hash })
+	if index == len(hashRing.points) {
+		index = 0
+	}
+	return hashRing.addresses[hashRing.points[index]], true
+}
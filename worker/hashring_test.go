@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"strconv"
+	"testing"
+)
+
+// hashRingTestKeys returns the given number of distinct keys
+func hashRingTestKeys(numKeys int) []string {
+	keys := make([]string, numKeys)
+	for index := range keys {
+		keys[index] = "key" + strconv.Itoa(index)
+	}
+	return keys
+}
+
+// TestHashRingDistribution checks that the keys are spread over every worker on the ring, with no worker getting much
+// more or much less than its share
+func TestHashRingDistribution(t *testing.T) {
+	keys := hashRingTestKeys(10000)
+	tests := []struct {
+		name       string // The name of the test case
+		numWorkers int    // The number of workers on the ring
+	}{
+		{"one worker", 1},
+		{"two workers", 2},
+		{"five workers", 5},
+		{"ten workers", 10},
+	}
+	for _, test := range tests {
+		hashRing := NewHashRing()
+		for worker := 0; worker < test.numWorkers; worker++ {
+			hashRing.Add("10.0.0." + strconv.Itoa(worker) + ":5000")
+		}
+		counts := make(map[string]int)
+		for _, key := range keys {
+			address, ok := hashRing.Get(key)
+			if !ok {
+				t.Fatalf("%s: no worker found for %s", test.name, key)
+			}
+			counts[address]++
+		}
+		if len(counts) != test.numWorkers {
+			t.Errorf("%s: keys went to %d workers, want %d", test.name, len(counts), test.numWorkers)
+		}
+		share := len(keys) / test.numWorkers
+		for address, count := range counts {
+			if count < share/2 || count > share*2 {
+				t.Errorf("%s: %s got %d keys, want about %d", test.name, address, count, share)
+			}
+		}
+	}
+}
+
+// TestHashRingStability checks that adding or removing a worker only moves the keys that go to, or came from, that
+// worker
+func TestHashRingStability(t *testing.T) {
+	keys := hashRingTestKeys(10000)
+	tests := []struct {
+		name    string // The name of the test case
+		change  string // The address of the worker added or removed
+		removed bool   // Whether the worker is removed rather than added
+	}{
+		{"add a worker", "10.0.0.9:5000", false},
+		{"remove a worker", "10.0.0.2:5000", true},
+	}
+	for _, test := range tests {
+		hashRing := NewHashRing()
+		for worker := 0; worker < 4; worker++ {
+			hashRing.Add("10.0.0." + strconv.Itoa(worker) + ":5000")
+		}
+		before := make(map[string]string)
+		for _, key := range keys {
+			before[key], _ = hashRing.Get(key)
+		}
+		if test.removed {
+			hashRing.Remove(test.change)
+		} else {
+			hashRing.Add(test.change)
+		}
+		moved := 0
+		for _, key := range keys {
+			after, _ := hashRing.Get(key)
+			if after == before[key] {
+				continue
+			}
+			moved++
+			if test.removed && before[key] != test.change {
+				t.Errorf("%s: %s moved from %s, which is still on the ring", test.name, key, before[key])
+			}
+			if !test.removed && after != test.change {
+				t.Errorf("%s: %s moved to %s instead of the new worker", test.name, key, after)
+			}
+		}
+		if moved == 0 {
+			t.Errorf("%s: no key moved", test.name)
+		}
+	}
+}
+
+// TestHashRingEmpty checks that an empty ring, or a ring whose every worker was removed, has no worker for any key
+func TestHashRingEmpty(t *testing.T) {
+	hashRing := NewHashRing()
+	if _, ok := hashRing.Get("key"); ok {
+		t.Errorf("a new ring returned a worker")
+	}
+	hashRing.Add("10.0.0.1:5000")
+	hashRing.Remove("10.0.0.1:5000")
+	if _, ok := hashRing.Get("key"); ok {
+		t.Errorf("a ring whose only worker was removed returned a worker")
+	}
+}
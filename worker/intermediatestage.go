@@ -1,53 +1,60 @@
 package worker
 
 import (
-	"encoding/gob"
 	"net"
 
 	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
 
 	"github.com/ffrankies/gopipeline/types"
 )
 
 // runIntermediateStage runs the function of a worker running an intermediate stage
-func runIntermediateStage(listener net.Listener, functionList []types.AnyFunc, myID string, position int,
-	registerType interface{}, masterAddress string) {
+func runIntermediateStage(listener net.Listener, stage *types.StageDefinition, myID string) {
 
-	inputQueue := makeQueue()
-	outputQueue := makeQueue()
-	go executeAndSend(functionList, position, myID, inputQueue, outputQueue)
-	setUpSignalHandler(inputQueue, outputQueue, masterAddress)
+	inputQueue := makeQueue(queueCapacity, WorkerStatistics.AddInputBlockedTime)
+	outputQueue := makeQueue(queueCapacity, WorkerStatistics.AddOutputBlockedTime)
+	tracker := NewEndOfStreamTracker(inputQueue)
+	setUpReorderBuffer(stage, inputQueue)
+	barriers.SetQueue(inputQueue)
+	go executeAndSend(stage, myID, inputQueue, outputQueue)
+	setUpSignalHandler(inputQueue, outputQueue)
+	control.Serve(func(message *types.Message) bool {
+		return handleCommand(message, tracker)
+	})
 	for {
 		logPrint("Waiting for connection from whoever")
 		listenerConnection, err := listener.Accept()
 		if err != nil {
 			panic(err)
 		}
-		go handleConnection(listenerConnection, registerType, inputQueue)
+		go handleConnection(listenerConnection, inputQueue, tracker)
 	}
 }
 
-// handleConnection handles a connection from either previous worker or master
-func handleConnection(connection net.Conn, registerType interface{}, inputQueue *Queue) {
-	decoder := gob.NewDecoder(connection)
+// handleConnection handles a connection from a previous worker
+func handleConnection(networkConnection net.Conn, inputQueue *Queue, tracker *EndOfStreamTracker) {
+	connection, err := protocol.Server(networkConnection, protocol.DefaultFeatures())
+	if err != nil {
+		logMessage(err.Error())
+		return
+	}
+	defer connection.Close()
+	acknowledger := NewAcknowledger(connection)
+	defer forgetAcknowledger(acknowledger)
 	for {
-		input, messageDesc, err := decodeInput(decoder, registerType)
+		message, err := decodeInput(connection)
 		if err != nil {
 			break
 		}
-		if messageDesc == common.MsgStageResult {
-			inputQueue.Push(input)
-			WorkerStatistics.UpdateBacklog(inputQueue.GetLength())
+		if message.Description == common.MsgStageResult || message.Description == common.MsgSequenceSkip {
+			receiveResult(acknowledger, inputQueue, message)
 			logPrint("Received input from previous worker")
 		}
-		if messageDesc == common.MsgAddNextStageAddr {
-			connections.AddConnection(input.(string))
-			logPrint("Received new address from master")
+		if handleBarrierMessage(message) {
+			continue
 		}
-		if messageDesc == common.MsgBreakConnection {
-			addressToRemove := input.(string)
-			connections.RemoveConnection(addressToRemove)
-			logPrint("Removed the worker from the list of connections")
+		if handleEndOfStreamMessage(tracker, message) {
 			continue
 		}
 	}
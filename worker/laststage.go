@@ -1,36 +1,60 @@
 package worker
 
 import (
-	"encoding/gob"
 	"net"
+	"strconv"
 
 	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
 
 	"github.com/ffrankies/gopipeline/types"
 )
 
-// runLastStage runs the function of a worker running the last stage
-func runLastStage(listener net.Listener, functionList []types.AnyFunc, myID string, registerType interface{}, masterAddress string) {
-	queue := makeQueue()
-	go executeOnly(functionList, len(functionList)-1, myID, queue)
-	setUpSignalHandler(nil, queue, masterAddress)
+// runLastStage runs the function of a worker running the last stage. If sendResults is true, the results of the stage
+// are streamed back to the master over a single connection, encoded with the given codec and compressed as given.
+func runLastStage(listener net.Listener, stage *types.StageDefinition, myID string, masterAddress string,
+	sendResults bool, codec string, compression types.Compression) {
+	queue := makeQueue(queueCapacity, WorkerStatistics.AddInputBlockedTime)
+	tracker := NewEndOfStreamTracker(queue)
+	setUpReorderBuffer(stage, queue)
+	barriers.SetQueue(queue)
+	var resultConnection *Connection
+	if sendResults {
+		resultConnection = NewConnection(masterAddress, codec, compression)
+	}
+	go executeOnly(stage, myID, queue, resultConnection)
+	setUpSignalHandler(nil, queue)
+	control.Serve(func(message *types.Message) bool {
+		return handleCommand(message, tracker)
+	})
 	for {
-		connectionFromPreviousWorker, err := listener.Accept()
+		connection, err := listener.Accept()
 		if err != nil {
 			panic(err)
 		}
-		decoder := gob.NewDecoder(connectionFromPreviousWorker)
-		for {
-			input, messageDesc, err := decodeInput(decoder, registerType)
-			if err != nil {
-				break
-			}
-			if messageDesc == common.MsgStageResult {
-				queue.Push(input)
-				WorkerStatistics.UpdateBacklog(queue.GetLength())
-			} else {
-				logMessage("ERROR: Last stage received unexpected message: " + string(messageDesc))
-			}
+		go handleConnectionToLastStage(connection, queue, tracker)
+	}
+}
+
+// handleConnectionToLastStage handles a connection from a previous worker
+func handleConnectionToLastStage(networkConnection net.Conn, queue *Queue, tracker *EndOfStreamTracker) {
+	connection, err := protocol.Server(networkConnection, protocol.DefaultFeatures())
+	if err != nil {
+		logMessage(err.Error())
+		return
+	}
+	defer connection.Close()
+	acknowledger := NewAcknowledger(connection)
+	defer forgetAcknowledger(acknowledger)
+	for {
+		message, err := decodeInput(connection)
+		if err != nil {
+			break
+		}
+		if message.Description == common.MsgStageResult || message.Description == common.MsgSequenceSkip {
+			receiveResult(acknowledger, queue, message)
+		} else if !handleBarrierMessage(message) && !handleEndOfStreamMessage(tracker, message) {
+			logMessage("ERROR: Last stage received unexpected message: " + strconv.Itoa(message.Description))
 		}
 	}
 }
@@ -3,6 +3,7 @@ package worker
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Element struct
@@ -15,31 +16,87 @@ func (n *Element) MessageString() string {
 	return fmt.Sprint(n.Data)
 }
 
-// Queue Struct
+// defaultQueueCapacity is the capacity of a queue when none is configured
+const defaultQueueCapacity = 1000
+
+// queueControlSlack is the number of elements that can be forced into a full queue, such as the inputs put back in
+// front of a batch
+const queueControlSlack = 1024
+
+// Queue Struct. The queue is bounded: pushing into a full queue blocks until an element is popped.
 type Queue struct {
 	elements     []interface{}
 	length       int
 	semaphore    chan int
+	slots        chan int            // Holds one token per element pushed within the capacity of the queue
+	overflow     int                 // The number of elements forced into the queue beyond its capacity
+	onBlocked    func(time.Duration) // Called with the time Push was blocked for because the queue was full
 	mutex        *sync.Mutex
 	emptyChannel chan int
 }
 
-// makeQueue makes a new queue and returns it along with its size.
-func makeQueue() *Queue {
+// makeQueue makes a new queue holding at most capacity elements. onBlocked, if not nil, is called with the time every
+// push was blocked for because the queue was full.
+func makeQueue(capacity int, onBlocked func(time.Duration)) *Queue {
+	if capacity <= 0 {
+		capacity = defaultQueueCapacity
+	}
 	return &Queue{
 		elements:     make([]interface{}, 0),
-		semaphore:    make(chan int, 9999), // Make a buffered channel with a high buffer
+		semaphore:    make(chan int, capacity+queueControlSlack),
+		slots:        make(chan int, capacity),
+		overflow:     0,
+		onBlocked:    onBlocked,
 		mutex:        &sync.Mutex{},
 		emptyChannel: nil,
 	}
 }
 
-// Push adds an element to the queue
+// Push adds an element to the queue, blocking while the queue is full. The mutex is not held while blocking, so that
+// elements can still be popped.
 func (q *Queue) Push(element interface{}) {
+	select {
+	case q.slots <- 1:
+	default:
+		timerStart := time.Now()
+		q.slots <- 1
+		if q.onBlocked != nil {
+			q.onBlocked(time.Since(timerStart))
+		}
+	}
 	q.mutex.Lock()
 	q.elements = append(q.elements, element)
+	q.mutex.Unlock()
 	q.semaphore <- 1 // Write to channel (semaphore++)
+}
+
+// PushFront puts elements back at the front of the queue, in order, so that they are popped before any other element.
+// Since the elements are put back by the goroutine popping them, this never blocks on a full queue.
+func (q *Queue) PushFront(elements []interface{}) {
+	q.mutex.Lock()
+	q.elements = append(append(make([]interface{}, 0, len(elements)+len(q.elements)), elements...), q.elements...)
+	for range elements {
+		select {
+		case q.slots <- 1:
+		default:
+			q.overflow++
+		}
+	}
 	q.mutex.Unlock()
+	for range elements {
+		q.semaphore <- 1 // Write to channel (semaphore++)
+	}
+}
+
+// release frees the places of the given number of popped elements. Must be called with the mutex locked.
+func (q *Queue) release(numElements int) {
+	for i := 0; i < numElements; i++ {
+		if q.overflow > 0 {
+			q.overflow--
+		} else {
+			<-q.slots
+		}
+	}
 }
 
 // Pop removes an element from the queue
@@ -48,6 +105,7 @@ func (q *Queue) Pop() interface{} {
 	q.mutex.Lock()
 	result := q.elements[0]
 	q.elements = q.elements[1:]
+	q.release(1)
 	if q.emptyChannel != nil {
 		if len(q.elements) == 0 {
 			q.emptyChannel <- 1
@@ -57,6 +115,36 @@ func (q *Queue) Pop() interface{} {
 	return result
 }
 
+// PopBatch removes up to maxSize elements from the queue. It blocks until at least one element is available, and then
+// waits at most timeout for more elements to fill up the batch.
+func (q *Queue) PopBatch(maxSize int, timeout time.Duration) []interface{} {
+	<-q.semaphore // Read from channel (semaphore--)
+	numElements := 1
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+fillBatch:
+	for numElements < maxSize {
+		select {
+		case <-q.semaphore:
+			numElements++
+		case <-timer.C:
+			break fillBatch
+		}
+	}
+	q.mutex.Lock()
+	batch := make([]interface{}, numElements)
+	copy(batch, q.elements[:numElements])
+	q.elements = q.elements[numElements:]
+	q.release(numElements)
+	if q.emptyChannel != nil {
+		if len(q.elements) == 0 {
+			q.emptyChannel <- 1
+		}
+	}
+	q.mutex.Unlock()
+	return batch
+}
+
 // GetLength gives out the length of the queue
 func (q *Queue) GetLength() int {
 	q.mutex.Lock()
@@ -0,0 +1,212 @@
+package worker
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// reorderBuffer holds back the inputs of an ordered stage until they can be pushed into the input queue in order. nil
+// if this worker's stage is not ordered.
+var reorderBuffer *ReorderBuffer
+
+// emitSkips is true if an ordered stage is downstream of this worker's stage. If so, the worker sends a skip in place
+// of every input it drops, so that the ordered stage does not wait for it.
+var emitSkips bool
+
+// reorderItem is an input held back by the reorder buffer
+type reorderItem struct {
+	message *types.Message // The message containing the input, or a skip standing for inputs dropped upstream
+	start   *big.Rat       // Where the share of its source item that the input stands for starts
+	end     *big.Rat       // Where that share ends
+	arrival time.Time      // The time at which the input arrived
+}
+
+// originBuffer holds back the inputs that derive from the items of a single source stage worker
+type originBuffer struct {
+	next   uint64         // The sequence number of the source item whose inputs are pushed into the queue next
+	cursor *big.Rat       // The share of that source item whose inputs have already been pushed into the queue
+	items  []*reorderItem // The inputs held back, sorted by sequence number and then by share
+}
+
+// ReorderBuffer sits in front of the input queue of an ordered stage, and pushes inputs into the queue in the order of
+// their sequence numbers. Inputs are ordered separately for every source stage worker, since each of them numbers its
+// items independently. Inputs with the same sequence number, such as the outputs of a flat-map stage, are pushed in
+// the order of their parts, and the next sequence number is only moved on to once the inputs derived from the source
+// item cover all of it. Skips sent by the stages in between stand for the inputs they dropped, and are pushed into
+// the queue like inputs, so that they can be passed on.
+type ReorderBuffer struct {
+	origins  map[string]*originBuffer // The inputs held back, by the ID of the source stage worker they derive from
+	depth    int                      // The total number of inputs held back
+	capacity int                      // The maximum number of inputs held back before a missing input is given up on
+	maxWait  time.Duration            // The maximum time an input is held back for
+	queue    *Queue                   // The input queue
+	mutex    *sync.Mutex              // For concurrency stuff
+}
+
+// NewReorderBuffer creates a reorder buffer in front of the given queue. A capacity or maxWait that is not positive is
+// replaced by the default.
+func NewReorderBuffer(queue *Queue, capacity int, maxWait time.Duration) *ReorderBuffer {
+	if capacity <= 0 {
+		capacity = types.DefaultReorderCapacity
+	}
+	if maxWait <= 0 {
+		maxWait = types.DefaultReorderTimeout
+	}
+	buffer := new(ReorderBuffer)
+	buffer.origins = make(map[string]*originBuffer)
+	buffer.depth = 0
+	buffer.capacity = capacity
+	buffer.maxWait = maxWait
+	buffer.queue = queue
+	buffer.mutex = &sync.Mutex{}
+	go buffer.expireGoroutine()
+	return buffer
+}
+
+// setUpReorderBuffer creates the reorder buffer in front of the given queue if the stage is ordered
+func setUpReorderBuffer(stage *types.StageDefinition, queue *Queue) {
+	if stage.Ordered {
+		reorderBuffer = NewReorderBuffer(queue, stage.ReorderCapacity, stage.ReorderTimeout)
+	}
+}
+
+// pushInput pushes a result received from a previous worker into the input queue, through the reorder buffer if the
+// stage is ordered
+func pushInput(queue *Queue, message *types.Message) {
+	if reorderBuffer != nil {
+		reorderBuffer.Push(message)
+	} else {
+		queue.Push(message)
+	}
+	WorkerStatistics.UpdateBacklog(queue.GetLength())
+}
+
+// Push adds an input to the buffer, and pushes every input that is now in order into the queue
+func (buffer *ReorderBuffer) Push(message *types.Message) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	origin, ok := buffer.origins[message.Origin]
+	if !ok {
+		origin = new(originBuffer)
+		origin.cursor = new(big.Rat)
+		buffer.origins[message.Origin] = origin
+	}
+	item := &reorderItem{message: message, arrival: time.Now()}
+	item.start, item.end = types.Span(message.Parts)
+	index := sort.Search(len(origin.items), func(i int) bool {
+		return item.before(origin.items[i])
+	})
+	origin.items = append(origin.items, nil)
+	copy(origin.items[index+1:], origin.items[index:])
+	origin.items[index] = item
+	buffer.depth++
+	buffer.release(origin)
+	for buffer.depth > buffer.capacity {
+		buffer.skip(buffer.oldestOrigin(0))
+	}
+	WorkerStatistics.UpdateReorderDepth(buffer.depth)
+}
+
+// Flush pushes every input held back into the queue, in order. Called once the end of the stream has been received,
+// since no missing input can arrive after it.
+func (buffer *ReorderBuffer) Flush() {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	for _, origin := range buffer.origins {
+		for len(origin.items) > 0 {
+			buffer.skip(origin)
+		}
+	}
+	WorkerStatistics.UpdateReorderDepth(buffer.depth)
+}
+
+// before returns true if the item comes before the other item: if it derives from an earlier source item, or from an
+// earlier share of the same source item
+func (item *reorderItem) before(other *reorderItem) bool {
+	if item.message.Sequence != other.message.Sequence {
+		return item.message.Sequence < other.message.Sequence
+	}
+	return item.start.Cmp(other.start) < 0
+}
+
+// inOrder returns true if the item can be pushed into the queue: if it derives from a source item that was moved past
+// already, or if it starts where the inputs pushed so far for the next source item end
+func (origin *originBuffer) inOrder(item *reorderItem) bool {
+	if item.message.Sequence != origin.next {
+		return item.message.Sequence < origin.next
+	}
+	return item.start.Cmp(origin.cursor) <= 0
+}
+
+// release pushes the inputs of the origin that are in order into the queue. Once the inputs pushed cover the whole of
+// the next source item, the origin moves on to the source item after it. Must be called with the mutex locked.
+func (buffer *ReorderBuffer) release(origin *originBuffer) {
+	for len(origin.items) > 0 && origin.inOrder(origin.items[0]) {
+		item := origin.items[0]
+		origin.items = origin.items[1:]
+		buffer.depth--
+		if item.message.Sequence == origin.next && item.end.Cmp(origin.cursor) > 0 {
+			origin.cursor = item.end
+		}
+		if origin.cursor.Cmp(big.NewRat(1, 1)) >= 0 {
+			origin.next++
+			origin.cursor = new(big.Rat)
+		}
+		buffer.queue.Push(item.message)
+		WorkerStatistics.UpdateReorderWaitTime(time.Since(item.arrival))
+	}
+}
+
+// skip gives up on the missing inputs before the first input held back for the origin, and releases it. Must be
+// called with the mutex locked.
+func (buffer *ReorderBuffer) skip(origin *originBuffer) {
+	if origin == nil || len(origin.items) == 0 {
+		return
+	}
+	first := origin.items[0]
+	if first.message.Sequence > origin.next {
+		WorkerStatistics.AddReorderSkipped(int(first.message.Sequence - origin.next))
+		origin.next = first.message.Sequence
+		origin.cursor = first.start
+	} else if first.message.Sequence == origin.next && first.start.Cmp(origin.cursor) > 0 {
+		WorkerStatistics.AddReorderSkipped(1)
+		origin.cursor = first.start
+	}
+	buffer.release(origin)
+}
+
+// oldestOrigin returns the origin holding back the input that arrived first, provided it has been held back for longer
+// than minWait. Returns nil if there is no such input. Must be called with the mutex locked.
+func (buffer *ReorderBuffer) oldestOrigin(minWait time.Duration) *originBuffer {
+	var oldest *originBuffer
+	var oldestArrival time.Time
+	for _, origin := range buffer.origins {
+		for _, item := range origin.items {
+			if oldest == nil || item.arrival.Before(oldestArrival) {
+				oldest = origin
+				oldestArrival = item.arrival
+			}
+		}
+	}
+	if oldest == nil || time.Since(oldestArrival) < minWait {
+		return nil
+	}
+	return oldest
+}
+
+// expireGoroutine periodically gives up on missing inputs that have held back other inputs for longer than maxWait
+func (buffer *ReorderBuffer) expireGoroutine() {
+	for {
+		time.Sleep(buffer.maxWait / 4)
+		buffer.mutex.Lock()
+		for origin := buffer.oldestOrigin(buffer.maxWait); origin != nil; origin = buffer.oldestOrigin(buffer.maxWait) {
+			buffer.skip(origin)
+		}
+		WorkerStatistics.UpdateReorderDepth(buffer.depth)
+		buffer.mutex.Unlock()
+	}
+}
@@ -0,0 +1,128 @@
+package worker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// reorderTestInput describes an input pushed into the reorder buffer
+type reorderTestInput struct {
+	label    string       // Identifies the input in the order it is pushed into the queue in
+	origin   string       // The source stage worker the input derives from
+	sequence uint64       // The sequence number of the source item it derives from
+	parts    []types.Part // Its part among the inputs derived from the source item
+	skip     bool         // Whether the input is a skip rather than a result
+}
+
+// newReorderTestMessage wraps the test input in a message
+func newReorderTestMessage(input reorderTestInput) *types.Message {
+	message := new(types.Message)
+	message.Description = common.MsgStageResult
+	if input.skip {
+		message.Description = common.MsgSequenceSkip
+	}
+	message.Contents = input.label
+	message.Origin = input.origin
+	message.Sequence = input.sequence
+	message.Parts = input.parts
+	return message
+}
+
+// drainReorderTestQueue pops every input in the queue, and returns their labels in order
+func drainReorderTestQueue(queue *Queue) []string {
+	labels := make([]string, 0)
+	for queue.GetLength() > 0 {
+		labels = append(labels, queue.Pop().(*types.Message).Contents.(string))
+	}
+	return labels
+}
+
+// TestReorderBuffer checks that inputs are pushed into the queue in order, that gaps are waited for until they are
+// filled by an input or a skip, and that a gap is given up on once the buffer is full
+func TestReorderBuffer(t *testing.T) {
+	half := func(index int) []types.Part { return []types.Part{{Index: index, Count: 2}} }
+	tests := []struct {
+		name     string             // The name of the test case
+		capacity int                // The capacity of the reorder buffer
+		inputs   []reorderTestInput // The inputs pushed into the buffer, in order
+		want     []string           // The labels of the inputs pushed into the queue, in order
+	}{
+		{"in order", 10, []reorderTestInput{{"0", "a", 0, nil, false}, {"1", "a", 1, nil, false},
+			{"2", "a", 2, nil, false}}, []string{"0", "1", "2"}},
+		{"gap filled", 10, []reorderTestInput{{"1", "a", 1, nil, false}, {"2", "a", 2, nil, false},
+			{"0", "a", 0, nil, false}}, []string{"0", "1", "2"}},
+		{"gap held", 10, []reorderTestInput{{"0", "a", 0, nil, false}, {"2", "a", 2, nil, false}},
+			[]string{"0"}},
+		{"gap filled by a skip", 10, []reorderTestInput{{"1", "a", 1, nil, false}, {"skip0", "a", 0, nil, true}},
+			[]string{"skip0", "1"}},
+		{"gap given up when full", 2, []reorderTestInput{{"1", "a", 1, nil, false}, {"2", "a", 2, nil, false},
+			{"3", "a", 3, nil, false}}, []string{"1", "2", "3"}},
+		{"parts in order", 10, []reorderTestInput{{"0b", "a", 0, half(1), false}, {"1", "a", 1, nil, false},
+			{"0a", "a", 0, half(0), false}}, []string{"0a", "0b", "1"}},
+		{"missing part held", 10, []reorderTestInput{{"0a", "a", 0, half(0), false}, {"1", "a", 1, nil, false}},
+			[]string{"0a"}},
+		{"missing part skipped", 10, []reorderTestInput{{"0a", "a", 0, half(0), false},
+			{"1", "a", 1, nil, false}, {"skip0b", "a", 0, half(1), true}}, []string{"0a", "skip0b", "1"}},
+		{"nested parts", 10, []reorderTestInput{
+			{"0b", "a", 0, half(1), false},
+			{"0a1", "a", 0, []types.Part{{Index: 0, Count: 2}, {Index: 1, Count: 2}}, false},
+			{"0a0", "a", 0, []types.Part{{Index: 0, Count: 2}, {Index: 0, Count: 2}}, false},
+			{"1", "a", 1, nil, false}}, []string{"0a0", "0a1", "0b", "1"}},
+		{"origins ordered separately", 10, []reorderTestInput{{"a1", "a", 1, nil, false},
+			{"b0", "b", 0, nil, false}, {"a0", "a", 0, nil, false}}, []string{"b0", "a0", "a1"}},
+		{"late input", 1, []reorderTestInput{{"1", "a", 1, nil, false}, {"2", "a", 2, nil, false},
+			{"0", "a", 0, nil, false}}, []string{"1", "2", "0"}},
+	}
+	for _, test := range tests {
+		queue := makeQueue(100, nil)
+		buffer := NewReorderBuffer(queue, test.capacity, time.Hour)
+		for _, input := range test.inputs {
+			buffer.Push(newReorderTestMessage(input))
+		}
+		if got := drainReorderTestQueue(queue); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestReorderBufferTimeout checks that a gap is given up on once the input after it has been held back for longer than
+// the maximum wait, and that the remaining inputs are released when the buffer is flushed
+func TestReorderBufferTimeout(t *testing.T) {
+	tests := []struct {
+		name   string             // The name of the test case
+		flush  bool               // Whether the buffer is flushed instead of waited on
+		inputs []reorderTestInput // The inputs pushed into the buffer, in order
+		want   []string           // The labels of the inputs pushed into the queue, in order
+	}{
+		{"timeout", false, []reorderTestInput{{"1", "a", 1, nil, false}, {"3", "a", 3, nil, false}},
+			[]string{"1", "3"}},
+		{"flush", true, []reorderTestInput{{"2", "a", 2, nil, false}, {"4", "a", 4, nil, false}},
+			[]string{"2", "4"}},
+	}
+	for _, test := range tests {
+		queue := makeQueue(100, nil)
+		maxWait := 50 * time.Millisecond
+		if test.flush {
+			maxWait = time.Hour
+		}
+		buffer := NewReorderBuffer(queue, 10, maxWait)
+		for _, input := range test.inputs {
+			buffer.Push(newReorderTestMessage(input))
+		}
+		if got := drainReorderTestQueue(queue); len(got) != 0 {
+			t.Errorf("%s: got %v before the gap was given up on, want nothing", test.name, got)
+		}
+		if test.flush {
+			buffer.Flush()
+		} else {
+			time.Sleep(10 * maxWait)
+		}
+		if got := drainReorderTestQueue(queue); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -1,19 +1,16 @@
 package worker
 
 import (
-	"encoding/gob"
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/ffrankies/gopipeline/internal/common"
-	"github.com/ffrankies/gopipeline/types"
 )
 
 // setUpSignalHandler sets up a signal handler for clean exit on termination
-func setUpSignalHandler(inputQueue *Queue, outputQueue *Queue, masterAddress string) {
+func setUpSignalHandler(inputQueue *Queue, outputQueue *Queue) {
 	signalHandlerChannel := make(chan os.Signal, 1)
 	signal.Notify(signalHandlerChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 	go func() {
@@ -28,37 +25,33 @@ func setUpSignalHandler(inputQueue *Queue, outputQueue *Queue, masterAddress str
 			}
 			if receivedSignal == syscall.SIGUSR1 {
 				fmt.Println("Received a SigUSR1 signal...")
+				if reorderBuffer != nil {
+					reorderBuffer.Flush()
+				}
 				if inputQueue != nil {
 					inputQueue.WaitUntilEmpty()
 				}
 				if outputQueue != nil {
 					outputQueue.WaitUntilEmpty()
 				}
+				connections.WaitForAcknowledgements()
 				connections.CloseAll()
 				// Figure out how to kill listener
-				notifyMasterOfExit(masterAddress)
+				notifyMasterOfExit()
 				os.Exit(0)
 			}
 		}
 	}()
 }
 
-// notifyMasterOfExit notifies the master that this node is about to exit
-func notifyMasterOfExit(masterAddress string) {
-	message := new(types.Message)
-	message.Sender = StageID
-	message.Description = common.MsgNotifyExit
-	message.Contents = StageID
-	connectionToMaster, err := net.Dial("tcp", masterAddress)
-	if err != nil {
-		fmt.Println(err.Error())
-		panic(err)
-	}
-	defer connectionToMaster.Close()
-	encoder := gob.NewEncoder(connectionToMaster)
-	err = encoder.Encode(message)
-	if err != nil {
-		fmt.Println(err.Error())
-		panic(err)
+// notifyMasterOfExit notifies the master that this node is about to exit. The state of a stateful stage is sent first,
+// along the control session, so that the master can hand it over to the replacement worker before forgetting this one.
+func notifyMasterOfExit() {
+	if stateMessage := newStateMessage(); stateMessage != nil {
+		if err := control.Send(stateMessage); err != nil {
+			fmt.Println(err.Error())
+		}
 	}
+	sendToMaster(common.MsgNotifyExit, StageID)
+	control.Close()
 }
@@ -1,77 +1,258 @@
 package worker
 
 import (
-	"encoding/gob"
+	"os"
 	"strconv"
 	"time"
 
 	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
 	"github.com/ffrankies/gopipeline/types"
 )
 
-// decodeInput decodes input from a previous stage
-func decodeInput(decoder *gob.Decoder, registerType interface{}) (input interface{}, messageDesc int, err error) {
-	//que := makeQueue(10) //check the size of the queue
-
-	gob.Register(registerType)
-	message := new(types.Message)
-	err = decoder.Decode(message)
+// decodeInput decodes a message from a previous stage
+func decodeInput(connection *protocol.Conn) (message *types.Message, err error) {
+	message = new(types.Message)
+	err = connection.Decode(message)
 	if err != nil {
 		logMessage(err.Error())
 	}
-	input = message.Contents
-	messageDesc = message.Description
-	//que.Push(&Element{input}) //FILL THE PUSH PART OF THE QUEUE
 	return
 }
 
-// executeAndSend computes the result of the stage and sends it to the next stage.
-func executeAndSend(functionList []types.AnyFunc, position int, myID string, inputQueue *Queue, outputQueue *Queue) {
-	go send(outputQueue)
+// output is a message in the output queue, along with the delivery that acknowledges the inputs it derives from once
+// it has been acknowledged. delivery is nil for barriers and the end of the stream.
+type output struct {
+	message  *types.Message
+	delivery *delivery
+}
+
+// executeAndSend computes the result of the stage and sends it to the next stage. Inputs are only acknowledged once
+// every result derived from them has been acknowledged by the next workers, so that they are sent again if this worker
+// fails before its results are safe. Skips received from the previous stages are passed on if an ordered stage is
+// downstream. When a barrier is popped from the input queue, a snapshot is taken and the barrier is passed on
+// to the output queue after the results of the inputs before it. When the end of the stream is popped from the input
+// queue, it is passed on to the output queue and no more inputs are processed.
+func executeAndSend(stage *types.StageDefinition, myID string, inputQueue *Queue, outputQueue *Queue) {
+	go send(outputQueue, myID)
+	waitForState()
 	for {
-		input := inputQueue.Pop()
-		message := executeStage(functionList, position, myID, input)
-		outputQueue.Push(message)
+		received, skipped, barrier, endOfStream := popInputs(stage, inputQueue)
+		results := append(executeInputs(stage, myID, received), newSkipMessages(myID, skipped)...)
+		inputs := append(received, skipped...)
+		delivery := newDelivery(len(results), func() { acknowledgeInputs(inputs) })
+		for _, message := range results {
+			outputQueue.Push(&output{message: message, delivery: delivery})
+		}
 		logPrint("Finished execution")
+		if barrier != nil {
+			takeSnapshot(barrier.CheckpointID, 0)
+			outputQueue.Push(&output{message: newBarrierMessage(myID, barrier.CheckpointID)})
+		}
+		if endOfStream {
+			outputQueue.Push(&output{message: newEndOfStreamMessage(myID)})
+			logPrint("Reached the end of the stream")
+			return
+		}
+	}
+}
+
+// popInputs pops the next inputs to process from the queue: a whole batch for batching stages, and a single input
+// otherwise. received holds the messages containing the inputs, and skipped the skips popped along with them. If the
+// end of the stream was popped, it is removed from the inputs and endOfStream is true. A batch ends at a barrier: if
+// one was popped, it is returned, and the elements popped after it are put back into the queue.
+func popInputs(stage *types.StageDefinition, queue *Queue) (received []*types.Message, skipped []*types.Message,
+	barrier *types.Barrier, endOfStream bool) {
+	var elements []interface{}
+	if stage.BatchFunction != nil {
+		elements = queue.PopBatch(stage.BatchSize, stage.BatchTimeout)
+	} else {
+		elements = []interface{}{queue.Pop()}
+	}
+	WorkerStatistics.UpdateBacklog(queue.GetLength())
+	received = make([]*types.Message, 0, len(elements))
+	for index, element := range elements {
+		if element == types.EndOfStream {
+			endOfStream = true
+			continue
+		}
+		message := element.(*types.Message)
+		if message.Description == common.MsgBarrier {
+			barrier = message.Contents.(*types.Barrier)
+			queue.PushFront(elements[index+1:])
+			return
+		}
+		if message.Description == common.MsgSequenceSkip {
+			skipped = append(skipped, message)
+			continue
+		}
+		received = append(received, message)
+	}
+	return
+}
+
+// executeInputs executes the stage on the inputs contained in the given messages: once on the whole batch for
+// batching stages, and once per input otherwise. Returns the messages to send on to the next stage. The outputs of a
+// batch derive from its first input, and every other input of the batch is replaced by a skip, since no output stands
+// for it on its own. An input that produced no output at all, because it was filtered out, dropped or failed, is
+// replaced by a skip too.
+func executeInputs(stage *types.StageDefinition, stageID string, received []*types.Message) []*types.Message {
+	if stage.BatchFunction != nil {
+		if len(received) == 0 {
+			return nil
+		}
+		inputs := make([]interface{}, 0, len(received))
+		for _, message := range received {
+			inputs = append(inputs, message.Contents)
+		}
+		messages := deriveOutputs(stageID, received[0], executeBatch(stage, stageID, inputs))
+		return append(messages, newSkipMessages(stageID, received[1:])...)
+	}
+	messages := make([]*types.Message, 0, len(received))
+	for _, message := range received {
+		outputs := executeStage(stage, stageID, message.Contents)
+		messages = append(messages, deriveOutputs(stageID, message, outputs)...)
 	}
+	return messages
 }
 
-// send sends results from the output queue to the next node
-func send(outputQueue *Queue) {
+// deriveOutputs gives the outputs of the stage the origin and sequence number of the input they derive from. If there
+// are several outputs, each of them also gets its part among them, so that an ordered stage downstream can order them
+// and knows when it has received all of them. If there are no outputs, returns a skip for the input instead.
+func deriveOutputs(stageID string, input *types.Message, outputs []*types.Message) []*types.Message {
+	if len(outputs) == 0 {
+		return newSkipMessages(stageID, []*types.Message{input})
+	}
+	for index, output := range outputs {
+		output.Origin = input.Origin
+		output.Sequence = input.Sequence
+		output.Parts = types.DeriveParts(input.Parts, index, len(outputs))
+		output.ID = types.DerivedID(stagePosition, input.ID, index, len(outputs))
+	}
+	return outputs
+}
+
+// newSkipMessages returns a skip for each of the given inputs or skips, which tells the ordered stages downstream that
+// no output derives from that share of its source item. Returns no messages if there is no ordered stage downstream.
+func newSkipMessages(stageID string, inputs []*types.Message) []*types.Message {
+	if !emitSkips {
+		return nil
+	}
+	messages := make([]*types.Message, 0, len(inputs))
+	for _, input := range inputs {
+		message := new(types.Message)
+		message.Sender = stageID
+		message.Description = common.MsgSequenceSkip
+		message.Origin = input.Origin
+		message.Sequence = input.Sequence
+		message.Parts = input.Parts
+		message.ID = types.DerivedID(stagePosition, input.ID, 0, 0)
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// send sends results from the output queue to one worker of every downstream stage. Barriers are sent to every next
+// worker. When the end of the stream is popped from the output queue, it is sent to every next node, and the worker
+// exits.
+func send(outputQueue *Queue, myID string) {
 	for {
-		output := outputQueue.Pop()
-		encoder := connections.Select()
-		if err := encoder.Encode(output); err != nil {
-			logMessage(err.Error())
-			break
+		next := outputQueue.Pop().(*output)
+		if next.message.Description == common.MsgEndOfStream {
+			finishStream(myID)
+			return
+		}
+		if next.message.Description == common.MsgBarrier {
+			if err := connections.Broadcast(next.message); err != nil {
+				logMessage(err.Error())
+			}
+			continue
+		}
+		if err := connections.SendToAll(next.message, next.delivery); err != nil {
+			logMessage("Could not send computation results to next stage: " + err.Error())
+			return
 		}
 		logPrint("Sent computation results to next stage")
 	}
 }
 
-// executeStage executes the function this stage is responsible for, and returns the result as a message
-func executeStage(functionList []types.AnyFunc, position int, stageID string, input interface{}) *types.Message {
-	message := new(types.Message)
-	var result interface{}
+// executeStage executes the function this stage is responsible for, and returns each of its outputs as a separate
+// message. Outputs equal to types.Drop are left out. Returns no messages if the stage failed to process the input.
+func executeStage(stage *types.StageDefinition, stageID string, input interface{}) []*types.Message {
 	timerStart := time.Now()
-	if input == nil {
-		result = functionList[position](nil)
-	} else {
-		result = functionList[position](input)
-	}
+	outputs := callStageFunction(stage, stageID, input)
 	WorkerStatistics.UpdateExecutionTime(time.Since(timerStart))
-	message.Sender = stageID
-	message.Description = common.MsgStageResult
-	message.Contents = result
-	return message
+	return newResultMessages(stageID, outputs, 1)
+}
+
+// executeBatch executes the stage's BatchFunction on a batch of inputs, and returns each of its outputs as a separate
+// message. The execution time is divided by the size of the batch, so that it remains comparable to the execution
+// time of stages that process a single input at a time.
+func executeBatch(stage *types.StageDefinition, stageID string, inputs []interface{}) []*types.Message {
+	timerStart := time.Now()
+	outputs := callBatchFunction(stage, stageID, inputs)
+	WorkerStatistics.UpdateExecutionTime(time.Since(timerStart) / time.Duration(len(inputs)))
+	return newResultMessages(stageID, outputs, len(inputs))
 }
 
-// executeOnly computes the result of the stage and logs the time at which the computation completed.
-func executeOnly(functionList []types.AnyFunc, position int, myID string, queue *Queue) {
+// newResultMessages wraps each output of the stage in a separate message, leaving out outputs equal to types.Drop, and
+// adds the outputs to the worker's item counts
+func newResultMessages(stageID string, outputs []interface{}, numInputs int) []*types.Message {
+	messages := make([]*types.Message, 0, len(outputs))
+	numDropped := 0
+	for _, output := range outputs {
+		if output == types.Drop {
+			numDropped++
+			continue
+		}
+		message := new(types.Message)
+		message.Sender = stageID
+		message.Description = common.MsgStageResult
+		message.Contents = output
+		messages = append(messages, message)
+	}
+	WorkerStatistics.AddItemCounts(numInputs, len(messages), numDropped)
+	return messages
+}
+
+// executeOnly computes the result of the stage and logs the time at which the computation completed. If
+// resultConnection is not nil, the result is also sent back to the master through it. Inputs are acknowledged once
+// their results have been sent. A snapshot is taken when a barrier is popped from the queue. When the end of the stream
+// is popped from the queue, the master is notified and the worker exits.
+func executeOnly(stage *types.StageDefinition, myID string, queue *Queue, resultConnection *Connection) {
+	waitForState()
 	for {
-		input := queue.Pop()
-		executeStage(functionList, position, myID, input)
+		received, skipped, barrier, endOfStream := popInputs(stage, queue)
+		messages := executeInputs(stage, myID, received)
 		currentTime := time.Now()
 		logPrint("Finished computation at time: " + strconv.FormatInt(currentTime.UnixNano(), 10))
+		if resultConnection != nil {
+			sendResultsToMaster(stage, myID, resultConnection, messages)
+			logPrint("Sent computation results to master")
+		}
+		acknowledgeInputs(append(received, skipped...))
+		if barrier != nil {
+			takeSnapshot(barrier.CheckpointID, 0)
+		}
+		if endOfStream {
+			notifyMasterOfCompletion(myID, resultConnection)
+			logPrint("Reached the end of the stream")
+			os.Exit(0)
+		}
+	}
+}
+
+// sendResultsToMaster sends the results of the last stage back to the master through the result connection. A result
+// that cannot be sent, such as one that cannot be encoded with the codec, is handled like an input the stage failed to
+// process, according to the stage's error policy, so that the worker carries on with the next inputs and still
+// notifies the master once it reaches the end of the stream.
+func sendResultsToMaster(stage *types.StageDefinition, myID string, resultConnection *Connection,
+	messages []*types.Message) {
+	for _, message := range messages {
+		if err := resultConnection.Con.Encode(message); err != nil {
+			WorkerStatistics.AddFailure()
+			failure := newStageFailure(myID, message.Contents, err, "", 1)
+			handleStageFailure(stageErrorPolicy(stage), failure)
+		}
 	}
 }
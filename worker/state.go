@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/types"
+)
+
+// stageState is the keyed state passed to the function of a stateful stage
+var stageState = types.NewStateStore()
+
+// isStateful is true if this worker runs a stateful stage
+var isStateful = false
+
+// stateReady is closed once this worker may start processing inputs, i.e. once the state of the worker it replaces
+// has been restored, or straight away if there is no such state
+var stateReady = make(chan struct{})
+
+// stateReadyOnce makes sure that stateReady is only closed once
+var stateReadyOnce = &sync.Once{}
+
+// stateMutex is held while the function of a stateful stage runs, and while the state is checkpointed, so that a
+// checkpoint is only ever taken between two inputs, and never holds a partly applied update
+var stateMutex = &sync.Mutex{}
+
+// restoredSequence is the number of items a source stage worker had produced when the restored checkpoint was taken,
+// or that the failed worker it replaces had delivered. These items are produced again, but not sent on.
+var restoredSequence uint64
+
+// restoredOrigin is the ID of the failed source stage worker whose stream this worker carries on. Empty if this worker
+// numbers its items under its own ID.
+var restoredOrigin string
+
+// setUpState prepares the state of a stateful stage. If awaitState is true, inputs are not processed until the state
+// of the replaced worker, or the checkpoint being restored, is received from the master. The state is checkpointed to
+// disk every checkpointInterval.
+func setUpState(stage *types.StageDefinition, awaitState bool, checkpointInterval time.Duration) {
+	isStateful = stage.StatefulFunc != nil
+	if !awaitState {
+		markStateReady()
+	}
+	if isStateful {
+		go checkpointGoroutine(checkpointInterval)
+	}
+}
+
+// markStateReady allows this worker to start processing inputs
+func markStateReady() {
+	stateReadyOnce.Do(func() {
+		close(stateReady)
+	})
+}
+
+// waitForState blocks until this worker may start processing inputs
+func waitForState() {
+	<-stateReady
+}
+
+// checkpointPath returns the path of the file in the user's home directory to which the state is checkpointed
+func checkpointPath() string {
+	return userHomeDir() + "/" + common.StateFileName(stagePosition, StageID)
+}
+
+// checkpointState writes the state of this worker to disk between two inputs, and returns the snapshot written
+func checkpointState() ([]byte, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	return stageState.Checkpoint(checkpointPath())
+}
+
+// checkpointGoroutine periodically writes the state of this worker to disk, once the state is ready. If the worker
+// fails, the master restores the last of these checkpoints on the worker replacing it.
+func checkpointGoroutine(checkpointInterval time.Duration) {
+	waitForState()
+	for {
+		time.Sleep(checkpointInterval)
+		if _, err := checkpointState(); err != nil {
+			logMessage("Could not checkpoint the state: " + err.Error())
+		}
+	}
+}
+
+// handleStateMessage restores the state handed over by the master, or the checkpoint sent by the master, and returns
+// true if the message contained either
+func handleStateMessage(message *types.Message) bool {
+	if message.Description == common.MsgRestore {
+		restoreCheckpoint(message.Contents.(*types.WorkerCheckpoint))
+		return true
+	}
+	if message.Description != common.MsgStageState {
+		return false
+	}
+	if err := stageState.Restore(message.Contents.([]byte)); err != nil {
+		logMessage("Could not restore the state of the replaced worker: " + err.Error())
+	} else {
+		logPrint("Restored the state of the replaced worker")
+	}
+	markStateReady()
+	return true
+}
+
+// restoreCheckpoint restores this worker's part of a checkpoint, and allows it to start processing inputs
+func restoreCheckpoint(workerCheckpoint *types.WorkerCheckpoint) {
+	restoredSequence = workerCheckpoint.Sequence
+	restoredOrigin = workerCheckpoint.WorkerID
+	if isStateful && len(workerCheckpoint.State) > 0 {
+		if err := stageState.Restore(workerCheckpoint.State); err != nil {
+			logMessage("Could not restore the state of the checkpoint: " + err.Error())
+		}
+	}
+	logPrint("Restored checkpoint " + strconv.Itoa(workerCheckpoint.CheckpointID))
+	markStateReady()
+}
+
+// newStateMessage takes a final checkpoint of the state of this worker, and returns it as a message to be handed over
+// to the worker replacing this one. Returns nil if this worker's stage is not stateful.
+func newStateMessage() *types.Message {
+	if !isStateful {
+		return nil
+	}
+	snapshot, err := checkpointState()
+	if err != nil {
+		logMessage("Could not checkpoint the state: " + err.Error())
+		return nil
+	}
+	message := new(types.Message)
+	message.Sender = StageID
+	message.Description = common.MsgStageState
+	message.Contents = snapshot
+	return message
+}
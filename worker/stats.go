@@ -3,7 +3,6 @@ package worker
 import (
 	"encoding/gob"
 	"fmt"
-	"net"
 	"os"
 	"strconv"
 	"time"
@@ -14,7 +13,7 @@ import (
 )
 
 // trackStatsGoroutine is meant to track the performance statistics of the given worker, and send them to master
-func trackStatsGoroutine(masterAddress string, stageID string) {
+func trackStatsGoroutine() {
 	for {
 		time.Sleep(1 * time.Second)
 		nodeAvailableMemory := readAvailableMemory()
@@ -22,7 +21,7 @@ func trackStatsGoroutine(masterAddress string, stageID string) {
 		WorkerStatistics.UpdateMemoryUsage(workerMemoryUsage, nodeAvailableMemory)
 		fmt.Println("====Worker Statistics for Stage " + StageID + " ====")
 		fmt.Println(WorkerStatistics)
-		sendStatsToMaster(masterAddress, stageID)
+		sendStatsToMaster()
 	}
 }
 
@@ -52,23 +51,8 @@ func readMemoryUsage() uint64 {
 	return procStatm.Size
 }
 
-// sendStatsToMaster sends the WorkerStatistics struct to the master node
-func sendStatsToMaster(masterAddress string, stageID string) {
-	message := new(types.Message)
-	message.Sender = stageID
-	message.Description = common.MsgStageStats
-	message.Contents = WorkerStatistics.Copy()
-	connectionToMaster, err := net.Dial("tcp", masterAddress)
-	if err != nil {
-		fmt.Println(err.Error())
-		panic(err)
-	}
-	defer connectionToMaster.Close()
+// sendStatsToMaster sends the WorkerStatistics struct to the master node along the control session
+func sendStatsToMaster() {
 	gob.Register(new(types.WorkerStats))
-	encoder := gob.NewEncoder(connectionToMaster)
-	err = encoder.Encode(message)
-	if err != nil {
-		fmt.Println(err.Error())
-		panic(err)
-	}
+	sendToMaster(common.MsgStageStats, WorkerStatistics.Copy())
 }
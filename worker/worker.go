@@ -9,9 +9,9 @@ import (
 	"os/user"
 	"strconv"
 	"sync"
-	"time"
 
 	"github.com/ffrankies/gopipeline/internal/common"
+	"github.com/ffrankies/gopipeline/internal/protocol"
 	"github.com/ffrankies/gopipeline/types"
 )
 
@@ -21,11 +21,17 @@ var StageID string
 // StageNumber the number of this stage
 var StageNumber string
 
+// stagePosition is the position of this stage within the pipeline
+var stagePosition int
+
 // WorkerStatistics is the performance statistics of this worker process
 var WorkerStatistics = new(types.WorkerStats)
 
-// connections is the list of connections to the next nodes
-var connections = NewConnections()
+// queueCapacity is the maximum number of items in each of this worker's queues
+var queueCapacity = defaultQueueCapacity
+
+// connections is the list of connections to the next nodes, grouped by the position of their stage
+var connections = NewStageConnections(new(types.Pipeline), 0)
 
 // logging mutex
 var logMutex = &sync.Mutex{}
@@ -68,52 +74,61 @@ func logMessage(message string) {
 	fmt.Println(message)
 }
 
-// sendInfoToMaster opens a connection to the master node, and sends the address of its listener and the pid of this
-// stage's worker process
-func sendInfoToMaster(masterAddress string, myID string, myAddress string) {
-
+// sendInfoToMaster sends the address of this worker's listener, the pid of this stage's worker process and the
+// fingerprint of this worker's executable and pipeline to the master, along the control session
+func sendInfoToMaster(myAddress string, pipeline *types.Pipeline) {
 	logPrint("Sending info to master")
-	message := new(types.Message)
-	message.Sender = myID
-	message.Description = common.MsgStageInfo
-	stageInfo := types.MessageStageInfo{Address: myAddress, PID: os.Getpid()}
-	message.Contents = stageInfo
-	connection, err := net.DialTimeout("tcp", masterAddress, 2*time.Second)
-	if err != nil {
-		panic(err)
-	}
-	defer connection.Close()
 	gob.Register(types.MessageStageInfo{})
-	encoder := gob.NewEncoder(connection)
-	err = encoder.Encode(message)
+	fingerprint, err := types.NewFingerprint(pipeline)
 	if err != nil {
 		panic(err)
 	}
+	stageInfo := types.MessageStageInfo{Address: myAddress, PID: os.Getpid(), Fingerprint: fingerprint}
+	sendToMaster(common.MsgStageInfo, stageInfo)
 }
 
-// runStage chooses the correct stage function to run, and runs it
-func runStage(options *common.WorkerOptions, functionList []types.AnyFunc, listener net.Listener,
-	registerType interface{}) {
-	isLastStage := options.Position == len(functionList)-1
+// runStage chooses the correct stage function to run, and runs it. Source stages produce items, sink stages consume
+// them, and every other stage receives items from its upstream stages and sends its results to its downstream stages.
+func runStage(options *common.WorkerOptions, pipeline *types.Pipeline, listener net.Listener) {
+	stage := pipeline.Stages[options.Position]
 	// Get data from previous worker, process it, and send results to the next worker
 	logPrint("My position is " + strconv.Itoa(options.Position))
-	if options.Position == 0 {
+	if pipeline.IsSource(options.Position) {
 		// waitForStartCommand(listener)
-		runFirstStage(listener, functionList, options.StageID, registerType, options.MasterAddress)
-	} else if isLastStage {
-		runLastStage(listener, functionList, options.StageID, registerType, options.MasterAddress)
+		runFirstStage(stage, options.StageID)
+	} else if pipeline.IsSink(options.Position) {
+		runLastStage(listener, stage, options.StageID, options.MasterAddress, options.SendResults, pipeline.GetCodec(),
+			pipeline.GetCompression())
 	} else {
-		runIntermediateStage(listener, functionList, options.StageID, options.Position, registerType, options.MasterAddress)
+		runIntermediateStage(listener, stage, options.StageID)
 	}
 }
 
 // Run the worker routine
-func Run(options *common.WorkerOptions, functionList []types.AnyFunc, registerType interface{}) {
+func Run(options *common.WorkerOptions, pipeline *types.Pipeline) {
+	pipeline.Register()
 	StageID = options.StageID
 	StageNumber = strconv.Itoa(options.Position)
-	go trackStatsGoroutine(options.MasterAddress, options.StageID)
-
-	// Listens for both the master and any other connection
+	stagePosition = options.Position
+	queueCapacity = options.QueueCapacity
+	if options.TLS {
+		identity, err := protocol.ReadIdentity(os.Stdin)
+		if err != nil {
+			panic(err)
+		}
+		if err = protocol.UseIdentity(identity); err != nil {
+			panic(err)
+		}
+	}
+	connections = NewStageConnections(pipeline, options.Position)
+	emitSkips = pipeline.OrderedDownstream(options.Position)
+	restoredOrigin = options.Origin
+	restoredSequence = options.Resume
+	setUpState(pipeline.Stages[options.Position], options.AwaitState, options.CheckpointInterval)
+	control = NewControlSession(options.MasterAddress)
+	go trackStatsGoroutine()
+
+	// Listens for the results of the previous workers
 	myAddress := common.GetOutboundIPAddressHack()
 	listener, err := net.Listen("tcp", myAddress+":0")
 	if err != err {
@@ -123,6 +138,6 @@ func Run(options *common.WorkerOptions, functionList []types.AnyFunc, registerTy
 	// Sends my address as a struct data to the master.
 	myPortNumber := common.GetPortNumberFromListener(listener)
 	myNetAddress := common.CombineAddressAndPort(myAddress, myPortNumber)
-	sendInfoToMaster(options.MasterAddress, options.StageID, myNetAddress)
-	runStage(options, functionList, listener, registerType)
+	sendInfoToMaster(myNetAddress, pipeline)
+	runStage(options, pipeline, listener)
 }